@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bisectImages expands the arguments of the bisect subcommand, oldest first,
+// into emulator images. A bare tag such as 1.5.50 is taken from the
+// repository of -emulator-image, and a range such as 1.5.40..1.5.50 stands
+// for every patch version from the first to the last.
+func bisectImages(args []string) ([]string, error) {
+	repo := emulatorImageName()
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	var tags []string
+	for _, arg := range args {
+		from, to, ok := strings.Cut(arg, "..")
+		if !ok {
+			tags = append(tags, arg)
+			continue
+		}
+		fromPrefix, fromPatch, _ := cutLast(from, ".")
+		toPrefix, toPatch, _ := cutLast(to, ".")
+		first, err1 := strconv.Atoi(fromPatch)
+		last, err2 := strconv.Atoi(toPatch)
+		if fromPrefix != toPrefix || err1 != nil || err2 != nil || first > last {
+			return nil, fmt.Errorf("bisect: range %s must run from a lower to a higher patch version of the same minor version", arg)
+		}
+		for p := first; p <= last; p++ {
+			tags = append(tags, fmt.Sprintf("%s.%d", fromPrefix, p))
+		}
+	}
+	if len(tags) < 2 {
+		return nil, fmt.Errorf("bisect: need at least two emulator versions, got %d", len(tags))
+	}
+	images := make([]string, len(tags))
+	for i, tag := range tags {
+		if strings.Contains(tag, ":") {
+			images[i] = tag
+		} else {
+			images[i] = repo + ":" + tag
+		}
+	}
+	return images, nil
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// bisect implements the bisect subcommand: it runs run against a fresh
+// emulator of each of images, oldest first, as few times as a binary search
+// needs, and reports the first image with which the write is lost. It
+// assumes that the bug, once introduced, stays; the oldest image must pass
+// and the newest must lose the write.
+func bisect(run func(context.Context) error, images []string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		outcomes := make(map[int]string)
+		probe := func(i int) (string, error) {
+			if o, ok := outcomes[i]; ok {
+				return o, nil
+			}
+			log.Printf("bisect: === %s ===", images[i])
+			err := runWithEmulator(ctx, run, images[i])
+			o := outcome(err)
+			log.Printf("bisect: %s: %s", images[i], o)
+			if o == "ERROR" {
+				return o, fmt.Errorf("bisect: %s: %w", images[i], err)
+			}
+			outcomes[i] = o
+			return o, nil
+		}
+
+		lo, hi := 0, len(images)-1
+		if o, err := probe(hi); err != nil {
+			return err
+		} else if o != "BUG" {
+			return fmt.Errorf("bisect: the newest version %s does not lose the write", images[hi])
+		}
+		if o, err := probe(lo); err != nil {
+			return err
+		} else if o == "BUG" {
+			return fmt.Errorf("bisect: the oldest version %s already loses the write", images[lo])
+		}
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			o, err := probe(mid)
+			if err != nil {
+				return err
+			}
+			if o == "BUG" {
+				hi = mid
+			} else {
+				lo = mid
+			}
+		}
+		log.Printf("bisect: first version losing the write: %s (last passing: %s, %d of %d versions run)",
+			images[hi], images[lo], len(outcomes), len(images))
+		return nil
+	}
+}
+
+// runWithEmulator sets up and runs run against a fresh emulator of image,
+// removing it afterwards.
+func runWithEmulator(ctx context.Context, run func(context.Context) error, image string) error {
+	enterPhase("emulator")
+	e, err := startDockerEmulator(ctx, image)
+	if err != nil {
+		return stepError(stepSetup, err)
+	}
+	autoEmulator = e
+	defer func() {
+		e.stop()
+		autoEmulator = nil
+	}()
+	*restHost = e.restHost
+	if err := os.Setenv("SPANNER_EMULATOR_HOST", e.grpcHost); err != nil {
+		return stepError(stepSetup, err)
+	}
+	if err := setup(ctx); err != nil {
+		return stepError(stepSetup, fmt.Errorf("setup: %w", err))
+	}
+	return run(ctx)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBisectImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		args    []string
+		wantErr bool
+		want    []string
+	}{
+		{name: "tags", args: []string{"1.5.40", "1.5.50"},
+			want: []string{"gcr.io/cloud-spanner-emulator/emulator:1.5.40", "gcr.io/cloud-spanner-emulator/emulator:1.5.50"}},
+		{name: "range", args: []string{"1.5.40..1.5.42"},
+			want: []string{"gcr.io/cloud-spanner-emulator/emulator:1.5.40", "gcr.io/cloud-spanner-emulator/emulator:1.5.41", "gcr.io/cloud-spanner-emulator/emulator:1.5.42"}},
+		{name: "image", args: []string{"1.5.40", "example.com/emulator:dev"},
+			want: []string{"gcr.io/cloud-spanner-emulator/emulator:1.5.40", "example.com/emulator:dev"}},
+		{name: "emulator-image with a registry port", image: "localhost:5000/emulator:latest", args: []string{"1.5.40", "1.5.41"},
+			want: []string{"localhost:5000/emulator:1.5.40", "localhost:5000/emulator:1.5.41"}},
+		{name: "one version", args: []string{"1.5.40"}, wantErr: true},
+		{name: "descending range", args: []string{"1.5.42..1.5.40"}, wantErr: true},
+		{name: "range across minor versions", args: []string{"1.4.9..1.5.1"}, wantErr: true},
+	}
+	defer func(orig string) { *emulatorImage = orig }(*emulatorImage)
+	t.Setenv("EMULATOR_IMAGE", "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*emulatorImage = tt.image
+			got, err := bisectImages(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("bisectImages(%q) = %q, want an error", tt.args, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bisectImages(%q): %v", tt.args, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("bisectImages(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
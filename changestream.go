@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+)
+
+// changeStream is the change stream on T that -verify=changestream reads.
+// Setup creates it only for that mode.
+const changeStream = "ReproStream"
+
+// changeStreamDDL returns the statement creating changeStream.
+func changeStreamDDL() string {
+	return "CREATE CHANGE STREAM " + changeStream + sqlFor(" FOR T")
+}
+
+// ensureChangeStream creates changeStream in the existing database db if it
+// does not have it yet.
+func ensureChangeStream(ctx context.Context, dc *database.DatabaseAdminClient, db string) error {
+	resp, err := dc.GetDatabaseDdl(ctx, &databasepb.GetDatabaseDdlRequest{Database: db})
+	if err != nil {
+		return fmt.Errorf("get database DDL: %w", err)
+	}
+	for _, stmt := range resp.GetStatements() {
+		if strings.HasPrefix(stmt, "CREATE CHANGE STREAM "+changeStream+" ") {
+			return nil
+		}
+	}
+	return updateDDLFor(ctx, db, changeStreamDDL())
+}
+
+// changeRecord, dataChangeRecord, and childPartitionsRecord are the parts of
+// a ChangeRecord row of the change stream query that
+// -verify=changestream looks at.
+type changeRecord struct {
+	DataChangeRecord      []*dataChangeRecord      `spanner:"data_change_record"`
+	ChildPartitionsRecord []*childPartitionsRecord `spanner:"child_partitions_record"`
+}
+
+type dataChangeRecord struct {
+	CommitTimestamp time.Time `spanner:"commit_timestamp"`
+	TableName       string    `spanner:"table_name"`
+	ModType         string    `spanner:"mod_type"`
+	Mods            []*struct {
+		Keys spanner.NullJSON `spanner:"keys"`
+	} `spanner:"mods"`
+}
+
+type childPartitionsRecord struct {
+	StartTimestamp  time.Time `spanner:"start_timestamp"`
+	ChildPartitions []*struct {
+		Token string `spanner:"token"`
+	} `spanner:"child_partitions"`
+}
+
+// checkChangeStream reads changeStream from the INSERT's commit up to now and
+// logs the DELETE data change records for the row pk, as an independent
+// account of whether the DELETE was applied: a row that survived the DELETE
+// with a record of it means the commit was applied but reads do not see it,
+// while one without a record means the commit never was.
+func checkChangeStream(ctx context.Context, client *spanner.Client, pk int64, survived bool) error {
+	start := commitTime("insert")
+	if start.IsZero() {
+		log.Printf("changestream: no INSERT commit timestamp to read from")
+		return nil
+	}
+	end := time.Now()
+	key := strconv.FormatInt(pk, 10)
+
+	var deletes []time.Time
+	// The query for the NULL token returns the first partitions; each
+	// partition may split into children, read from their start.
+	type partition struct {
+		token spanner.NullString
+		start time.Time
+	}
+	queue := []partition{{start: start}}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		stmt := spanner.Statement{
+			SQL: "SELECT ChangeRecord FROM READ_" + changeStream + " (start_timestamp => @start, end_timestamp => @end, " +
+				"partition_token => @token, heartbeat_milliseconds => 10000)",
+			Params: map[string]any{"start": p.start, "end": end, "token": p.token},
+		}
+		err := client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			var r struct {
+				ChangeRecord []*changeRecord `spanner:"ChangeRecord"`
+			}
+			if err := row.ToStructLenient(&r); err != nil {
+				return err
+			}
+			for _, cr := range r.ChangeRecord {
+				for _, d := range cr.DataChangeRecord {
+					if d.TableName != *table || d.ModType != "DELETE" {
+						continue
+					}
+					for _, m := range d.Mods {
+						if keys, ok := m.Keys.Value.(map[string]any); ok && fmt.Sprint(keys[*pkColumn]) == key {
+							deletes = append(deletes, d.CommitTimestamp)
+						}
+					}
+				}
+				for _, c := range cr.ChildPartitionsRecord {
+					for _, child := range c.ChildPartitions {
+						if !seen[child.Token] {
+							seen[child.Token] = true
+							queue = append(queue, partition{token: spanner.NullString{StringVal: child.Token, Valid: true}, start: c.StartTimestamp})
+						}
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("read change stream %s: %w", changeStream, err)
+		}
+	}
+
+	for _, ts := range deletes {
+		log.Printf("changestream: DELETE of PK=%d recorded at %s", pk, ts.Format(time.RFC3339Nano))
+	}
+	switch {
+	case survived && len(deletes) > 0:
+		log.Printf("changestream: the DELETE was applied, but reads still see PK=%d", pk)
+	case survived:
+		log.Printf("changestream: no DELETE of PK=%d recorded; the commit was never applied", pk)
+	case len(deletes) == 0:
+		log.Printf("changestream: PK=%d is gone, but no DELETE of it was recorded", pk)
+	}
+	return nil
+}
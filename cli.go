@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// subcommand is a subcommand of the command line. A flat subcommand runs as
+// if there were none, after setting its flag, if any, unless that is given
+// too: go run . matrix is go run . -matrix. Flags after the subcommand are
+// parsed with a FlagSet of its own holding flags, or every flag if flags is
+// nil.
+type subcommand struct {
+	flat        bool
+	flag, value string
+	flags       []string
+}
+
+// targetFlags are the flags choosing the database and reporting the result,
+// which every subcommand honors.
+var targetFlags = []string{
+	"project", "instance", "database", "real", "emulator", "emulator-image", "protocol", "rest-host",
+	"setup-retries", "timeout", "output", "output-file", "exit-only", "v", "trace", "trace-rpc", "trace-callers", "otel-endpoint",
+}
+
+var subcommands = map[string]subcommand{
+	"run":             {flat: true},
+	"matrix":          {flat: true, flag: "matrix", value: "true"},
+	"list":            {flat: true, flag: "list", value: "true", flags: []string{}},
+	"stress":          {flat: true, flag: "scenario", value: "stress"},
+	"setup":           {flags: append([]string{"dialect", "ddl-file", "table", "pk-column", "schema", "verify", "verify-via", "typed-values", "clear-existing"}, targetFlags...)},
+	"teardown":        {flags: targetFlags},
+	"bisect":          {},
+	"client-versions": {},
+	"report":          {},
+	"fuzz":            {},
+}
+
+// forwardedFlag is a flag of a subcommand's FlagSet that sets the flag of
+// the same name in the command line's FlagSet, so that flag.Visit and
+// flagSet see it there.
+type forwardedFlag struct {
+	cl *flag.FlagSet
+	f  *flag.Flag
+}
+
+func (v forwardedFlag) String() string {
+	if v.f == nil {
+		return ""
+	}
+	return v.f.Value.String()
+}
+
+func (v forwardedFlag) Set(s string) error { return v.cl.Set(v.f.Name, s) }
+
+func (v forwardedFlag) IsBoolFlag() bool {
+	b, ok := v.f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// subcommandFlagSet returns the FlagSet of the subcommand name, forwarding
+// the flags of cl it honors.
+func subcommandFlagSet(cl *flag.FlagSet, name string, sub subcommand) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(cl.Output())
+	add := func(f *flag.Flag) { fs.Var(forwardedFlag{cl, f}, f.Name, f.Usage) }
+	if sub.flags == nil {
+		cl.VisitAll(add)
+		return fs
+	}
+	for _, n := range sub.flags {
+		if f := cl.Lookup(n); f != nil {
+			add(f)
+		}
+	}
+	return fs
+}
+
+// parseCommandLine parses args into cl, flag.CommandLine outside of tests.
+// Flags may come before the subcommand, as they always could, or after it,
+// as in go run . matrix -delete=apply, where only the subcommand's own
+// flags are accepted; either way cl.Arg(0) is the subcommand afterward, or
+// "" for none, with its own arguments following it.
+func parseCommandLine(cl *flag.FlagSet, args []string) error {
+	if err := cl.Parse(args); err != nil {
+		return err
+	}
+	if cl.NArg() == 0 {
+		return nil
+	}
+	name := cl.Arg(0)
+	sub, ok := subcommands[name]
+	if !ok {
+		err := fmt.Errorf("unknown subcommand: %s", name)
+		fmt.Fprintln(cl.Output(), err)
+		return err
+	}
+	fs := subcommandFlagSet(cl, name, sub)
+	if err := fs.Parse(cl.Args()[1:]); err != nil {
+		return err
+	}
+	rest := fs.Args()
+	if sub.flat {
+		if sub.flag != "" && !isFlagSet(cl, sub.flag) {
+			if err := cl.Set(sub.flag, sub.value); err != nil {
+				return err
+			}
+		}
+		return cl.Parse(append([]string{"--"}, rest...))
+	}
+	return cl.Parse(append([]string{"--", name}, rest...))
+}
+
+// flagSet reports whether the flag name was given on the command line.
+func flagSet(name string) bool {
+	return isFlagSet(flag.CommandLine, name)
+}
+
+// isFlagSet reports whether the flag name of fs was set.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
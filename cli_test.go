@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		// wantFlags are the flags set afterward, with their values.
+		wantFlags map[string]string
+		wantArgs  []string
+	}{
+		{name: "flat", args: []string{"-delete=apply", "-begin=inlined"},
+			wantFlags: map[string]string{"delete": "apply", "begin": "inlined"}},
+		{name: "flags before the subcommand", args: []string{"-delete=apply", "setup"},
+			wantFlags: map[string]string{"delete": "apply"}, wantArgs: []string{"setup"}},
+		{name: "flags after the subcommand", args: []string{"setup", "-project=p"},
+			wantFlags: map[string]string{"project": "p"}, wantArgs: []string{"setup"}},
+		{name: "flag the subcommand does not honor", args: []string{"setup", "-delete=apply"}, wantErr: true},
+		{name: "flag alias", args: []string{"matrix", "-delete=apply"},
+			wantFlags: map[string]string{"matrix": "true", "delete": "apply"}},
+		{name: "flag alias given explicitly", args: []string{"-scenario=raw", "stress"},
+			wantFlags: map[string]string{"scenario": "raw"}},
+		{name: "run", args: []string{"run", "-begin=explicit"},
+			wantFlags: map[string]string{"begin": "explicit"}},
+		{name: "bisect arguments", args: []string{"-v=1", "bisect", "-delete=apply", "1.5.40..1.5.50"},
+			wantFlags: map[string]string{"v": "1", "delete": "apply"}, wantArgs: []string{"bisect", "1.5.40..1.5.50"}},
+		{name: "list takes no flags", args: []string{"list", "-v=1"}, wantErr: true},
+		{name: "unknown subcommand", args: []string{"nosuch"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := flag.NewFlagSet("test", flag.ContinueOnError)
+			cl.SetOutput(io.Discard)
+			cl.String("delete", "stmt-mutation", "")
+			cl.String("begin", "default", "")
+			cl.String("project", "test-project", "")
+			cl.String("scenario", "", "")
+			cl.Int("v", 0, "")
+			cl.Bool("matrix", false, "")
+			cl.Bool("list", false, "")
+
+			err := parseCommandLine(cl, tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCommandLine(%q) succeeded, want an error", tt.args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCommandLine(%q): %v", tt.args, err)
+			}
+			got := make(map[string]string)
+			cl.Visit(func(f *flag.Flag) { got[f.Name] = f.Value.String() })
+			if len(got) != len(tt.wantFlags) {
+				t.Errorf("flags set = %v, want %v", got, tt.wantFlags)
+			}
+			for name, want := range tt.wantFlags {
+				if got[name] != want {
+					t.Errorf("-%s = %q, want %q", name, got[name], want)
+				}
+			}
+			if len(cl.Args())+len(tt.wantArgs) > 0 && !slices.Equal(cl.Args(), tt.wantArgs) {
+				t.Errorf("args = %q, want %q", cl.Args(), tt.wantArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// spannerModule is the client library module pinned by client-versions.
+const spannerModule = "cloud.google.com/go/spanner"
+
+// childSkippedFlags are the flags client-versions keeps to itself rather than
+// passing to each build: the builds share one database, dropped once at the
+// end, and report through the log rather than their own result file.
+var childSkippedFlags = map[string]bool{"cleanup": true, "output": true, "output-file": true}
+
+// clientVersions implements the client-versions subcommand: for each of
+// versions of the client library it copies this module, from the current
+// directory, to a temporary directory, pins the library there with go get,
+// builds it, and runs the scenario selected by the other flags. It fails
+// like -matrix: with errWriteLost if any version lost the write.
+func clientVersions(ctx context.Context, versions []string) error {
+	if len(versions) == 0 {
+		return errors.New("client-versions: no versions given")
+	}
+	src, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(src, "go.mod")); err != nil {
+		return fmt.Errorf("client-versions must run from the module directory: %w", err)
+	}
+	if *emulatorMode != "" {
+		// Each build starts and removes its own emulator, leaving
+		// nothing for -cleanup here.
+		*cleanup = false
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if childSkippedFlags[f.Name] {
+			return
+		}
+		if l, ok := f.Value.(*stringList); ok {
+			for _, v := range *l {
+				args = append(args, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+
+	outcomes := make([]string, len(versions))
+	var bugs, errs int
+	for i, v := range versions {
+		enterPhase("client " + v)
+		o, err := runClientVersion(ctx, src, v, args)
+		if err != nil {
+			log.Printf("client-versions: %s: %s: %v", v, o, err)
+		} else {
+			log.Printf("client-versions: %s: %s", v, o)
+		}
+		outcomes[i] = o
+		switch o {
+		case "BUG":
+			bugs++
+		case "ERROR":
+			errs++
+		}
+	}
+	for i, v := range versions {
+		log.Printf("%-6s %s@%s", outcomes[i], spannerModule, v)
+	}
+
+	switch {
+	case bugs > 0:
+		return fmt.Errorf("%w: %d of %d client versions lost the write", errWriteLost, bugs, len(versions))
+	case errs > 0:
+		return fmt.Errorf("%d of %d client versions failed", errs, len(versions))
+	}
+	return nil
+}
+
+// runClientVersion builds the module in src against version of the client
+// library and runs it with args, returning the outcome its exit code stands
+// for.
+func runClientVersion(ctx context.Context, src, version string, args []string) (string, error) {
+	dir, err := os.MkdirTemp("", "repro-"+version+"-")
+	if err != nil {
+		return "ERROR", err
+	}
+	defer os.RemoveAll(dir)
+	if err := copyModule(src, dir); err != nil {
+		return "ERROR", err
+	}
+	for _, cmd := range [][]string{
+		{"go", "get", spannerModule + "@" + version},
+		{"go", "build", "-o", "repro", "."},
+	} {
+		c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			return "ERROR", fmt.Errorf("%s: %w\n%s", strings.Join(cmd, " "), err, out)
+		}
+	}
+
+	c := exec.CommandContext(ctx, filepath.Join(dir, "repro"), args...)
+	c.Stdout, c.Stderr = os.Stderr, os.Stderr
+	err = c.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return "PASS", nil
+	case errors.As(err, &exit) && exit.ExitCode() == exitBug:
+		return "BUG", nil
+	default:
+		return "ERROR", err
+	}
+}
+
+// copyModule copies the module files in src and its package directories,
+// other than tests, to dst.
+func copyModule(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if rel != "." && (strings.HasPrefix(name, ".") || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		}
+		if !(name == "go.mod" || name == "go.sum" || strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")) {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), b, 0o644)
+	})
+}
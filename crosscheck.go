@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// reproduceCrossCheck makes the -op write twice, in two independent
+// statement-based transactions with -begin: to PK=1 with DML, as
+// -delete=stmt-dml does, and to PK=2 with a buffered mutation, as
+// -delete=stmt-mutation does. It then reads T once and compares what each
+// path left behind, so that a write lost through one API path but not the
+// other shows in a single run. -delete is ignored; -keyset must be single.
+func reproduceCrossCheck(ctx context.Context) error {
+	switch {
+	case *op == "replace":
+		return fmt.Errorf("-cross-check needs a DML form of -op, which replace has not")
+	case *keySet != "single":
+		return fmt.Errorf("-cross-check writes one row per path; -keyset=%s would cover the other path's row", *keySet)
+	case *deleteSQL != "":
+		return fmt.Errorf("-cross-check writes PK=2 with DML as well; drop -delete-sql")
+	}
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := clearTable(ctx, client); err != nil {
+		return stepError(stepSetup, fmt.Errorf("reset: %w", err))
+	}
+	enterPhase("insert")
+	if _, err := client.Apply(ctx, []*spanner.Mutation{
+		spanner.InsertOrUpdate(*table, []string{*pkColumn, "Val"}, []any{1, 1}),
+		spanner.InsertOrUpdate(*table, []string{*pkColumn, "Val"}, []any{2, 2}),
+	}, spanner.TransactionTag(runTag())); err != nil {
+		return stepError(stepInsert, fmt.Errorf("insert: %w", err))
+	}
+	log.Printf("INSERT PK=1 and PK=2 committed")
+
+	paths := []struct {
+		name  string
+		pk    int64
+		write func(pk int64) (time.Time, error)
+	}{
+		{"DML", 1, func(pk int64) (time.Time, error) {
+			_, _, stmt := writeFor(pk)
+			commitTs, rowCount, err := execStmtDML(ctx, client, txnOpts, txnHooks{}, stmt)
+			if err == nil {
+				log.Printf("DML: server reported %d row(s) affected", rowCount)
+			}
+			return commitTs, err
+		}},
+		{"mutation", 2, func(pk int64) (time.Time, error) {
+			_, m, _ := writeFor(pk)
+			return execStmtMutation(ctx, client, txnOpts, txnHooks{}, m)
+		}},
+	}
+	label := strings.ToUpper(*op)
+	for _, p := range paths {
+		enterPhase(strings.ToLower(p.name))
+		log.Printf("%s PK=%d: StmtBasedTransaction (%s, begin=%s)", label, p.pk, p.name, *beginMode)
+		commitTs, err := p.write(p.pk)
+		if err != nil {
+			return stepError(stepDelete, fmt.Errorf("%s path: %s PK=%d: %w", p.name, strings.ToLower(label), p.pk, err))
+		}
+		log.Printf("%s PK=%d via %s committed at %s", label, p.pk, p.name, commitTs.Format(time.RFC3339Nano))
+	}
+
+	enterPhase("verify")
+	rows, err := readRows(ctx, client)
+	if err != nil {
+		return stepError(stepVerify, err)
+	}
+	var applied, lost []string
+	for _, p := range paths {
+		pk := writtenPK(p.pk)
+		val, exists := rows[pk]
+		ok := !exists
+		state := "no row"
+		if exists {
+			ok = *op != "delete" && val.Valid && val.Int64 == updatedVal
+			state = fmt.Sprintf("Val=%v", val)
+		}
+		result := "applied"
+		if !ok {
+			result = "LOST"
+			lost = append(lost, fmt.Sprintf("%s (PK=%d has %s)", p.name, pk, state))
+		} else {
+			applied = append(applied, p.name)
+		}
+		log.Printf("cross-check: %s via %s: PK=%d has %s: %s", label, p.name, pk, state, result)
+	}
+	switch {
+	case len(lost) == 0:
+		log.Printf("cross-check: both paths applied the %s", label)
+		return nil
+	case len(applied) == 0:
+		return stepError(stepVerify, fmt.Errorf("%w: %s lost through both paths: %s", errWriteLost, label, strings.Join(lost, ", ")))
+	default:
+		return stepError(stepVerify, fmt.Errorf("%w: %s lost through %s but applied through %s", errWriteLost, label, strings.Join(lost, ", "), strings.Join(applied, ", ")))
+	}
+}
@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// reproduceThreeClients runs each step on its own client so that the DELETE
+// is the first transaction on a cold multiplexed session.
+func reproduceThreeClients(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	var reported int64
+	var commitTs time.Time
+	steps := []struct {
+		name string
+		run  func(*spanner.Client) error
+	}{
+		{"A (insert)", func(c *spanner.Client) error { return insertRow(ctx, c) }},
+		{"B (delete)", func(c *spanner.Client) (err error) {
+			reported, commitTs, err = deleteRow(ctx, c, txnOpts, deleteHooks())
+			return err
+		}},
+		{"C (verify)", func(c *spanner.Client) error { return checkReported(verifyDeleted(ctx, c, commitTs), reported) }},
+	}
+	for _, step := range steps {
+		rec := &sessionRecorder{}
+		client, err := newClient(ctx, rec.clientOptions()...)
+		if err != nil {
+			return err
+		}
+		err = step.run(client)
+		client.Close()
+		log.Printf("client %s sessions: %s", step.name, rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reproduceVerifyReopen verifies the DELETE with the client that issued it and
+// again with a new client, so that any state cached by the first client
+// (sessions, transactions) cannot influence the second read.
+func reproduceVerifyReopen(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	var reported int64
+	var commitTs time.Time
+	err = insertRow(ctx, client)
+	if err == nil {
+		reported, commitTs, err = deleteRow(ctx, client, txnOpts, deleteHooks())
+	}
+	if err != nil {
+		client.Close()
+		return err
+	}
+	originalErr := checkReported(verifyDeleted(ctx, client, commitTs), reported)
+	client.Close()
+
+	if err := describeDatabase(ctx); err != nil {
+		return fmt.Errorf("get database: %w", err)
+	}
+
+	client, err = newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	reopenedErr := checkReported(verifyDeleted(ctx, client, commitTs), reported)
+
+	log.Printf("verify with original client: %s, with reopened client: %s", outcome(originalErr), outcome(reopenedErr))
+	if outcome(originalErr) != outcome(reopenedErr) {
+		return fmt.Errorf("verification differs between clients (original: %v, reopened: %v)", originalErr, reopenedErr)
+	}
+	return reopenedErr
+}
+
+// describeDatabase logs the identity of the database so that runs reopening
+// it can confirm they are talking to the same one.
+func describeDatabase(ctx context.Context) error {
+	dc, err := newDatabaseAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	d, err := dc.GetDatabase(ctx, &databasepb.GetDatabaseRequest{Name: databaseName()})
+	if err != nil {
+		return err
+	}
+	log.Printf("database %s: state=%s created=%s", d.GetName(), d.GetState(), d.GetCreateTime().AsTime().Format(time.RFC3339Nano))
+	return nil
+}
+
+// reproduceIsolationCheck reads the deleted rows from a separate single-use
+// transaction while the DELETE is buffered but not yet committed, and again
+// after commit both at that pre-commit timestamp and strongly. Only the
+// strong read after commit should miss them. The read runs after any
+// after-write hooks the flags install.
+func reproduceIsolationCheck(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return err
+	}
+
+	pks := writePKs()
+	var preCommitTs time.Time
+	hooks := deleteHooks()
+	hooks.afterWrite = chainHooks(hooks.afterWrite, func(ctx context.Context, _ *spanner.ReadWriteTransaction) error {
+		ts, n, err := visibleRows(ctx, client.Single(), pks)
+		if err != nil {
+			return err
+		}
+		log.Printf("isolation: before commit, concurrent read at %s sees %d of %d row(s) from PK=%d", ts.Format(time.RFC3339Nano), n, len(pks), pks[0])
+		if n != len(pks) {
+			return fmt.Errorf("uncommitted DELETE is visible to a concurrent reader at %s", ts.Format(time.RFC3339Nano))
+		}
+		preCommitTs = ts
+		return nil
+	})
+	_, commitTs, err := deleteRow(ctx, client, txnOpts, hooks)
+	if err != nil {
+		return err
+	}
+
+	if preCommitTs.IsZero() {
+		log.Printf("isolation: -delete=%s has no transaction to read from before commit", *deleteMode)
+	} else {
+		ts, n, err := visibleRows(ctx, client.Single().WithTimestampBound(spanner.ReadTimestamp(preCommitTs)), pks)
+		if err != nil {
+			return err
+		}
+		log.Printf("isolation: after commit, read at pre-commit timestamp %s sees %d of %d row(s) from PK=%d", ts.Format(time.RFC3339Nano), n, len(pks), pks[0])
+		if n != len(pks) {
+			return fmt.Errorf("read at pre-commit timestamp %s sees %d of the %d deleted row(s)", ts.Format(time.RFC3339Nano), n, len(pks))
+		}
+	}
+
+	err = verifyDeleted(ctx, client, commitTs)
+	log.Printf("isolation: after commit, strong read sees the deleted row(s): %t", errors.Is(err, errWriteLost))
+	return err
+}
+
+// visibleRows returns how many of the rows pks are visible to ro and the
+// timestamp it read at.
+func visibleRows(ctx context.Context, ro *spanner.ReadOnlyTransaction, pks []int64) (time.Time, int, error) {
+	n, err := countRows(ro.Read(ctx, *table, keySetOf(pks), []string{*pkColumn}), nil)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("read: %w", err)
+	}
+	ts, err := ro.Timestamp()
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("read timestamp: %w", err)
+	}
+	return ts, n, nil
+}
+
+// reproduceCompareDMLStats deletes PK=1 with DML in a statement-based
+// transaction that returns commit stats, and checks that the row count
+// reported by ExecuteSql agrees with the mutation count reported by Commit.
+// The two numbers come from independent server code paths, so a mismatch shows
+// where the accounting diverges. -delete is ignored; -begin is honored.
+func reproduceCompareDMLStats(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	txnOpts.CommitOptions.ReturnCommitStats = true
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return err
+	}
+
+	log.Printf("DELETE: StmtBasedTransaction (DML with commit stats, begin=%s)", *beginMode)
+	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, txnOpts)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	rowCount, err := txn.Update(ctx, spanner.Statement{SQL: sqlFor("DELETE FROM T WHERE PK = 1")})
+	if err != nil {
+		txn.Rollback(ctx)
+		return fmt.Errorf("update: %w", err)
+	}
+	resp, err := txn.CommitWithReturnResp(ctx)
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	mutationCount := resp.CommitStats.GetMutationCount()
+	log.Printf("DML reported %d row(s) deleted, commit stats report %d mutation(s)", rowCount, mutationCount)
+
+	verifyErr := verifyDeleted(ctx, client, resp.CommitTs)
+	if rowCount != mutationCount {
+		return fmt.Errorf("DML row count %d disagrees with commit mutation count %d (verify: %s)", rowCount, mutationCount, outcome(verifyErr))
+	}
+	return verifyErr
+}
+
+// reproduceVerifyAfterDDL verifies the DELETE, adds a column to T, and
+// verifies again. A row whose presence changes across the schema change points
+// at state that the emulator had buffered but not yet applied. The column is
+// dropped afterwards so that the schema is unchanged for the next run.
+func reproduceVerifyAfterDDL(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return err
+	}
+	_, commitTs, err := deleteRow(ctx, client, txnOpts, deleteHooks())
+	if err != nil {
+		return err
+	}
+	beforeErr := verifyDeleted(ctx, client, commitTs)
+	log.Printf("verify before DDL: %s", outcome(beforeErr))
+
+	log.Println("DDL: ALTER TABLE T ADD COLUMN X INT64")
+	if err := updateDDL(ctx, sqlFor("ALTER TABLE T ADD COLUMN X INT64")); err != nil {
+		return fmt.Errorf("add column: %w", err)
+	}
+	afterErr := verifyDeleted(ctx, client, commitTs)
+	log.Printf("verify after DDL: %s", outcome(afterErr))
+	if err := updateDDL(ctx, sqlFor("ALTER TABLE T DROP COLUMN X")); err != nil {
+		return fmt.Errorf("drop column: %w", err)
+	}
+
+	if outcome(beforeErr) != outcome(afterErr) {
+		return fmt.Errorf("verification changed across DDL (before: %v, after: %v)", beforeErr, afterErr)
+	}
+	return afterErr
+}
+
+// updateDDL applies DDL statements to the database and waits for them to
+// complete.
+func updateDDL(ctx context.Context, stmts ...string) error {
+	return updateDDLFor(ctx, databaseName(), stmts...)
+}
+
+// updateDDLFor is updateDDL for the database db.
+func updateDDLFor(ctx context.Context, db string, stmts ...string) error {
+	dc, err := newDatabaseAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	op, err := dc.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:   db,
+		Statements: stmts,
+	})
+	if err != nil {
+		return err
+	}
+	return op.Wait(ctx)
+}
+
+// reproduceDMLMutationOrder sets Val=10 with DML and buffers a mutation
+// setting Val=20 in the same statement-based transaction. Mutations are
+// applied at commit, after all DML, so the committed value must be 20. A final
+// value of 10, or a missing row, means the buffered mutation was lost.
+// -delete is ignored; -begin is honored.
+func reproduceDMLMutationOrder(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return err
+	}
+
+	log.Printf("UPDATE: StmtBasedTransaction (DML Val=10, then BufferWrite Val=20, begin=%s)", *beginMode)
+	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, txnOpts)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	if _, err := txn.Update(ctx, spanner.Statement{SQL: sqlFor("UPDATE T SET Val = 10 WHERE PK = 1")}); err != nil {
+		txn.Rollback(ctx)
+		return fmt.Errorf("update: %w", err)
+	}
+	if err := txn.BufferWrite([]*spanner.Mutation{
+		spanner.Update(*table, []string{*pkColumn, "Val"}, []any{1, 20}),
+	}); err != nil {
+		txn.Rollback(ctx)
+		return fmt.Errorf("buffer write: %w", err)
+	}
+	if _, err := txn.CommitWithReturnResp(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	row, err := client.Single().ReadRow(ctx, *table, spanner.Key{1}, []string{"Val"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return fmt.Errorf("%w: row PK=1 is missing after UPDATE succeeded without error", errWriteLost)
+	}
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	var val spanner.NullInt64
+	if err := row.Column(0, &val); err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	log.Printf("final Val for PK=1: %v (expected 20)", val)
+	if !val.Valid || val.Int64 != 20 {
+		return fmt.Errorf("%w: Val=%v after commit, buffered mutation (Val=20) did not take effect over DML (Val=10)", errWriteLost, val)
+	}
+	return nil
+}
+
+// reproduceMixedConcurrent runs two read/write transactions on one client at
+// the same time: A deletes PK=1 with DML, B deletes PK=2 with a buffered
+// mutation. Both write, wait for each other, and then commit together, so
+// that DML- and mutation-based commits overlap on the multiplexed session.
+func reproduceMixedConcurrent(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Println("INSERT: ReadWriteTransaction (DML, PK=1 and PK=2)")
+	if _, err := client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		_, err := txn.Update(ctx, spanner.Statement{SQL: sqlFor("INSERT INTO T (PK, Val) VALUES (1, 1), (2, 2)")})
+		return err
+	}, spanner.TransactionOptions{TransactionTag: runTag()}); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+
+	var ready sync.WaitGroup
+	ready.Add(2)
+	start := make(chan struct{})
+	go func() {
+		defer exitOnPanic()
+		ready.Wait()
+		close(start)
+	}()
+
+	// concurrently runs write in a transaction and commits it once both
+	// transactions have written. The two conflict on the emulator, so an
+	// aborted attempt is retried with ResetForRetry, then without waiting.
+	concurrently := func(name string, write func(*spanner.ReadWriteStmtBasedTransaction) error) func() error {
+		return func() error {
+			var once sync.Once
+			defer once.Do(ready.Done)
+			resp, err := runStmtTxn(withRetryBudget(ctx, contentionRetries), client, txnOpts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+				err := write(txn)
+				once.Do(ready.Done)
+				if err != nil {
+					return err
+				}
+				select {
+				case <-start:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			log.Printf("%s committed at %s", name, resp.CommitTs.Format(time.RFC3339Nano))
+			return nil
+		}
+	}
+
+	log.Printf("DELETE: two concurrent StmtBasedTransactions (A: DML PK=1, B: BufferWrite PK=2, begin=%s)", *beginMode)
+	var g errgroup.Group
+	g.Go(concurrently("A", func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		_, err := txn.Update(ctx, spanner.Statement{SQL: sqlFor("DELETE FROM T WHERE PK = 1")})
+		return err
+	}))
+	g.Go(concurrently("B", func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		return txn.BufferWrite([]*spanner.Mutation{spanner.Delete(*table, spanner.Key{2})})
+	}))
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	survived, err := survivingRows(ctx, client, []int64{1, 2})
+	if err != nil {
+		return err
+	}
+	var lost []string
+	for _, w := range []struct {
+		pk    int64
+		label string
+	}{
+		{1, "A (DML DELETE PK=1)"},
+		{2, "B (mutation DELETE PK=2)"},
+	} {
+		log.Printf("%s: row exists after commit: %t", w.label, survived[w.pk])
+		if survived[w.pk] {
+			lost = append(lost, w.label)
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("%w: lost %s after both commits succeeded without error", errWriteLost, strings.Join(lost, " and "))
+	}
+	return nil
+}
+
+// reproduceDMLPlusMutation deletes PK=1 with DML and PK=2 with a buffered
+// mutation in one statement-based transaction, once with the DML first, so
+// that it carries the inlined begin, and once with the mutation first, so
+// that the transaction starts mutation-only. The commit must apply both.
+// -delete is ignored; -begin is honored.
+func reproduceDMLPlusMutation(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	dml := func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		n, err := txn.Update(ctx, spanner.Statement{SQL: sqlFor("DELETE FROM T WHERE PK = 1")})
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+		log.Printf("DML DELETE PK=1 affected %d row(s)", n)
+		return nil
+	}
+	mutation := func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		if err := txn.BufferWrite([]*spanner.Mutation{spanner.Delete(*table, spanner.Key{2})}); err != nil {
+			return fmt.Errorf("buffer write: %w", err)
+		}
+		return nil
+	}
+	var lost []string
+	for _, order := range []struct {
+		name  string
+		steps []func(*spanner.ReadWriteStmtBasedTransaction) error
+	}{
+		{"dml-first", []func(*spanner.ReadWriteStmtBasedTransaction) error{dml, mutation}},
+		{"mutation-first", []func(*spanner.ReadWriteStmtBasedTransaction) error{mutation, dml}},
+	} {
+		enterPhase(order.name)
+		log.Printf("%s: INSERT PK=1 and PK=2", order.name)
+		if _, err := client.Apply(ctx, []*spanner.Mutation{
+			spanner.InsertOrUpdate(*table, []string{*pkColumn, "Val"}, []any{1, 1}),
+			spanner.InsertOrUpdate(*table, []string{*pkColumn, "Val"}, []any{2, 2}),
+		}, spanner.TransactionTag(runTag())); err != nil {
+			return fmt.Errorf("%s: insert: %w", order.name, err)
+		}
+
+		log.Printf("%s: DELETE: StmtBasedTransaction (DML PK=1 and BufferWrite PK=2, begin=%s)", order.name, *beginMode)
+		txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, txnOpts)
+		if err != nil {
+			return fmt.Errorf("%s: begin: %w", order.name, err)
+		}
+		for _, step := range order.steps {
+			if err := step(txn); err != nil {
+				txn.Rollback(ctx)
+				return fmt.Errorf("%s: %w", order.name, err)
+			}
+		}
+		resp, err := txn.CommitWithReturnResp(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: commit: %w", order.name, err)
+		}
+		log.Printf("%s: committed at %s", order.name, resp.CommitTs.Format(time.RFC3339Nano))
+
+		survived, err := survivingRows(ctx, client, []int64{1, 2})
+		if err != nil {
+			return fmt.Errorf("%s: %w", order.name, err)
+		}
+		if survived[1] {
+			lost = append(lost, order.name+" DML DELETE PK=1")
+		}
+		if survived[2] {
+			lost = append(lost, order.name+" mutation DELETE PK=2")
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("%w: lost %s after the commits succeeded without error", errWriteLost, strings.Join(lost, " and "))
+	}
+	return nil
+}
+
+// reproduceConcurrency inserts PK=1..-concurrency and deletes every row from
+// its own goroutine with the -delete mode, all on one client, so that the
+// DELETE transactions share the multiplexed session at the same time. The
+// emulator aborts concurrent transactions, so an aborted DELETE is retried.
+func reproduceConcurrency(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	n := *concurrency
+	rows := make([]*spanner.Mutation, n)
+	for i := range rows {
+		pk := int64(i + 1)
+		rows[i] = spanner.Insert(*table, []string{*pkColumn, "Val"}, []any{pk, pk})
+	}
+	log.Printf("INSERT: client.Apply (PK=1..%d)", n)
+	if _, err := client.Apply(ctx, rows, spanner.TransactionTag(runTag())); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+
+	log.Printf("DELETE: %d goroutines, one row each (-delete=%s, begin=%s)", n, *deleteMode, *beginMode)
+	deleteErrs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer exitOnPanic()
+			defer wg.Done()
+			_, _, deleteErrs[i] = deleteRowPK(withRetryBudget(ctx, contentionRetries), client, txnOpts, deleteHooks(), int64(i+1))
+		}()
+	}
+	wg.Wait()
+
+	var deleted []int64
+	for i, derr := range deleteErrs {
+		if derr == nil {
+			deleted = append(deleted, int64(i+1))
+		}
+	}
+	survived, err := survivingRows(ctx, client, deleted)
+	if err != nil {
+		return err
+	}
+	var survivors []string
+	var failed int
+	for i, derr := range deleteErrs {
+		pk := int64(i + 1)
+		switch {
+		case derr != nil:
+			failed++
+			log.Printf("goroutine %d (PK=%d): ERROR: %v", i, pk, derr)
+		case survived[pk]:
+			survivors = append(survivors, fmt.Sprint(pk))
+			log.Printf("goroutine %d (PK=%d): BUG: row survived", i, pk)
+		default:
+			log.Printf("goroutine %d (PK=%d): PASS", i, pk)
+		}
+	}
+	log.Printf("%d/%d rows survived their DELETE, %d DELETE(s) failed", len(survivors), n, failed)
+	if len(survivors) > 0 {
+		return fmt.Errorf("%w: PK %s still exist after DELETE succeeded without error", errWriteLost, strings.Join(survivors, ", "))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d DELETEs failed", failed, n)
+	}
+	return nil
+}
+
+// reproduceLongRO runs -long-ro-cycles insert/delete/verify cycles while a
+// multi-use ReadOnlyTransaction holds a snapshot on the same client, closes
+// it, and runs the same number of cycles again, comparing how many DELETEs
+// were lost in each phase.
+func reproduceLongRO(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ro := client.ReadOnlyTransaction()
+	ts, _, err := visibleRows(ctx, ro, writePKs())
+	if err != nil {
+		ro.Close()
+		return fmt.Errorf("begin read-only transaction: %w", err)
+	}
+	log.Printf("long-ro: read-only transaction open at %s", ts.Format(time.RFC3339Nano))
+	lostOpen, err := deleteCycles(ctx, client, txnOpts)
+	if err == nil {
+		// Read again so the snapshot is still in use after the writes.
+		_, _, err = visibleRows(ctx, ro, writePKs())
+	}
+	ro.Close()
+	if err != nil {
+		return err
+	}
+	log.Println("long-ro: read-only transaction closed")
+	lostClosed, err := deleteCycles(ctx, client, txnOpts)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("long-ro: DELETE lost in %d/%d cycles with read-only transaction open, %d/%d with it closed",
+		lostOpen, *longROCycles, lostClosed, *longROCycles)
+	if lostOpen > 0 || lostClosed > 0 {
+		return fmt.Errorf("%w: DELETE lost in %d/%d cycles with read-only transaction open, %d/%d with it closed",
+			errWriteLost, lostOpen, *longROCycles, lostClosed, *longROCycles)
+	}
+	return nil
+}
+
+// deleteCycles runs -long-ro-cycles insert/delete/verify cycles on client and
+// returns the number of cycles that lost the DELETE. A lost row is removed
+// before the next cycle so that its INSERT can succeed.
+func deleteCycles(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions) (lost int, err error) {
+	for i := 1; i <= *longROCycles; i++ {
+		if err := insertRow(ctx, client); err != nil {
+			return lost, err
+		}
+		_, commitTs, err := deleteRow(ctx, client, txnOpts, deleteHooks())
+		if err != nil {
+			return lost, err
+		}
+		err = verifyDeleted(ctx, client, commitTs)
+		log.Printf("cycle %d: %s", i, outcome(err))
+		switch {
+		case errors.Is(err, errWriteLost):
+			lost++
+			if err := resetTable(ctx); err != nil {
+				return lost, fmt.Errorf("reset: %w", err)
+			}
+		case err != nil:
+			return lost, err
+		}
+	}
+	return lost, nil
+}
+
+// reproduceReuseCommitted deletes PK=1 with a statement-based transaction and
+// then calls it again after commit. Every call must return an error; one that
+// returns nil is a silent no-op, which on a multiplexed session could look
+// exactly like a lost write. -delete is ignored; -begin is honored.
+func reproduceReuseCommitted(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return err
+	}
+
+	log.Printf("DELETE: StmtBasedTransaction (BufferWrite, begin=%s)", *beginMode)
+	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, txnOpts)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	if err := txn.BufferWrite([]*spanner.Mutation{spanner.Delete(*table, spanner.Key{1})}); err != nil {
+		txn.Rollback(ctx)
+		return fmt.Errorf("buffer write: %w", err)
+	}
+	resp, err := txn.CommitWithReturnResp(ctx)
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	reuses := []struct {
+		name string
+		call func() error
+	}{
+		{"BufferWrite", func() error {
+			return txn.BufferWrite([]*spanner.Mutation{spanner.Delete(*table, spanner.Key{2})})
+		}},
+		{"Query", func() error {
+			return txn.Query(ctx, spanner.Statement{SQL: "SELECT 1"}).Do(func(*spanner.Row) error { return nil })
+		}},
+		{"Update", func() error {
+			_, err := txn.Update(ctx, spanner.Statement{SQL: sqlFor("DELETE FROM T WHERE PK = 2")})
+			return err
+		}},
+		{"CommitWithReturnResp", func() error {
+			_, err := txn.CommitWithReturnResp(ctx)
+			return err
+		}},
+	}
+	var silent []string
+	for _, r := range reuses {
+		err := r.call()
+		log.Printf("reuse after commit: %s returned %v", r.name, err)
+		if err == nil {
+			silent = append(silent, r.name)
+		}
+	}
+
+	if err := verifyDeleted(ctx, client, resp.CommitTs); err != nil {
+		return err
+	}
+	if len(silent) > 0 {
+		return fmt.Errorf("committed transaction accepted %s without error", strings.Join(silent, ", "))
+	}
+	return nil
+}
+
+// reproduceLargeBatch writes -mutation-count rows with one mutation each,
+// all buffered in one transaction with the -delete mutation mode, and
+// deletes them the same way, counting the rows of T after each commit. A
+// count between zero and -mutation-count tells a partly applied batch apart
+// from one lost whole.
+func reproduceLargeBatch(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	n := *mutationCount
+	inserts := make([]*spanner.Mutation, n)
+	deletes := make([]*spanner.Mutation, n)
+	for i := range n {
+		pk := int64(i + 1)
+		inserts[i] = spanner.Insert(*table, []string{*pkColumn, "Val"}, []any{pk, pk})
+		deletes[i] = spanner.Delete(*table, spanner.Key{pk})
+	}
+	for _, w := range []struct {
+		label string
+		ms    []*spanner.Mutation
+		want  int64
+	}{
+		{"INSERT", inserts, int64(n)},
+		{"DELETE", deletes, 0},
+	} {
+		enterPhase(strings.ToLower(w.label))
+		log.Printf("%s: %d mutations in one transaction (-delete=%s, begin=%s)", w.label, len(w.ms), *deleteMode, *beginMode)
+		start := time.Now()
+		commitTs, err := commitMutations(ctx, client, txnOpts, w.ms)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.ToLower(w.label), err)
+		}
+		log.Printf("%s committed at %s in %s", w.label, commitTs.Format(time.RFC3339Nano), time.Since(start).Round(time.Millisecond))
+
+		enterPhase("verify")
+		var got int64
+		if err := client.Single().Query(ctx, spanner.Statement{SQL: sqlFor("SELECT COUNT(*) FROM T")}).Do(func(r *spanner.Row) error {
+			return r.Column(0, &got)
+		}); err != nil {
+			return fmt.Errorf("count: %w", err)
+		}
+		log.Printf("after %s: T has %d of %d expected row(s)", w.label, got, w.want)
+		switch {
+		case got == w.want:
+		case got == int64(n)-w.want:
+			return fmt.Errorf("%w: the whole %s of %d rows was lost after its commit succeeded", errWriteLost, w.label, n)
+		default:
+			return fmt.Errorf("%w: %s of %d rows was partly lost: T has %d row(s), expected %d", errWriteLost, w.label, n, got, w.want)
+		}
+	}
+	return nil
+}
+
+// commitMutations commits ms in one transaction with the -delete mode, which
+// must be one of the modes that write with mutations alone.
+func commitMutations(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions, ms []*spanner.Mutation) (time.Time, error) {
+	switch *deleteMode {
+	case "stmt-mutation":
+		resp, err := runStmtTxn(ctx, client, txnOpts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			if err := txn.BufferWrite(ms); err != nil {
+				return fmt.Errorf("buffer write: %w", err)
+			}
+			return nil
+		})
+		return resp.CommitTs, err
+	case "rw-mutation":
+		resp, err := client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			return txn.BufferWrite(ms)
+		}, txnOpts)
+		return resp.CommitTs, err
+	case "apply":
+		return client.Apply(ctx, ms, applyOptions(spanner.ApplyCommitOptions(txnOpts.CommitOptions), spanner.TransactionTag(txnOpts.TransactionTag))...)
+	case "batchwrite":
+		return execBatchWrite(ctx, client, txnOpts, []*spanner.MutationGroup{{Mutations: ms}})
+	default:
+		return time.Time{}, fmt.Errorf("-delete=%s does not write with mutations alone; use stmt-mutation, rw-mutation, apply, or batchwrite", *deleteMode)
+	}
+}
+
+// reproduceStress runs -stress goroutines on one client, each repeating
+// insert, delete with the -delete mode, and verify -stress-iterations times
+// on its own primary key, so that whole scenarios rather than just the
+// DELETEs share the multiplexed session. An aborted DELETE is retried, and
+// one that stays aborted is counted apart from the lost writes, its row
+// removed, and the next cycle run. It reports how many cycles lost the
+// write, how many stayed aborted, and the latency of the DELETEs.
+func reproduceStress(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	n, iterations := *stress, *stressIterations
+	log.Printf("stress: %d goroutines x %d cycles (-delete=%s, begin=%s)", n, iterations, *deleteMode, *beginMode)
+	var (
+		mu            sync.Mutex
+		lost, aborted int
+		latencies     []time.Duration
+	)
+	g, gctx := errgroup.WithContext(withRetryBudget(ctx, contentionRetries))
+	for i := 0; i < n; i++ {
+		pk := int64(i + 1)
+		g.Go(func() error {
+			defer exitOnPanic()
+			for it := 1; it <= iterations; it++ {
+				row := spanner.Insert(*table, []string{*pkColumn, "Val"}, []any{pk, pk})
+				if _, err := client.Apply(gctx, []*spanner.Mutation{row}, spanner.TransactionTag(runTag())); err != nil {
+					return fmt.Errorf("PK=%d cycle %d: insert: %w", pk, it, err)
+				}
+				start := time.Now()
+				_, commitTs, err := deleteRowPK(gctx, client, txnOpts, deleteHooks(), pk)
+				if spanner.ErrCode(err) == codes.Aborted {
+					log.Printf("stress: PK=%d cycle %d: DELETE still aborted after retries: %v", pk, it, err)
+					mu.Lock()
+					aborted++
+					mu.Unlock()
+					// Apply retries aborts itself; the next cycle's INSERT
+					// needs the row gone.
+					if _, err := client.Apply(gctx, []*spanner.Mutation{spanner.Delete(*table, spanner.Key{pk})}); err != nil {
+						return fmt.Errorf("PK=%d cycle %d: cleanup: %w", pk, it, err)
+					}
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("PK=%d cycle %d: %w", pk, it, err)
+				}
+				elapsed := time.Since(start)
+				exists, readTs, err := rowExists(gctx, client, pk, []string{*pkColumn}, commitTs)
+				if err == nil {
+					err = checkReadAfterWrite(readTs, commitTs)
+				}
+				if err != nil {
+					return fmt.Errorf("PK=%d cycle %d: verify: %w", pk, it, err)
+				}
+				mu.Lock()
+				latencies = append(latencies, elapsed)
+				if exists {
+					lost++
+				}
+				mu.Unlock()
+				if exists {
+					log.Printf("stress: PK=%d cycle %d: BUG: row survived", pk, it)
+					// Remove the survivor so the next cycle's INSERT does not fail.
+					if _, err := client.Apply(gctx, []*spanner.Mutation{spanner.Delete(*table, spanner.Key{pk})}); err != nil {
+						return fmt.Errorf("PK=%d cycle %d: cleanup: %w", pk, it, err)
+					}
+				}
+			}
+			return nil
+		})
+	}
+	err = g.Wait()
+
+	total := len(latencies)
+	log.Printf("stress: %d/%d cycles lost the write; %s", lost, total, estimateLoss(lost, total))
+	log.Printf("stress: %d cycle(s) skipped with the DELETE aborted after %d retries", aborted, retryBudget(gctx))
+	log.Printf("stress: DELETE latency %s", summarizeLatencies(latencies))
+	switch {
+	case lost > 0:
+		return fmt.Errorf("%w: %d/%d stress cycles lost the write", errWriteLost, lost, total)
+	case err != nil:
+		return err
+	case total == 0:
+		return fmt.Errorf("all %d stress cycles aborted; none checked the write", aborted)
+	}
+	return nil
+}
+
+// abortOnce is a unary interceptor failing the first Commit after arm with
+// Aborted, as a conflicting transaction would, for -abort-retry. The failed
+// Commit never reaches the server.
+type abortOnce struct {
+	armed   atomic.Bool
+	commits atomic.Int32
+}
+
+func (a *abortOnce) arm() { a.armed.Store(true) }
+
+func (a *abortOnce) intercept(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if method != "/google.spanner.v1.Spanner/Commit" {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if a.armed.CompareAndSwap(true, false) {
+		log.Printf("abort-retry: injecting Aborted into Commit")
+		return status.Error(codes.Aborted, "injected by -abort-retry")
+	}
+	a.commits.Add(1)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// reproduceAbortRetry deletes PK=1 with a buffered mutation whose first Commit
+// is aborted, and verifies that the retried transaction's mutation was
+// committed. With -delete=rw-mutation the client library retries the
+// transaction function; with -delete=stmt-mutation the transaction is retried
+// with ResetForRetry, which on a multiplexed session carries the aborted
+// transaction's ID into the new one and always begins it explicitly. The retry
+// must track its own precommit token. -begin applies to the first attempt.
+func reproduceAbortRetry(ctx context.Context) error {
+	if *deleteMode != "rw-mutation" && *deleteMode != "stmt-mutation" {
+		return fmt.Errorf("-abort-retry supports -delete=rw-mutation and stmt-mutation, not %s", *deleteMode)
+	}
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	abort := &abortOnce{}
+	client, err := newClient(ctx, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(abort.intercept)))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return stepError(stepInsert, err)
+	}
+
+	enterPhase("delete")
+	abort.arm()
+	m := spanner.Delete(*table, spanner.Key{1})
+	var attempts int
+	var commitTs time.Time
+	if *deleteMode == "rw-mutation" {
+		log.Printf("DELETE: ReadWriteTransaction (BufferWrite, begin=%s), first Commit aborted", *beginMode)
+		var resp spanner.CommitResponse
+		resp, err = client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			attempts++
+			return txn.BufferWrite([]*spanner.Mutation{m})
+		}, txnOpts)
+		commitTs = resp.CommitTs
+	} else {
+		log.Printf("DELETE: StmtBasedTransaction (BufferWrite, begin=%s), first Commit aborted, retried with ResetForRetry", *beginMode)
+		var resp spanner.CommitResponse
+		resp, err = runStmtTxn(withRetryBudget(ctx, contentionRetries), client, txnOpts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			attempts++
+			if err := txn.BufferWrite([]*spanner.Mutation{m}); err != nil {
+				return fmt.Errorf("buffer write: %w", err)
+			}
+			return nil
+		})
+		commitTs = resp.CommitTs
+	}
+	if err != nil {
+		return stepError(stepDelete, fmt.Errorf("delete: %w", err))
+	}
+	log.Printf("DELETE committed at %s after %d attempt(s), %d Commit RPC(s) sent", commitTs.Format(time.RFC3339Nano), attempts, abort.commits.Load())
+	if attempts < 2 {
+		return stepError(stepDelete, fmt.Errorf("the transaction ran %d time(s); the injected abort was not retried", attempts))
+	}
+	return stepError(stepVerify, verifyDeleted(ctx, client, commitTs))
+}
+
+// cancelCommit is a unary interceptor ending the context of the DELETE at
+// its first Commit after arm, for -cancel-at=before-commit and during-commit,
+// and for after-buffer with -cancel-kind=deadline. Before the commit, the
+// Commit never reaches the server; during it, the Commit is applied and its
+// response discarded, so that the client sees a cancellation or deadline of
+// a commit that took effect. A deadline cannot be moved forward on demand,
+// so with -cancel-kind=deadline the Commit runs under one that has already
+// passed, or reports DeadlineExceeded after it returns.
+type cancelCommit struct {
+	mu     sync.Mutex
+	armed  bool
+	cancel context.CancelFunc
+}
+
+func (c *cancelCommit) arm(cancel context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.armed, c.cancel = true, cancel
+}
+
+func (c *cancelCommit) intercept(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if method != "/google.spanner.v1.Spanner/Commit" {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	c.mu.Lock()
+	armed, cancel := c.armed, c.cancel
+	c.armed, c.cancel = false, nil
+	c.mu.Unlock()
+	if !armed {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if *cancelAt != "during-commit" {
+		if *cancelKind == "deadline" {
+			log.Printf("cancel-at: running Commit with a deadline that has passed")
+			ctx, stop := context.WithDeadline(ctx, time.Now())
+			defer stop()
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		log.Printf("cancel-at: canceling the context before Commit")
+		cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if *cancelKind == "deadline" {
+		log.Printf("cancel-at: Commit returned %s; discarding the response as if its deadline passed", status.Code(err))
+		if err != nil {
+			return err
+		}
+		return status.Error(codes.DeadlineExceeded, "deadline exceeded by -cancel-at=during-commit")
+	}
+	log.Printf("cancel-at: Commit returned %s; canceling the context and discarding the response", status.Code(err))
+	cancel()
+	if err != nil {
+		return err
+	}
+	return status.Error(codes.Canceled, "context canceled by -cancel-at=during-commit")
+}
+
+// reproduceCancelAt implements -cancel-at: it deletes PK=1 with -delete and
+// -begin, cancels the DELETE's context or lets its deadline pass, as
+// -cancel-kind says, at the point -cancel-at names, and checks that the
+// DELETE failed with the matching code and that T is in the state that point
+// implies. At after-buffer and before-commit no Commit reached the server,
+// so PK=1 must still exist; during-commit the Commit was applied, so it must
+// be gone.
+func reproduceCancelAt(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	cc := &cancelCommit{}
+	client, err := newClient(ctx, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(cc.intercept)))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := insertRow(ctx, client); err != nil {
+		return stepError(stepInsert, err)
+	}
+
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hooks := deleteHooks()
+	if *cancelAt == "after-buffer" {
+		after := hooks.afterWrite
+		hooks.afterWrite = func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			if after != nil {
+				if err := after(ctx, txn); err != nil {
+					return err
+				}
+			}
+			if *cancelKind == "deadline" {
+				log.Printf("cancel-at: the DELETE was buffered; its Commit will run past its deadline")
+				cc.arm(cancel)
+				return nil
+			}
+			log.Printf("cancel-at: canceling the context after the DELETE was buffered")
+			cancel()
+			return nil
+		}
+	} else {
+		cc.arm(cancel)
+	}
+	_, _, err = deleteRow(dctx, client, txnOpts, hooks)
+	if err == nil {
+		return stepError(stepDelete, fmt.Errorf("the DELETE succeeded although its context was canceled at %s", *cancelAt))
+	}
+	want, wantErr := codes.Canceled, context.Canceled
+	if *cancelKind == "deadline" {
+		want, wantErr = codes.DeadlineExceeded, context.DeadlineExceeded
+	}
+	if spanner.ErrCode(err) != want && !errors.Is(err, wantErr) {
+		return stepError(stepDelete, fmt.Errorf("want %s: %w", want, err))
+	}
+	log.Printf("cancel-at: the DELETE failed as expected: %v", err)
+
+	enterPhase("verify")
+	// The canceled DELETE reported no commit timestamp to read at.
+	exists, readTs, err := rowExists(ctx, client, 1, []string{*pkColumn}, time.Time{})
+	if err != nil {
+		return stepError(stepVerify, err)
+	}
+	log.Printf("verify (%s) read at %s: PK=1 exists=%t", *verifyMode, readTs.Format(time.RFC3339Nano), exists)
+	switch {
+	case *cancelAt == "during-commit" && exists:
+		return fmt.Errorf("%w: the server applied the DELETE's Commit before the cancellation, but PK=1 still exists", errWriteLost)
+	case *cancelAt != "during-commit" && !exists:
+		return fmt.Errorf("%w: the DELETE was canceled at %s before any Commit reached the server, but PK=1 is gone", errWriteLost, *cancelAt)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+)
+
+// schema is the DDL for T in GoogleSQL. sqlFor translates it, like every
+// other statement, for -dialect=postgresql.
+const schema = "CREATE TABLE T (PK INT64 NOT NULL, Val INT64) PRIMARY KEY(PK)"
+
+var (
+	// ident matches the identifiers this program uses in SQL. T and PK
+	// stand for -table and -pk-column. In a PostgreSQL-dialect database they
+	// are created quoted, so that mutations and reads can keep using the
+	// same mixed-case names.
+	ident = regexp.MustCompile(`\b(T|PK|Val|X)\b`)
+	// pgParam matches GoogleSQL positional-style parameters @p1, @p2, ...
+	pgParam = regexp.MustCompile(`@p(\d+)\b`)
+	// pgPrimaryKey matches GoogleSQL's trailing PRIMARY KEY clause.
+	pgPrimaryKey = regexp.MustCompile(`\) PRIMARY KEY\((\w+)\)$`)
+)
+
+func isPostgreSQL() bool { return *dialect == "postgresql" }
+
+func databaseDialect() databasepb.DatabaseDialect {
+	if isPostgreSQL() {
+		return databasepb.DatabaseDialect_POSTGRESQL
+	}
+	return databasepb.DatabaseDialect_GOOGLE_STANDARD_SQL
+}
+
+// sqlFor returns sql, written in GoogleSQL against T(PK, Val), for -table and
+// -pk-column in the dialect selected by -dialect. Only the subset of GoogleSQL
+// this program uses is translated: identifiers are quoted, @pN parameters
+// become $N, INT64 becomes bigint, and the primary key moves inside the
+// column list.
+func sqlFor(sql string) string {
+	pg := isPostgreSQL()
+	if pg {
+		sql = pgPrimaryKey.ReplaceAllString(sql, ", PRIMARY KEY($1))")
+		sql = strings.ReplaceAll(sql, "INT64", "bigint")
+	}
+	sql = ident.ReplaceAllStringFunc(sql, func(id string) string {
+		switch id {
+		case "T":
+			id = *table
+		case "PK":
+			id = *pkColumn
+		}
+		if pg {
+			return `"` + id + `"`
+		}
+		return id
+	})
+	if !pg {
+		return sql
+	}
+	return pgParam.ReplaceAllString(sql, `$$$1`)
+}
+
+// createDatabaseStatement returns the CREATE DATABASE statement for the
+// database id in the selected dialect.
+func createDatabaseStatement(id string) string {
+	if isPostgreSQL() {
+		return `CREATE DATABASE "` + id + `"`
+	}
+	return "CREATE DATABASE `" + id + "`"
+}
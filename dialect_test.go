@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestSQLFor(t *testing.T) {
+	tests := []struct {
+		dialect string
+		sql     string
+		want    string
+	}{
+		{"googlesql", "DELETE FROM T WHERE PK = @p1", "DELETE FROM T WHERE PK = @p1"},
+		{"googlesql", schema, schema},
+		{"postgresql", "INSERT INTO T (PK, Val) VALUES (@p1, @p2)", `INSERT INTO "T" ("PK", "Val") VALUES ($1, $2)`},
+		{"postgresql", "ALTER TABLE T ADD COLUMN X INT64", `ALTER TABLE "T" ADD COLUMN "X" bigint`},
+		{"postgresql", schema, `CREATE TABLE "T" ("PK" bigint NOT NULL, "Val" bigint, PRIMARY KEY("PK"))`},
+	}
+	defer func(orig string) { *dialect = orig }(*dialect)
+	for _, tt := range tests {
+		*dialect = tt.dialect
+		if got := sqlFor(tt.sql); got != tt.want {
+			t.Errorf("-dialect=%s: sqlFor(%q) = %q, want %q", tt.dialect, tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestSQLForTable(t *testing.T) {
+	tests := []struct {
+		dialect string
+		sql     string
+		want    string
+	}{
+		{"googlesql", "UPDATE T SET Val = 10 WHERE PK = 1", "UPDATE Items SET Val = 10 WHERE Id = 1"},
+		{"googlesql", schema, "CREATE TABLE Items (Id INT64 NOT NULL, Val INT64) PRIMARY KEY(Id)"},
+		{"postgresql", "DELETE FROM T WHERE PK = @p1", `DELETE FROM "Items" WHERE "Id" = $1`},
+		{"postgresql", schema, `CREATE TABLE "Items" ("Id" bigint NOT NULL, "Val" bigint, PRIMARY KEY("Id"))`},
+	}
+	defer func(d, tbl, pk string) { *dialect, *table, *pkColumn = d, tbl, pk }(*dialect, *table, *pkColumn)
+	*table, *pkColumn = "Items", "Id"
+	for _, tt := range tests {
+		*dialect = tt.dialect
+		if got := sqlFor(tt.sql); got != tt.want {
+			t.Errorf("-dialect=%s -table=Items -pk-column=Id: sqlFor(%q) = %q, want %q", tt.dialect, tt.sql, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// insertModes are the values accepted by -insert.
+var insertModes = []string{"dml", "mutation", "apply"}
+
+// dmlDeleteModes are the -delete modes that run the DML statement rather than
+// the mutation; -delete=mixed runs a fixed UPDATE and then the mutation.
+var dmlDeleteModes = map[string]bool{
+	"stmt-dml":        true,
+	"stmt-dml-return": true,
+	"stmt-batch-dml":  true,
+	"rw-batch-dml":    true,
+	"autocommit":      true,
+	"pdml":            true,
+}
+
+// printPlan implements -dry-run: it validates the flags that select the
+// scenario and logs what a run would do, without opening any client.
+// Combinations that are valid but do not do what they appear to ask for are
+// logged as warnings.
+func printPlan() error {
+	if _, err := parseBeginOption(); err != nil {
+		return err
+	}
+	if !slices.Contains(insertModes, *insertMode) {
+		return fmt.Errorf("unknown insert mode: %s", *insertMode)
+	}
+	if !slices.Contains(deleteModes, *deleteMode) {
+		return fmt.Errorf("unknown delete mode: %s", *deleteMode)
+	}
+
+	var warnings []string
+	if *insertMode == "apply" && *beginMode != "default" {
+		warnings = append(warnings, fmt.Sprintf("-insert=apply ignores -begin=%s", *beginMode))
+	}
+	if beginIgnored(*deleteMode) && *beginMode != "default" {
+		warnings = append(warnings, fmt.Sprintf("-delete=%s ignores -begin=%s", *deleteMode, *beginMode))
+	}
+	if *insertSQL != "" && *insertMode != "dml" {
+		warnings = append(warnings, fmt.Sprintf("-insert=%s ignores -insert-sql", *insertMode))
+	}
+	if *deleteSQL != "" && !dmlDeleteModes[*deleteMode] {
+		warnings = append(warnings, fmt.Sprintf("-delete=%s ignores -delete-sql", *deleteMode))
+	}
+	if *atLeastOnce && *insertMode != "apply" && *deleteMode != "apply" {
+		warnings = append(warnings, "-at-least-once only applies to -insert=apply and -delete=apply")
+	}
+	if *deleteSQL != "" && *op != "delete" {
+		warnings = append(warnings, fmt.Sprintf("-op=%s ignores -delete-sql", *op))
+	}
+
+	if *realSpanner {
+		log.Printf("plan: Cloud Spanner database %s (instance must exist)", databaseName())
+	} else {
+		log.Printf("plan: emulator database %s", databaseName())
+	}
+	if *skipSetup {
+		log.Printf("plan: setup skipped")
+	} else {
+		ddl, err := schemaDDL()
+		if err != nil {
+			return err
+		}
+		log.Printf("plan: DDL (%s): %s", *dialect, createDatabaseStatement(*databaseID))
+		for _, stmt := range ddl {
+			log.Printf("plan: DDL (%s): %s", *dialect, stmt)
+		}
+	}
+
+	if *insertMode == "dml" {
+		log.Printf("plan: INSERT with -insert=dml -begin=%s: %s", *beginMode, insertSQLText())
+	} else {
+		log.Printf("plan: INSERT with -insert=%s: %d insert mutation(s) for PK=1..%d", *insertMode, *rows, *rows)
+	}
+
+	label, _, stmt := writeFor(1)
+	var what string
+	switch {
+	case dmlDeleteModes[*deleteMode]:
+		what = stmt.SQL
+		if *deleteMode == "stmt-dml-return" && *deleteSQL == "" {
+			what += " " + returningClause()
+		}
+		if len(stmt.Params) > 0 {
+			what += fmt.Sprintf(" with params %v", stmt.Params)
+		}
+	case *deleteMode == "mixed":
+		what = sqlFor("UPDATE T SET Val = Val + 1 WHERE PK = @p1") + ", then a buffered " + strings.ToLower(label) + " mutation"
+	default:
+		what = "a buffered " + strings.ToLower(label) + " mutation"
+	}
+	log.Printf("plan: %s with -delete=%s -begin=%s: %s", label, *deleteMode, *beginMode, what)
+	log.Printf("plan: verify with -verify=%s -verify-via=%s", *verifyMode, *verifyVia)
+
+	for _, w := range warnings {
+		log.Printf("dry run: warning: %s", w)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// dumpStaleness is how far in the past the stale read of -dump-state reads:
+// far enough that, right after a step, it usually still shows the table as
+// it was before the step.
+const dumpStaleness = time.Second
+
+// dumpCount numbers the -dump-dir files in the order they are written.
+var dumpCount int
+
+// dumpState implements -dump-state: after step, it reads every column of
+// every row of -table, once strong and once at dumpStaleness, and logs both
+// snapshots with their read timestamps, or writes each to a file in
+// -dump-dir. A failed dump is logged and does not fail the run.
+func dumpState(ctx context.Context, client *spanner.Client, step string) {
+	if !*dumpStateMode {
+		return
+	}
+	for _, read := range []struct {
+		name  string
+		bound spanner.TimestampBound
+	}{
+		{"strong", spanner.StrongRead()},
+		{"stale", spanner.ExactStaleness(dumpStaleness)},
+	} {
+		rows, readTs, err := snapshotTable(ctx, client, read.bound)
+		if err != nil {
+			log.Printf("dump after %s (%s read): %v", step, read.name, err)
+			continue
+		}
+		header := fmt.Sprintf("dump after %s (%s read at %s): %s has %d row(s)", step, read.name, readTs.Format(time.RFC3339Nano), *table, len(rows))
+		if *dumpDir == "" {
+			log.Print(header)
+			for _, r := range rows {
+				log.Printf("  %s", r)
+			}
+			continue
+		}
+		dumpCount++
+		path := filepath.Join(*dumpDir, dumpFileName(step, read.name))
+		if err := os.WriteFile(path, []byte(header+"\n"+strings.Join(append(rows, ""), "\n")), 0o644); err != nil {
+			log.Printf("dump after %s (%s read): %v", step, read.name, err)
+			continue
+		}
+		log.Printf("%s; wrote %s", header, path)
+	}
+}
+
+// dumpFileName returns the name of the -dump-dir file of the read after
+// step: its number, the -delete and -begin it ran with and, under -repeat,
+// the iteration, so that each file of a -matrix or -repeat run can be traced
+// to its cell, as in 03-apply-default-i2-delete-strong.txt.
+func dumpFileName(step, read string) string {
+	cell := *deleteMode + "-" + *beginMode
+	if repeatIteration > 0 {
+		cell += fmt.Sprintf("-i%d", repeatIteration)
+	}
+	return fmt.Sprintf("%02d-%s-%s-%s.txt", dumpCount, cell, step, read)
+}
+
+// snapshotTable reads every row of -table at bound, in key order, each
+// formatted as its COLUMN=VALUE pairs with the values in their JSON wire
+// encoding. With -nondestructive only the keys of this run are read.
+func snapshotTable(ctx context.Context, client *spanner.Client, bound spanner.TimestampBound) ([]string, time.Time, error) {
+	stmt := spanner.Statement{SQL: sqlFor("SELECT * FROM T ORDER BY PK")}
+	if *nondestructive {
+		stmt = spanner.Statement{
+			SQL:    sqlFor("SELECT * FROM T WHERE PK >= @p1 AND PK < @p2 ORDER BY PK"),
+			Params: map[string]any{"p1": pkBase, "p2": pkBase + runKeySpan},
+		}
+	}
+	ro := client.Single().WithTimestampBound(bound)
+	iter := ro.Query(ctx, stmt)
+	defer iter.Stop()
+	var rows []string
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var cols []string
+		for i, name := range row.ColumnNames() {
+			var v spanner.GenericColumnValue
+			if err := row.Column(i, &v); err != nil {
+				return nil, time.Time{}, fmt.Errorf("column %s: %w", name, err)
+			}
+			b, err := protojson.Marshal(v.Value)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("column %s: %w", name, err)
+			}
+			cols = append(cols, name+"="+string(b))
+		}
+		rows = append(rows, strings.Join(cols, " "))
+	}
+	readTs, err := ro.Timestamp()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return rows, readTs, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultEmulatorImage is the emulator version run_all_output.txt was
+// recorded with. EMULATOR_IMAGE overrides it, as it does for run_all.sh.
+const defaultEmulatorImage = "gcr.io/cloud-spanner-emulator/emulator:1.5.50"
+
+// emulatorImageName returns the image started by -emulator=auto.
+func emulatorImageName() string {
+	if *emulatorImage != "" {
+		return *emulatorImage
+	}
+	if v := os.Getenv("EMULATOR_IMAGE"); v != "" {
+		return v
+	}
+	return defaultEmulatorImage
+}
+
+// dockerEmulator is an emulator running in a Docker container, with its gRPC
+// and REST ports published on free local ports.
+type dockerEmulator struct {
+	id       string
+	grpcHost string
+	restHost string
+}
+
+// autoEmulator is the container started by -emulator=auto, removed by finish.
+var autoEmulator *dockerEmulator
+
+// startDockerEmulator runs image in a Docker container and waits until its
+// gRPC port accepts connections. Setup still retries while the emulator
+// finishes starting.
+func startDockerEmulator(ctx context.Context, image string) (*dockerEmulator, error) {
+	out, err := exec.CommandContext(ctx, "docker", "run", "-d", "--rm", "-p", "127.0.0.1::9010", "-p", "127.0.0.1::9020", image).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker run %s: %w", image, err)
+	}
+	e := &dockerEmulator{id: strings.TrimSpace(string(out))}
+	if e.grpcHost, err = e.port(ctx, "9010/tcp"); err == nil {
+		e.restHost, err = e.port(ctx, "9020/tcp")
+	}
+	if err == nil {
+		err = waitListening(ctx, e.grpcHost)
+	}
+	if err != nil {
+		e.stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+// port returns the local address the container port is published on.
+func (e *dockerEmulator) port(ctx context.Context, port string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", "port", e.id, port).Output()
+	if err != nil {
+		return "", fmt.Errorf("docker port %s: %w", port, err)
+	}
+	host, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return host, nil
+}
+
+// stop removes the container.
+func (e *dockerEmulator) stop() {
+	if err := exec.Command("docker", "rm", "-f", e.id).Run(); err != nil {
+		log.Printf("emulator: docker rm %s: %v", e.id, err)
+	}
+}
+
+// waitListening polls host until it accepts a TCP connection.
+func waitListening(ctx context.Context, host string) error {
+	for {
+		conn, err := (&net.Dialer{Timeout: time.Second}).DialContext(ctx, "tcp", host)
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("emulator at %s not listening: %w", host, ctx.Err())
+		}
+	}
+}
+
+// startAutoEmulator implements -emulator=auto: it starts the emulator and
+// points SPANNER_EMULATOR_HOST and -rest-host at it.
+func startAutoEmulator(ctx context.Context) error {
+	image := emulatorImageName()
+	enterPhase("emulator")
+	e, err := startDockerEmulator(ctx, image)
+	if err != nil {
+		return err
+	}
+	autoEmulator = e
+	log.Printf("emulator: started %s at %s (container %.12s)", image, e.grpcHost, e.id)
+	*restHost = e.restHost
+	return os.Setenv("SPANNER_EMULATOR_HOST", e.grpcHost)
+}
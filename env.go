@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// environment is the effective configuration of a run: everything a
+// reproduction shared in an issue needs besides the code. It is logged as a
+// banner at startup and included in -output=json and the report
+// subcommand's issue body.
+type environment struct {
+	LibraryVersion string            `json:"library_version"`
+	GoVersion      string            `json:"go_version"`
+	Platform       string            `json:"platform"`
+	EmulatorHost   string            `json:"emulator_host,omitempty"`
+	EmulatorImage  string            `json:"emulator_image,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Flags          map[string]string `json:"flags"`
+}
+
+// runEnvironment is the environment logged by logEnvironment, before
+// -fault pointed SPANNER_EMULATOR_HOST at its proxy.
+var runEnvironment *environment
+
+// collectEnvironment returns the current environment: the GOOGLE_CLOUD_SPANNER_*
+// variables that are set, and the value of every flag, defaults included.
+func collectEnvironment() *environment {
+	e := &environment{
+		LibraryVersion: moduleVersion("cloud.google.com/go/spanner"),
+		GoVersion:      runtime.Version(),
+		Platform:       runtime.GOOS + "/" + runtime.GOARCH,
+		EmulatorHost:   os.Getenv("SPANNER_EMULATOR_HOST"),
+		Flags:          make(map[string]string),
+	}
+	if *emulatorMode == "auto" {
+		e.EmulatorImage = emulatorImageName()
+	}
+	for _, kv := range os.Environ() {
+		if name, v, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "GOOGLE_CLOUD_SPANNER_") {
+			if e.Env == nil {
+				e.Env = make(map[string]string)
+			}
+			e.Env[name] = v
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) { e.Flags[f.Name] = f.Value.String() })
+	return e
+}
+
+// reportedEnvironment returns the environment for -output=json and the
+// report subcommand: the one logged at startup, or the current one if the
+// run ended before the banner.
+func reportedEnvironment() *environment {
+	if runEnvironment != nil {
+		return runEnvironment
+	}
+	return collectEnvironment()
+}
+
+// logEnvironment collects the environment into runEnvironment and logs it.
+func logEnvironment() {
+	e := collectEnvironment()
+	runEnvironment = e
+	log.Printf("Environment: cloud.google.com/go/spanner@%s, %s %s", e.LibraryVersion, e.GoVersion, e.Platform)
+	emulator := e.EmulatorHost
+	if e.EmulatorImage != "" {
+		emulator += " (" + e.EmulatorImage + ")"
+	}
+	log.Printf("Environment: SPANNER_EMULATOR_HOST=%s; %s", emulator, formatEnv(e.Env))
+	log.Printf("Flags: %s", strings.Join(formatFlags(e.Flags), " "))
+}
+
+// formatEnv formats env as sorted NAME=VALUE pairs.
+func formatEnv(env map[string]string) string {
+	if len(env) == 0 {
+		return "no GOOGLE_CLOUD_SPANNER_* variables set"
+	}
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		pairs = append(pairs, name+"="+env[name])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// formatFlags formats flags as sorted -name=value arguments, quoting values
+// that the shell would split.
+func formatFlags(flags map[string]string) []string {
+	var args []string
+	for _, name := range slices.Sorted(maps.Keys(flags)) {
+		v := flags[name]
+		if v == "" || strings.ContainsAny(v, " \t\"'$*?;&|<>()[]{}") {
+			v = fmt.Sprintf("%q", v)
+		}
+		args = append(args, "-"+name+"="+v)
+	}
+	return args
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+)
+
+// Exit codes. Every way the program ends maps to one of these, so that CI
+// gates and bisection scripts can run with -exit-only and ignore the output.
+const (
+	exitPass           = 0
+	exitError          = 1
+	exitBug            = 2
+	exitTimeout        = 3
+	exitSetup          = 4
+	exitUnexpectedPass = 5
+)
+
+// errUnexpectedPass marks a run that lost no write where the -expectations
+// file says it should have: the bug was fixed, or stopped reproducing.
+var errUnexpectedPass = errors.New("unexpected pass")
+
+const exitCodeHelp = `
+Subcommands:
+  setup     create the instance and database (reusing either if it exists), and exit
+  teardown  drop the database and delete the instance, and exit
+  bisect    run the scenario against each emulator VERSION (a tag, an image, or
+            a patch range such as 1.5.40..1.5.50), oldest first, in Docker, and
+            report the first version that loses the write
+  client-versions
+            build this module against each cloud.google.com/go/spanner VERSION
+            (such as v1.80.0) and run the scenario with each build
+  fuzz      commit -fuzz-txns random transactions from -seed, through every
+            write API and -begin mode, checking T against a model after each
+  report    run the scenario with -trace, then as -matrix, and write a GitHub
+            issue body with the environment, command, outcomes, and trace
+
+Exit codes:
+  0  PASS     the DELETE took effect
+  1  ERROR    the scenario failed before reaching a verdict (RPC, flag, or panic)
+  2  BUG      the DELETE reported success but the row survived
+  3  TIMEOUT  the run did not finish within -timeout
+  4  SETUP    no emulator or database to run against: SPANNER_EMULATOR_HOST
+              unset, the emulator unreachable, or instance/database setup failed
+  5  UNEXPECTED PASS
+              with -expectations, a known broken cell kept the write
+`
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [run|matrix|stress|list|setup|teardown|bisect VERSION...|client-versions VERSION...|fuzz|report] [flags]\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(flag.CommandLine.Output(), exitCodeHelp)
+}
+
+// phase is the step of the run currently in flight, reported when -timeout
+// expires so that a wedged emulator can be told apart from the bug.
+var phase atomic.Value
+
+// phaseState is the value held by phase.
+type phaseState struct {
+	name  string
+	start time.Time
+}
+
+// enterPhase records that the run has started step name, and at -v=1 logs
+// how long the previous step took.
+func enterPhase(name string) {
+	now := time.Now()
+	if prev, ok := phase.Swap(phaseState{name: name, start: now}).(phaseState); ok {
+		vlogf(1, "phase %s took %s", prev.name, now.Sub(prev.start).Round(time.Microsecond))
+		recordPhase(prev.name, now.Sub(prev.start))
+	}
+}
+
+// currentPhase returns the step most recently entered.
+func currentPhase() string {
+	if p, ok := phase.Load().(phaseState); ok {
+		return p.name
+	}
+	return "startup"
+}
+
+// step is the category of a reproError: the step of the scenario that
+// failed, or stepBugWriteLost when verification found the bug.
+type step string
+
+const (
+	stepSetup        step = "setup"
+	stepInsert       step = "insert"
+	stepDelete       step = "delete"
+	stepVerify       step = "verify"
+	stepBugWriteLost step = "bug-write-lost"
+)
+
+// reproError records which step of the scenario err came from, so that a
+// failure to reach the emulator is never mistaken for the bug.
+type reproError struct {
+	step step
+	err  error
+}
+
+func (e *reproError) Error() string { return e.err.Error() }
+func (e *reproError) Unwrap() error { return e.err }
+
+// stepError wraps a non-nil err from step s in a reproError. A verification
+// error that is errWriteLost is categorized as stepBugWriteLost.
+func stepError(s step, err error) error {
+	if err == nil {
+		return nil
+	}
+	if s == stepVerify && errors.Is(err, errWriteLost) {
+		s = stepBugWriteLost
+	}
+	return &reproError{step: s, err: err}
+}
+
+// errorStep returns the step err is categorized under, or "" if the scenario
+// did not categorize it.
+func errorStep(err error) step {
+	var re *reproError
+	if errors.As(err, &re) {
+		return re.step
+	}
+	return ""
+}
+
+// exitCode maps the result of a run to the process exit code. A setup step
+// that times out is a setup failure: an emulator that never answers is the
+// commonest way to end up there.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitPass
+	case errorStep(err) == stepBugWriteLost, errors.Is(err, errWriteLost):
+		return exitBug
+	case errors.Is(err, errUnexpectedPass):
+		return exitUnexpectedPass
+	case errorStep(err) == stepSetup:
+		return exitSetup
+	case errors.Is(err, context.DeadlineExceeded), spanner.ErrCode(err) == codes.DeadlineExceeded:
+		return exitTimeout
+	default:
+		return exitError
+	}
+}
+
+// silence discards everything the program and the libraries it uses would
+// write to stdout and stderr.
+func silence() {
+	log.SetOutput(io.Discard)
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = devNull
+		os.Stderr = devNull
+	}
+}
+
+// exitOnPanic turns a panic into exitError instead of the runtime's exit
+// status 2, which would read as BUG. Recovering only covers the goroutine
+// that panicked, so it must be deferred first in main and in every goroutine
+// the program starts, including errgroup functions and gRPC handlers.
+func exitOnPanic() {
+	if r := recover(); r != nil {
+		log.Printf("panic: %v", r)
+		os.Exit(exitError)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// expectations is the -expectations file: the -matrix cells known to lose the
+// write, as "delete/begin" (such as "stmt-mutation/explicit"), each with the
+// reason it is known broken.
+type expectations struct {
+	KnownBroken map[string]string `json:"known_broken"`
+}
+
+// knownBroken holds the cells of the -expectations file, or nil without one.
+var knownBroken map[[2]string]string
+
+// loadExpectations reads the -expectations file into knownBroken.
+func loadExpectations(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var e expectations
+	if err := json.Unmarshal(b, &e); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	knownBroken = make(map[[2]string]string)
+	for cell, reason := range e.KnownBroken {
+		d, b, ok := strings.Cut(cell, "/")
+		if !ok {
+			return fmt.Errorf("%s: cell %q is not delete/begin", path, cell)
+		}
+		if !slices.Contains(deleteModes, d) || !slices.Contains(beginModes, b) {
+			return fmt.Errorf("%s: unknown -delete or -begin in cell %q", path, cell)
+		}
+		knownBroken[[2]string{d, b}] = reason
+	}
+	return nil
+}
+
+// gateMatrix checks the outcomes of -matrix against knownBroken. Known broken
+// cells that lose the write pass the gate; any other cell that loses the
+// write is a regression, and a known broken cell that passes means the bug
+// was fixed and the expectations need updating. Both fail the gate, as does
+// any cell that errors; a known broken cell that passes is reported as
+// errUnexpectedPass only when nothing else failed.
+func gateMatrix(cells map[[2]string]string) error {
+	var regressions, fixed, errs []string
+	for _, d := range deleteModes {
+		for _, b := range beginModes {
+			o, ok := cells[[2]string{d, b}]
+			if !ok {
+				continue
+			}
+			cell := d + "/" + b
+			reason, broken := knownBroken[[2]string{d, b}]
+			switch {
+			case o == "ERROR":
+				errs = append(errs, cell)
+			case o == "BUG" && broken:
+				log.Printf("gate: %s: known broken (%s)", cell, reason)
+			case o == "BUG":
+				regressions = append(regressions, cell)
+			case broken:
+				fixed = append(fixed, cell)
+			}
+		}
+	}
+	if len(fixed) > 0 {
+		log.Printf("gate: known broken cells that passed, remove them from -expectations: %s", strings.Join(fixed, ", "))
+	}
+	switch {
+	case len(regressions) > 0:
+		return fmt.Errorf("%w: gate: %d regression(s): %s", errWriteLost, len(regressions), strings.Join(regressions, ", "))
+	case len(errs) > 0:
+		return fmt.Errorf("gate: %d cell(s) failed: %s", len(errs), strings.Join(errs, ", "))
+	case len(fixed) > 0:
+		return fmt.Errorf("%w: gate: known broken cells passed: %s", errUnexpectedPass, strings.Join(fixed, ", "))
+	}
+	log.Printf("gate: only known broken cells lost the write")
+	return nil
+}
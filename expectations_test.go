@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadExpectations(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+		// wantCells are the cells known broken afterward, with their reasons.
+		wantCells map[[2]string]string
+	}{
+		{name: "cells", json: `{"known_broken": {"stmt-mutation/explicit": "issue 282", "apply/default": "b/2"}}`,
+			wantCells: map[[2]string]string{{"stmt-mutation", "explicit"}: "issue 282", {"apply", "default"}: "b/2"}},
+		{name: "no cells", json: `{}`, wantCells: map[[2]string]string{}},
+		{name: "not JSON", json: `known_broken:`, wantErr: true},
+		{name: "cell without begin", json: `{"known_broken": {"apply": "b/1"}}`, wantErr: true},
+		{name: "unknown delete", json: `{"known_broken": {"nosuch/default": "b/1"}}`, wantErr: true},
+		{name: "unknown begin", json: `{"known_broken": {"apply/nosuch": "b/1"}}`, wantErr: true},
+	}
+	defer func(orig map[[2]string]string) { knownBroken = orig }(knownBroken)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "expectations.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := loadExpectations(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadExpectations(%s) succeeded, want an error", tt.json)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadExpectations(%s): %v", tt.json, err)
+			}
+			if len(knownBroken) != len(tt.wantCells) {
+				t.Errorf("knownBroken = %v, want %v", knownBroken, tt.wantCells)
+			}
+			for cell, want := range tt.wantCells {
+				if knownBroken[cell] != want {
+					t.Errorf("knownBroken[%s/%s] = %q, want %q", cell[0], cell[1], knownBroken[cell], want)
+				}
+			}
+		})
+	}
+}
+
+func TestGateMatrix(t *testing.T) {
+	tests := []struct {
+		name  string
+		cells map[[2]string]string
+		// wantExit is the exit code the gate's error maps to.
+		wantExit int
+	}{
+		{name: "only known broken cells lose the write",
+			cells:    map[[2]string]string{{"stmt-mutation", "explicit"}: "BUG", {"apply", "default"}: "PASS"},
+			wantExit: exitPass},
+		{name: "regression",
+			cells:    map[[2]string]string{{"stmt-mutation", "explicit"}: "BUG", {"apply", "default"}: "BUG"},
+			wantExit: exitBug},
+		{name: "error", cells: map[[2]string]string{{"stmt-mutation", "explicit"}: "BUG", {"apply", "default"}: "ERROR"},
+			wantExit: exitError},
+		{name: "fixed", cells: map[[2]string]string{{"stmt-mutation", "explicit"}: "PASS"},
+			wantExit: exitUnexpectedPass},
+		{name: "regression and fixed",
+			cells:    map[[2]string]string{{"stmt-mutation", "explicit"}: "PASS", {"apply", "default"}: "BUG"},
+			wantExit: exitBug},
+		{name: "error and fixed",
+			cells:    map[[2]string]string{{"stmt-mutation", "explicit"}: "PASS", {"apply", "default"}: "ERROR"},
+			wantExit: exitError},
+	}
+	defer func(orig map[[2]string]string) { knownBroken = orig }(knownBroken)
+	knownBroken = map[[2]string]string{{"stmt-mutation", "explicit"}: "issue 282"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := gateMatrix(tt.cells); exitCode(err) != tt.wantExit {
+				t.Errorf("gateMatrix(%v) = %v, exit code %d, want %d", tt.cells, err, exitCode(err), tt.wantExit)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// faults holds the -fault specifications.
+var faults stringList
+
+var faultPhase = flag.String("fault-phase", "delete", "phase in which -fault injects its faults, such as insert, delete, or verify; empty for any")
+
+func init() {
+	flag.Var(&faults, "fault", "METHOD:ACTION injected by a proxy between the clients and the emulator into the first call of the Spanner RPC METHOD in -fault-phase: delay=DURATION, drop (never forwarded), drop-response (forwarded, the response replaced by Unavailable), or duplicate (forwarded twice); for example Commit:drop-response (repeatable)")
+}
+
+// fault is one parsed -fault: what the proxy does to the first call of
+// method in -fault-phase.
+type fault struct {
+	method, action string
+	delay          time.Duration
+	fired          atomic.Bool
+}
+
+func (f *fault) String() string { return f.method + ":" + f.action }
+
+// parseFaults parses the -fault flags.
+func parseFaults() ([]*fault, error) {
+	var fs []*fault
+	for _, spec := range faults {
+		method, action, ok := strings.Cut(spec, ":")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("-fault=%s: want METHOD:ACTION", spec)
+		}
+		f := &fault{method: method, action: action}
+		switch {
+		case strings.HasPrefix(action, "delay="):
+			d, err := time.ParseDuration(strings.TrimPrefix(action, "delay="))
+			if err != nil {
+				return nil, fmt.Errorf("-fault=%s: %w", spec, err)
+			}
+			f.action, f.delay = "delay", d
+		case action == "drop", action == "drop-response", action == "duplicate":
+		default:
+			return nil, fmt.Errorf("-fault=%s: unknown action %s", spec, action)
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// faultProxy is an in-process gRPC proxy to the emulator, forwarding every
+// RPC as raw frames and injecting the -fault actions. Unlike an interceptor,
+// it sits below the client library's retries: a dropped response reaches
+// the client as a failed RPC that the library may retry, as a flaky network
+// would make it.
+type faultProxy struct {
+	upstream *grpc.ClientConn
+	server   *grpc.Server
+	faults   []*fault
+}
+
+// activeFaultProxy is the proxy started for -fault, stopped by finish.
+var activeFaultProxy *faultProxy
+
+// startFaultProxy starts the proxy for -fault in front of the emulator at
+// SPANNER_EMULATOR_HOST, and points SPANNER_EMULATOR_HOST at the proxy.
+func startFaultProxy() error {
+	fs, err := parseFaults()
+	if err != nil {
+		return err
+	}
+	target := os.Getenv("SPANNER_EMULATOR_HOST")
+	if target == "" {
+		return errors.New("-fault needs the emulator: SPANNER_EMULATOR_HOST is not set")
+	}
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})),
+	)
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	p := &faultProxy{upstream: conn, faults: fs}
+	p.server = grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(p.handle))
+	go p.server.Serve(lis)
+	activeFaultProxy = p
+	log.Printf("fault proxy: %s -> %s, injecting %s in phase %q", lis.Addr(), target, strings.Join(faults, ", "), *faultPhase)
+	return os.Setenv("SPANNER_EMULATOR_HOST", lis.Addr().String())
+}
+
+// stop stops the proxy, ending the calls still in flight, and closes its
+// connection to the emulator.
+func (p *faultProxy) stop() {
+	p.server.Stop()
+	if err := p.upstream.Close(); err != nil {
+		log.Printf("fault proxy: %v", err)
+	}
+}
+
+// match returns the fault to inject into a call of method, marking it fired,
+// or nil.
+func (p *faultProxy) match(method string) *fault {
+	if *faultPhase != "" && currentPhase() != *faultPhase {
+		return nil
+	}
+	for _, f := range p.faults {
+		if strings.HasSuffix(method, "/"+f.method) && f.fired.CompareAndSwap(false, true) {
+			return f
+		}
+	}
+	return nil
+}
+
+// handle forwards one RPC of any method to the emulator.
+func (p *faultProxy) handle(_ any, ss grpc.ServerStream) error {
+	defer exitOnPanic()
+	method, _ := grpc.MethodFromServerStream(ss)
+	f := p.match(method)
+	if f != nil {
+		log.Printf("fault proxy: %s: injecting %s", method, f.action)
+	}
+	switch {
+	case f == nil:
+	case f.action == "delay":
+		time.Sleep(f.delay)
+	case f.action == "drop":
+		return status.Errorf(codes.Unavailable, "dropped by -fault=%s", f)
+	}
+
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	ctx := metadata.NewOutgoingContext(ss.Context(), md.Copy())
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	cs, err := p.upstream.NewStream(ctx, desc, method)
+	if err != nil {
+		return err
+	}
+
+	var dup chan []byte
+	if f != nil && f.action == "duplicate" {
+		dup = make(chan []byte, 1)
+		go p.duplicate(ctx, method, dup)
+	}
+	go func() {
+		defer exitOnPanic()
+		for first := true; ; first = false {
+			var frame []byte
+			if err := ss.RecvMsg(&frame); err != nil {
+				cs.CloseSend()
+				return
+			}
+			if first && dup != nil {
+				dup <- frame
+			}
+			if err := cs.SendMsg(&frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	header, err := cs.Header()
+	if err != nil {
+		return err
+	}
+	dropResponse := f != nil && f.action == "drop-response"
+	if !dropResponse {
+		if err := ss.SendHeader(header); err != nil {
+			return err
+		}
+	}
+	for {
+		var frame []byte
+		err := cs.RecvMsg(&frame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ss.SetTrailer(cs.Trailer())
+			return err
+		}
+		if dropResponse {
+			continue
+		}
+		if err := ss.SendMsg(&frame); err != nil {
+			return err
+		}
+	}
+	if dropResponse {
+		log.Printf("fault proxy: %s: the emulator returned OK; dropping the response", method)
+		return status.Errorf(codes.Unavailable, "response dropped by -fault=%s", f)
+	}
+	ss.SetTrailer(cs.Trailer())
+	return nil
+}
+
+// duplicate sends the first request frame received on dup to method a
+// second time, on its own stream, and logs the outcome.
+func (p *faultProxy) duplicate(ctx context.Context, method string, dup <-chan []byte) {
+	defer exitOnPanic()
+	var frame []byte
+	select {
+	case frame = <-dup:
+	case <-ctx.Done():
+		return
+	}
+	cs, err := p.upstream.NewStream(context.WithoutCancel(ctx), &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+	if err == nil {
+		err = cs.SendMsg(&frame)
+	}
+	if err == nil {
+		err = cs.CloseSend()
+	}
+	for err == nil {
+		var resp []byte
+		err = cs.RecvMsg(&resp)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	log.Printf("fault proxy: %s: duplicate returned %s", method, status.Code(err))
+}
+
+// rawCodec passes the frames of every RPC through the proxy unparsed.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("raw codec: cannot marshal %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec: cannot unmarshal into %T", v)
+	}
+	*b = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// fuzzAPIs are the ways a fuzz transaction writes: DML, buffered mutations,
+// or both, in a statement-based transaction; buffered mutations in a
+// ReadWriteTransaction; Apply; and BatchWrite.
+var fuzzAPIs = []string{"dml", "buffer", "mixed", "rw", "apply", "batchwrite"}
+
+// fuzzOp is one write of a fuzz transaction: DML (upsert, update, or delete)
+// or a mutation (upsert, replace, or delete), on the row pk. None of them
+// fails on a row that exists or does not.
+type fuzzOp struct {
+	dml  bool
+	kind string
+	pk   int64
+	val  int64
+}
+
+func (o fuzzOp) String() string {
+	api := "mutation"
+	if o.dml {
+		api = "DML"
+	}
+	if o.kind == "delete" {
+		return fmt.Sprintf("%s %s PK=%d", api, o.kind, o.pk)
+	}
+	return fmt.Sprintf("%s %s PK=%d Val=%d", api, o.kind, o.pk, o.val)
+}
+
+// statement returns the DML of o.
+func (o fuzzOp) statement() spanner.Statement {
+	var sql string
+	switch o.kind {
+	case "upsert":
+		sql = "INSERT OR UPDATE INTO T (PK, Val) VALUES (@p1, @p2)"
+		if isPostgreSQL() {
+			sql = "INSERT INTO T (PK, Val) VALUES (@p1, @p2) ON CONFLICT (PK) DO UPDATE SET Val = excluded.Val"
+		}
+	case "update":
+		sql = "UPDATE T SET Val = @p2 WHERE PK = @p1"
+	case "delete":
+		sql = "DELETE FROM T WHERE PK = @p1"
+	}
+	stmt := spanner.Statement{SQL: sqlFor(sql), Params: map[string]any{"p1": o.pk}}
+	if o.kind != "delete" {
+		stmt.Params["p2"] = o.val
+	}
+	return stmt
+}
+
+// mutation returns the mutation of o.
+func (o fuzzOp) mutation() *spanner.Mutation {
+	cols, vals := []string{*pkColumn, "Val"}, []any{o.pk, o.val}
+	switch o.kind {
+	case "replace":
+		return spanner.Replace(*table, cols, vals)
+	case "delete":
+		return spanner.Delete(*table, spanner.Key{o.pk})
+	default:
+		return spanner.InsertOrUpdate(*table, cols, vals)
+	}
+}
+
+// apply applies o to rows as the server would.
+func (o fuzzOp) apply(rows map[int64]int64) {
+	switch o.kind {
+	case "delete":
+		delete(rows, o.pk)
+	case "update":
+		if _, ok := rows[o.pk]; ok {
+			rows[o.pk] = o.val
+		}
+	default:
+		rows[o.pk] = o.val
+	}
+}
+
+// fuzzTxn is one randomly generated transaction.
+type fuzzTxn struct {
+	api, begin string
+	ops        []fuzzOp
+}
+
+func (t fuzzTxn) String() string {
+	ops := make([]string, len(t.ops))
+	for i, o := range t.ops {
+		ops[i] = o.String()
+	}
+	return fmt.Sprintf("%s begin=%s: %s", t.api, t.begin, strings.Join(ops, ", "))
+}
+
+// newFuzzTxn generates a transaction of one to three writes to PK=1..keys.
+func newFuzzTxn(r *rand.Rand, keys int64) fuzzTxn {
+	t := fuzzTxn{api: fuzzAPIs[r.IntN(len(fuzzAPIs))], begin: beginModes[r.IntN(len(beginModes))]}
+	if t.api == "apply" || t.api == "batchwrite" {
+		t.begin = "default"
+	}
+	for range 1 + r.IntN(3) {
+		o := fuzzOp{pk: 1 + r.Int64N(keys), val: r.Int64N(1000)}
+		o.dml = t.api == "dml" || t.api == "mixed" && r.IntN(2) == 0
+		if o.dml {
+			o.kind = []string{"upsert", "update", "delete"}[r.IntN(3)]
+		} else {
+			o.kind = []string{"upsert", "replace", "delete"}[r.IntN(3)]
+		}
+		t.ops = append(t.ops, o)
+	}
+	return t
+}
+
+// expect returns the contents of T after t commits on rows. DML takes effect
+// in order as it runs; buffered mutations take effect at commit, after all
+// DML, in the order they were buffered.
+func (t fuzzTxn) expect(rows map[int64]int64) map[int64]int64 {
+	next := maps.Clone(rows)
+	for _, o := range t.ops {
+		if o.dml {
+			o.apply(next)
+		}
+	}
+	for _, o := range t.ops {
+		if !o.dml {
+			o.apply(next)
+		}
+	}
+	return next
+}
+
+// run commits t on client.
+func (t fuzzTxn) run(ctx context.Context, client *spanner.Client) error {
+	var ms []*spanner.Mutation
+	for _, o := range t.ops {
+		if !o.dml {
+			ms = append(ms, o.mutation())
+		}
+	}
+	switch t.api {
+	case "apply":
+		_, err := client.Apply(ctx, ms, spanner.TransactionTag(runTag()))
+		return err
+	case "batchwrite":
+		_, err := execBatchWrite(ctx, client, spanner.TransactionOptions{TransactionTag: runTag()}, []*spanner.MutationGroup{{Mutations: ms}})
+		return err
+	}
+
+	opts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	if opts.BeginTransactionOption, err = beginOption(t.begin); err != nil {
+		return err
+	}
+	if t.api == "rw" {
+		_, err := client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			return txn.BufferWrite(ms)
+		}, opts)
+		return err
+	}
+	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	for _, o := range t.ops {
+		if o.dml {
+			_, err = txn.Update(ctx, o.statement())
+		} else {
+			err = txn.BufferWrite([]*spanner.Mutation{o.mutation()})
+		}
+		if err != nil {
+			txn.Rollback(ctx)
+			return fmt.Errorf("%s: %w", o, err)
+		}
+	}
+	_, err = txn.Commit(ctx)
+	return err
+}
+
+// fuzz implements the fuzz subcommand: it commits -fuzz-txns random
+// transactions, generated from -seed, on one client, keeps a model of T, and
+// compares the model with the server after every commit. A transaction that
+// commits without error but leaves T other than the model says is a lost
+// write; the seed and transaction number reproduce it.
+func fuzz(ctx context.Context) error {
+	seed := *fuzzSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("fuzz: -seed=%d, %d transactions on PK=1..%d", seed, *fuzzTxns, *fuzzKeys)
+	r := rand.New(rand.NewPCG(uint64(seed), uint64(seed)))
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := resetTable(ctx); err != nil {
+		return err
+	}
+	model := newTableModel()
+	for i := 1; i <= *fuzzTxns; i++ {
+		t := newFuzzTxn(r, int64(*fuzzKeys))
+		enterPhase(fmt.Sprintf("txn %d", i))
+		log.Printf("fuzz: txn %d: %s", i, t)
+		if err := t.run(ctx, client); err != nil {
+			return fmt.Errorf("txn %d (%s): %w", i, t, err)
+		}
+		model.rows = t.expect(model.rows)
+		diffs, err := model.diff(ctx, client)
+		if err != nil {
+			return fmt.Errorf("txn %d: %w", i, err)
+		}
+		if len(diffs) > 0 {
+			for _, d := range diffs {
+				log.Printf("fuzz: txn %d: %s", i, d)
+			}
+			return fmt.Errorf("%w: -seed=%d txn %d (%s) committed, but %s", errWriteLost, seed, i, t, strings.Join(diffs, "; "))
+		}
+	}
+	log.Printf("fuzz: all %d transactions matched the model", *fuzzTxns)
+	return nil
+}
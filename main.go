@@ -3,38 +3,314 @@
 // Multiplexed session RW transactions silently lose writes.
 //
 // Usage:
-//   go run main.go -delete=<stmt-mutation|rw-mutation|apply|stmt-dml> -begin=<default|inlined|explicit>
+//   go run . -delete=MODE -begin=<default|inlined|explicit>
+//                               MODE is one of stmt-mutation, rw-mutation, apply,
+//                               stmt-dml, stmt-dml-return, stmt-batch-dml,
+//                               rw-batch-dml, mixed, autocommit, pdml, or batchwrite
+//   go run . [flags] run [flags]
+//                               the same; flags after a subcommand are limited
+//                               to the ones it honors (go run . setup -h lists them)
+//   go run . [flags] matrix     the same as -matrix
+//   go run . [flags] stress     the same as -scenario=stress
+//   go run . list               the same as -list
+//   go run . [flags] setup      create the instance and database, and exit
+//   go run . [flags] teardown   drop the database and instance, and exit
+//   go run . [flags] bisect 1.5.40..1.5.50
+//                               find the first emulator version losing the write
+//   go run . [flags] client-versions v1.80.0 v1.87.0
+//                               run the scenario built against each client library version
+//   go run . -seed=N [flags] fuzz
+//                               commit random transactions and check each against a model
+//   go run . [flags] report > issue.md
+//                               write a ready-to-paste issue body for the scenario
 //
 // Prerequisites:
-//   SPANNER_EMULATOR_HOST=localhost:9010
+//   SPANNER_EMULATOR_HOST=localhost:9010, or -emulator=auto and Docker
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/spanner"
 	database "cloud.google.com/go/spanner/admin/database/apiv1"
 	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
 	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
 	"cloud.google.com/go/spanner/admin/instance/apiv1/instancepb"
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+
+	"spanner-mux-session-repro/repro"
 )
 
-const db = "projects/test-project/instances/test-instance/databases/test-database"
+// extraSchema holds the -schema statements, created after T.
+var extraSchema stringList
+
+func init() {
+	flag.Var(&extraSchema, "schema", "extra DDL statement created after T, such as an index or an interleaved table (repeatable)")
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, "; ") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// projectName, instanceName, and databaseName are the resource names built
+// from -project, -instance, and -database.
+func projectName() string  { return "projects/" + *projectID }
+func instanceName() string { return projectName() + "/instances/" + *instanceID }
+func databaseName() string { return instanceName() + "/databases/" + *databaseID }
 
 var (
-	deleteMode = flag.String("delete", "stmt-mutation", "DELETE mode: stmt-mutation, rw-mutation, apply, or stmt-dml")
-	beginMode  = flag.String("begin", "default", "BeginTransaction mode: default, inlined, or explicit")
-	skipSetup  = flag.Bool("skip-setup", false, "skip instance/database creation")
+	op           = flag.String("op", "delete", "write under test, made through the -delete mode: delete; update, insert_or_update, or replace (Val=99 on PK=1); insert (PK=1001, Val=99); replace has no DML form")
+	insertMode   = flag.String("insert", "dml", "INSERT mode: dml, mutation, or apply (-begin applies to dml and mutation)")
+	deleteMode   = flag.String("delete", "stmt-mutation", "DELETE mode: stmt-mutation, rw-mutation, apply, stmt-dml, stmt-dml-return (THEN RETURN PK), stmt-batch-dml, rw-batch-dml, mixed, autocommit, pdml, or batchwrite")
+	beginMode    = flag.String("begin", "default", "BeginTransaction mode: default, inlined, or explicit")
+	rows         = flag.Int("rows", 1, "insert PK=1..N with Val=PK instead of the single row PK=1")
+	keyRange     = flag.Bool("key-range", false, "same as -keyset=range")
+	keySet       = flag.String("keyset", "single", "key set of the DELETE mutation: single (PK=1), range (a KeyRange over PK=1..-rows), keys (PK=1..-rows as separate keys), all (AllKeys), or prefix (a KeyRange over the empty key prefix); the DML -delete modes use the matching WHERE clause, and every row covered is verified gone")
+	insertSQL    = flag.String("insert-sql", "", "statement run by -insert=dml instead of the fixed INSERT; must create PK=1")
+	deleteSQL    = flag.String("delete-sql", "", "statement run by the DML -delete modes instead of the fixed DELETE; must delete PK=1")
+	dryRun       = flag.Bool("dry-run", false, "validate the flags, log the resolved database, DDL, statements, and modes, and exit without opening any client")
+	ddlFile      = flag.String("ddl-file", "", "file of ;-separated DDL statements created instead of the fixed table T; the table must have an INT64 key -pk-column and an INT64 column Val")
+	table        = flag.String("table", "T", "table the scenario writes, in place of T")
+	pkColumn     = flag.String("pk-column", "PK", "key column of -table, in place of PK")
+	skipSetup    = flag.Bool("skip-setup", false, "skip instance/database creation")
+	setupRetries = flag.Int("setup-retries", 5, "retries of each setup RPC that fails with Unavailable or DeadlineExceeded, with exponential backoff")
+	maxRetries   = flag.Int("max-retries", 0, "retry a statement-based transaction (the stmt-* -delete modes) whose statements or commit fail with Aborted up to this many times, with ResetForRetry; each attempt is logged and added to -output=json and report. Without it, the first abort fails the run, except in the scenarios that conflict on purpose (mixed-concurrent, concurrency, stress, abort-retry), which retry up to 10 times")
+	cleanup      = flag.Bool("cleanup", false, "drop the database and delete the instance after the run, whatever its result; if that fails, a passing run exits as a setup error (not with -nondestructive)")
+
+	nondestructive = flag.Bool("nondestructive", false, "run against an existing -database and -table shared with others: skip setup, never clear the table, write only keys under a prefix unique to the run, and delete those afterward")
+
+	realSpanner = flag.Bool("real", false, "run against Cloud Spanner instead of the emulator, with Application Default Credentials; requires -project, -instance (which must exist), and -database")
+	projectID   = flag.String("project", "test-project", "project ID")
+	instanceID  = flag.String("instance", "test-instance", "instance ID, created by setup")
+	dialect     = flag.String("dialect", "googlesql", "database dialect created by setup: googlesql or postgresql")
+	databaseID  = flag.String("database", "test-database", "database ID, created by setup")
+
+	clearExisting = flag.Bool("clear-existing", false, "with -real, let setup reuse an existing -database by deleting every row of -table; without it, setup refuses an existing database (use -nondestructive to touch only the run's own keys)")
+
+	emulatorMode  = flag.String("emulator", "", "auto: start the emulator image in Docker on free local ports for the run and remove it afterwards, instead of using SPANNER_EMULATOR_HOST")
+	emulatorImage = flag.String("emulator-image", "", "image started by -emulator=auto (default $EMULATOR_IMAGE, or "+defaultEmulatorImage+")")
+
+	protocol = flag.String("protocol", "grpc", "admin API transport: grpc or rest (the data client is gRPC only)")
+	restHost = flag.String("rest-host", "localhost:9020", "emulator REST endpoint used by -protocol=rest")
+
+	scenarioName = flag.String("scenario", "", "run the named scenario (see -list) instead of the one selected by its own flag, or write-loss")
+	scriptFile   = flag.String("script", "", "run the JSON transaction script in this file (begin, dml, mutation, read, commit, rollback, and verify steps; see script.go and scripts/)")
+	list         = flag.Bool("list", false, "list the scenarios with their flags and expected results, and exit")
+
+	generateStandalone = flag.String("generate-standalone", "", "write a self-contained main.go reproducing the selected -delete/-begin configuration to this path and exit")
+
+	multiplexed  = flag.String("multiplexed", "", "true or false: set GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS, ..._FOR_RW, and ..._PARTITIONED_OPS before creating clients (default: leave the environment as is); both: run the scenario with each and report whether the write loss is specific to multiplexed sessions")
+	pool         = flag.String("pool", "default", "session pool preset: default (-min-opened and -max-opened) or warmed (MinOpened=-max-opened, waiting for the pool to fill before the INSERT)")
+	minOpened    = flag.Uint64("min-opened", 1, "SessionPoolConfig.MinOpened")
+	maxOpened    = flag.Uint64("max-opened", 10, "SessionPoolConfig.MaxOpened")
+	grpcPool     = flag.Int("grpc-pool", 1, "number of gRPC connections of the data client (option.WithGRPCConnectionPool)")
+	listSessions = flag.Bool("list-sessions", false, "list the database's sessions with ListSessions before the INSERT and after the verification of the default scenario, with whether each is multiplexed and which RPCs the run sent on it")
+	poolStats    = flag.Bool("pool-stats", false, "after the run, log how many regular and multiplexed sessions were created and how requests were spread over them")
+	maxIdle      = flag.Uint64("max-idle", 0, "SessionPoolConfig.MaxIdle: maximum number of idle sessions kept in the pool")
+
+	sessionMaintenanceInterval = flag.Duration("session-maintenance-interval", 0, "interval of session pool maintenance (HealthCheckInterval and MultiplexSessionCheckInterval); when set, the DELETE waits two intervals after the INSERT")
+
+	invalidTableThenDelete = flag.Bool("invalid-table-then-delete", false, "query a non-existent table inside the DELETE transaction and ignore the error before the write")
+	readYourWrites         = flag.Bool("read-your-writes", false, "read PK=1 inside the DELETE transaction after the write and check its visibility: DML is visible, buffered mutations are not")
+	concurrentReads        = flag.Int("concurrent-reads", 0, "read the written rows from this many goroutines inside the DELETE transaction before the write")
+
+	atLeastOnce    = flag.Bool("at-least-once", false, "pass ApplyAtLeastOnce to -insert=apply and -delete=apply, committing in a single Commit RPC without BeginTransaction")
+	commitStats    = flag.Bool("commit-stats", false, "request commit stats for the DELETE and fail if the commit reports no mutations, or reports no stats at all")
+	maxCommitDelay = flag.Duration("max-commit-delay", 0, "set MaxCommitDelay on the DELETE commit (e.g. 500ms) to encourage server-side commit batching")
+	isolation      = flag.String("isolation", "default", "isolation level of the read/write transactions: default, serializable, or repeatable-read")
+	readLockMode   = flag.String("read-lock-mode", "default", "ReadLockMode of the read/write transactions: default, pessimistic, or optimistic")
+	excludeStreams = flag.Bool("exclude-txn-from-change-streams", false, "set ExcludeTxnFromChangeStreams on the read/write transactions")
+
+	matrixMode      = flag.Bool("matrix", false, "run every -delete/-begin combination and print a grid of outcomes; -begin is only varied for modes that use it; only for the scenarios that honor both in every mode")
+	count           = flag.Int("count", 1, "run the insert/delete/verify cycle this many times on one client, clearing T between cycles, and report how many lost the write")
+	repeat          = flag.Int("repeat", 1, "run the scenario this many times, clearing T between iterations")
+	untilFail       = flag.Bool("until-fail", false, "with -repeat or -count, stop at the first iteration that does not pass")
+	confirmFails    = flag.Int("confirm-failures", 0, "re-run a run that lost a write, or each BUG cell of -matrix, this many more times, each in a fresh database, and report it CONFIRMED if every re-run lost a write too, or UNCONFIRMED")
+	expectFile      = flag.String("expectations", "", "with -matrix, a JSON file of known broken cells (see expectations.json); the run then passes when only those lose the write, and fails on any other loss or on a known broken cell passing")
+	fuzzSeed        = flag.Int64("seed", 0, "seed of the fuzz subcommand's transactions (0 picks one from the clock and logs it)")
+	fuzzTxns        = flag.Int("fuzz-txns", 50, "transactions the fuzz subcommand commits")
+	fuzzKeys        = flag.Int("fuzz-keys", 8, "the fuzz subcommand writes PK=1..N")
+	assertMonotonic = flag.Bool("assert-monotonic", false, "with -repeat, fail if any iteration's outcome differs from the first")
+
+	raw              = flag.Bool("raw", false, "run the scenario through the generated API client (CreateSession, BeginTransaction, ExecuteSql, Commit) instead of the client library; -delete=stmt-mutation or stmt-dml")
+	rawMultiplexed   = flag.Bool("raw-multiplexed", true, "with -raw, create the session with multiplexed=true")
+	threeClients     = flag.Bool("three-clients", false, "insert, delete, and verify with three separate clients")
+	verifyReopen     = flag.Bool("verify-reopen", false, "after the DELETE, verify again with a freshly opened client")
+	isolationCheck   = flag.Bool("isolation-check", false, "check that a concurrent reader cannot see the DELETE before it commits")
+	compareDMLStats  = flag.Bool("compare-dml-stats", false, "delete with DML and ReturnCommitStats, and compare the affected row count with the commit's mutation count")
+	verifyAfterDDL   = flag.Bool("verify-after-ddl", false, "verify, run a schema change on T, and verify again")
+	longRO           = flag.Bool("long-ro", false, "run insert/delete cycles while a multi-use read-only transaction is open on the same client, then again after closing it")
+	longROCycles     = flag.Int("long-ro-cycles", 5, "number of insert/delete cycles per phase of -long-ro")
+	abortRetry       = flag.Bool("abort-retry", false, "abort the first Commit of the DELETE with an injected Aborted and verify the retried transaction's mutation is committed; -delete=rw-mutation or stmt-mutation")
+	cancelAt         = flag.String("cancel-at", "", "cancel the DELETE's context at before-commit, during-commit (after the server applies the Commit), or after-buffer, and check that T is in the state that implies")
+	cancelKind       = flag.String("cancel-kind", "cancel", "how -cancel-at ends the DELETE's context: cancel, expecting Canceled, or deadline, expecting DeadlineExceeded")
+	reuseCommitted   = flag.Bool("reuse-committed-txn", false, "after the stmt-mutation DELETE commits, reuse the transaction object and check that every call fails")
+	concurrency      = flag.Int("concurrency", 0, "insert PK=1..N and delete each row from its own goroutine with the -delete mode, all on one client")
+	stress           = flag.Int("stress", 0, "run insert/delete/verify cycles from this many goroutines on one client, each on its own PK, and report lost writes and DELETE latency")
+	stressIterations = flag.Int("stress-iterations", 10, "cycles per goroutine of -stress")
+	soak             = flag.Duration("soak", 0, "keep one client open this long, such as 30m, running an insert/delete/verify cycle every -soak-interval and logging the sessions each cycle first used; combine with -session-maintenance-interval to shorten the maintenance intervals. Without -timeout, the default is added to it; an explicit -timeout must exceed it, or be 0")
+	soakInterval     = flag.Duration("soak-interval", time.Minute, "time between the starts of the cycles of -soak")
+	readOnly         = flag.Bool("read-only", false, "write PK=1..3 and read them back through every read-only path: strong, stale, multi-use, and batch partitions")
+	multiDatabase    = flag.Int("multi-database", 0, "insert PK=1..N into T of -database and of a second database, -database with -b appended, in interleaved transactions on one client each, delete half the rows of each the same way, and check that no write leaked or was lost")
+	typedValues      = flag.Bool("typed-values", false, "write, update, and delete a row with a column of every type (STRING, BYTES, NUMERIC, JSON, commit TIMESTAMP, BOOL, FLOAT64, FLOAT32, DATE, ARRAY of INT64 and STRING, PROTO, ENUM) in table Typed and check every value; -delete=stmt-mutation, rw-mutation, apply, batchwrite, or stmt-dml; GoogleSQL only")
+	mutationCount    = flag.Int("mutation-count", 0, "insert PK=1..N with N buffered mutations in one transaction, delete them with N more, and count the rows after each commit; -delete picks the mutation mode")
+	mixedConcurrent  = flag.Bool("mixed-concurrent", false, "delete PK=1 with DML and PK=2 with a buffered mutation in two concurrent transactions that commit together")
+	dmlPlusMutation  = flag.Bool("dml-plus-mutation", false, "delete PK=1 with DML and PK=2 with a buffered mutation in one transaction, DML first and then mutation first")
+	crossCheck       = flag.Bool("cross-check", false, "make the -op write to PK=1 with DML and to PK=2 with a buffered mutation, in two independent statement-based transactions with -begin, and report which path lost it; -delete is ignored")
+	dmlMutationOrder = flag.Bool("dml-mutation-order", false, "UPDATE PK=1 with DML and a buffered mutation in one transaction and check that the mutation wins")
+
+	verifyMode      = flag.String("verify", "strong", "timestamp bound of the verifying read: strong, exact-staleness, max-staleness, read-timestamp (the DELETE's commit timestamp), or changestream (strong, then read a change stream on T for the DELETE; GoogleSQL only)")
+	verifyVia       = flag.String("verify-via", "readrow", "read path of the verifying read: readrow, query, read-index (through an index on Val), or batch-read (partitioned, in a BatchReadOnlyTransaction)")
+	verifyStaleness = flag.Duration("verify-staleness", 10*time.Second, "staleness for -verify=exact-staleness and max-staleness; a read from before the write's commit is reported as inconclusive, an ERROR")
+	verifyColumns   = flag.Bool("verify-columns", false, "verify the DELETE reading [PK], [PK Val], and [Val] and flag any disagreement")
+	checkModel      = flag.Bool("check-model", false, "cross-check the harness's expected table state against the server after every step; divergence in a control mode (apply, stmt-dml) is a harness error")
+
+	output     = flag.String("output", "text", "result format: text (log lines) or json (a single JSON object on stdout, no log lines)")
+	outputFile = flag.String("output-file", "", "with -output=json, write the JSON object to this file instead of stdout and keep the log lines on stderr")
+	timeout    = flag.Duration("timeout", time.Minute, "abort the run after this long and exit with the TIMEOUT code, naming the step in flight; raise it for -repeat, -count, -matrix, and -session-maintenance-interval (0 means no limit)")
+	exitOnly   = flag.Bool("exit-only", false, "write nothing to stdout or stderr and report the result only through the exit code")
+
+	verbosity    = flag.Int("v", 0, "verbosity: 1 also logs the time taken by each phase (setup, insert, delete, verify) and every CommitResponse in full, 2 also logs each gRPC call's method and duration")
+	traceWire    = flag.Bool("trace", false, "log every request and response of the data and gRPC admin clients in full as protojson, for attaching to bug reports; the most detailed RPC trace, over -trace-rpc")
+	traceRPC     = flag.Bool("trace-rpc", false, "log each Spanner RPC; Commit and BeginTransaction requests in full, others with their session and transaction selector, and the sessions, transactions, and commits returned")
+	traceCallers = flag.Bool("trace-callers", false, "log each Spanner RPC with the client library frames that initiated it, in the detail of -trace or -trace-rpc if given, or by method alone")
+	metricsMode  = flag.Bool("metrics", false, "count and time the Spanner RPCs of each phase (insert, delete, verify, ...), log them with the phase timings at the end, or per cell with -matrix, and add them to -output=json")
+
+	dumpStateMode = flag.Bool("dump-state", false, "log every row of -table after setup, after the INSERT, and after the DELETE, each with a strong and a 1s stale read and their read timestamps")
+	dumpDir       = flag.String("dump-dir", "", "with -dump-state, write each snapshot to a numbered file in this existing directory instead of the log, named for the -delete, -begin, and -repeat iteration it ran with")
+
+	requestTag     = flag.String("request-tag", "", "request tag set on every read, query, and DML request, to find the run's RPCs in the emulator's logs (default: the verifying reads are tagged run-<run ID>)")
+	routeToLeader  = flag.Bool("route-to-leader", true, "send the x-goog-spanner-route-to-leader header on read/write and partitioned DML requests, as the client library does by default; false sets ClientConfig.DisableRouteToLeader. -trace and -trace-rpc show the header")
+	priority       = flag.String("priority", "default", "RequestOptions.Priority set on every read, query, DML, and commit request: default (unset), low, medium, or high")
+	otelEndpoint   = flag.String("otel-endpoint", "", "export the client library's OpenTelemetry spans (BeginTransaction, ExecuteSql, Commit, ...) over OTLP/gRPC to this host:port, such as localhost:4317 for a local Jaeger")
+	transactionTag = flag.String("transaction-tag", "", "transaction tag set on every read/write transaction and its commit (default run-<run ID>)")
 )
 
+// runID identifies this invocation in log lines, transaction tags, and
+// generated artifacts, so that output from parallel or historical runs can be
+// told apart when collected into one stream.
+var runID = uuid.NewString()
+
+// errWriteLost marks the silent write loss this program reproduces, as opposed
+// to infrastructure or API errors.
+var errWriteLost = repro.ErrWriteLost
+
+// errInconclusive marks a verification that could not have seen the write,
+// so that a surviving row says nothing about whether it was lost.
+var errInconclusive = errors.New("inconclusive")
+
+// survivedError is the errWriteLost reported by verification, carrying the
+// key of the row that survived its DELETE.
+type survivedError struct {
+	pk     int64
+	rows   int // number of deleted rows that survived
+	detail string
+}
+
+func (e *survivedError) Error() string {
+	return fmt.Sprintf("%v: row PK=%d still exists after DELETE succeeded without error%s", errWriteLost, e.pk, e.detail)
+}
+
+func (e *survivedError) Is(target error) bool { return target == errWriteLost }
+
+// inconsistentError is a survivedError after a DELETE whose server response
+// counted the rows it deleted: the server contradicts itself.
+type inconsistentError struct {
+	reported int64
+	survived *survivedError
+}
+
+func (e *inconsistentError) Error() string {
+	return fmt.Sprintf("INCONSISTENT: server reported %d deletes but %d rows remain: %v", e.reported, e.survived.rows, e.survived)
+}
+
+func (e *inconsistentError) Unwrap() error { return e.survived }
+
+// noRowCount is the row count deleteRow returns for -delete modes whose
+// response does not count the rows written, the mutation modes.
+const noRowCount = -1
+
+// checkReported turns a survivedError from verification into an
+// inconsistentError if the DELETE reported deleting at least one row.
+func checkReported(err error, reported int64) error {
+	var survived *survivedError
+	if reported > 0 && errors.As(err, &survived) {
+		return &inconsistentError{reported: reported, survived: survived}
+	}
+	return err
+}
+
 func parseBeginOption() (spanner.BeginTransactionOption, error) {
-	switch *beginMode {
+	return beginOption(*beginMode)
+}
+
+// isolationLevel returns the IsolationLevel selected by -isolation.
+func isolationLevel() (spannerpb.TransactionOptions_IsolationLevel, error) {
+	switch *isolation {
+	case "default":
+		return spannerpb.TransactionOptions_ISOLATION_LEVEL_UNSPECIFIED, nil
+	case "serializable":
+		return spannerpb.TransactionOptions_SERIALIZABLE, nil
+	case "repeatable-read":
+		return spannerpb.TransactionOptions_REPEATABLE_READ, nil
+	default:
+		return 0, fmt.Errorf("unknown isolation level: %s", *isolation)
+	}
+}
+
+// requestPriority returns the RequestOptions.Priority selected by -priority.
+func requestPriority() (spannerpb.RequestOptions_Priority, error) {
+	switch *priority {
+	case "default":
+		return spannerpb.RequestOptions_PRIORITY_UNSPECIFIED, nil
+	case "low":
+		return spannerpb.RequestOptions_PRIORITY_LOW, nil
+	case "medium":
+		return spannerpb.RequestOptions_PRIORITY_MEDIUM, nil
+	case "high":
+		return spannerpb.RequestOptions_PRIORITY_HIGH, nil
+	default:
+		return 0, fmt.Errorf("unknown priority: %s", *priority)
+	}
+}
+
+// lockMode returns the ReadLockMode selected by -read-lock-mode.
+func lockMode() (spannerpb.TransactionOptions_ReadWrite_ReadLockMode, error) {
+	switch *readLockMode {
+	case "default":
+		return spannerpb.TransactionOptions_ReadWrite_READ_LOCK_MODE_UNSPECIFIED, nil
+	case "pessimistic":
+		return spannerpb.TransactionOptions_ReadWrite_PESSIMISTIC, nil
+	case "optimistic":
+		return spannerpb.TransactionOptions_ReadWrite_OPTIMISTIC, nil
+	default:
+		return 0, fmt.Errorf("unknown read lock mode: %s", *readLockMode)
+	}
+}
+
+// beginOption returns the BeginTransactionOption of the -begin mode.
+func beginOption(mode string) (spanner.BeginTransactionOption, error) {
+	switch mode {
 	case "default":
 		return spanner.DefaultBeginTransaction, nil
 	case "inlined":
@@ -42,177 +318,1928 @@ func parseBeginOption() (spanner.BeginTransactionOption, error) {
 	case "explicit":
 		return spanner.ExplicitBeginTransaction, nil
 	default:
-		return 0, fmt.Errorf("unknown begin mode: %s", *beginMode)
+		return 0, fmt.Errorf("unknown begin mode: %s", mode)
+	}
+}
+
+func main() {
+	defer exitOnPanic()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.Usage = usage
+	if err := parseCommandLine(flag.CommandLine, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitPass)
+		}
+		os.Exit(exitError)
+	}
+	if flag.NArg() > 1 && flag.Arg(0) != "bisect" && flag.Arg(0) != "client-versions" {
+		fmt.Fprintf(os.Stderr, "unexpected arguments after %s: %s\n", flag.Arg(0), strings.Join(flag.Args()[1:], " "))
+		os.Exit(exitError)
+	}
+	switch *output {
+	case "text":
+	case "json":
+		if *outputFile == "" {
+			log.SetOutput(io.Discard)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format: %s\n", *output)
+		os.Exit(exitError)
+	}
+	if flag.Arg(0) == "report" && *output != "text" {
+		fmt.Fprintln(os.Stderr, "report writes its own output; drop -output")
+		os.Exit(exitError)
+	}
+	if *exitOnly {
+		silence()
+	}
+	if *list {
+		if err := listScenarios(os.Stdout); err != nil {
+			os.Exit(exitError)
+		}
+		return
+	}
+	log.SetFlags(0)
+	log.Printf("run ID: %s", runID)
+	log.SetPrefix(runID + " ")
+
+	if *generateStandalone != "" {
+		if err := writeStandalone(*generateStandalone); err != nil {
+			log.Fatalf("Generate standalone: %v", err)
+		}
+		log.Printf("Wrote standalone reproduction to %s", *generateStandalone)
+		return
+	}
+
+	if err := checkTarget(); err != nil {
+		if errors.Is(err, errNoEmulator) && !*dryRun {
+			log.Print(err)
+			os.Exit(exitSetup)
+		}
+		if !*dryRun {
+			log.Fatal(err)
+		}
+		log.Printf("dry run: warning: %v", err)
+	}
+
+	if *multiplexed != "" && *multiplexed != "both" {
+		if err := setMultiplexed(*multiplexed); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Sessions: %s", sessionMode())
+
+	sc, err := selectScenario()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *matrixMode && !sc.honorsModes {
+		log.Fatalf("-matrix varies -delete and -begin, which -scenario=%s does not honor in every mode", sc.name)
+	}
+	if *expectFile != "" {
+		if !*matrixMode {
+			log.Fatal("-expectations requires -matrix")
+		}
+		if err := loadExpectations(*expectFile); err != nil {
+			log.Fatalf("-expectations: %v", err)
+		}
+	}
+	log.Printf("Scenario: %s", sc.name)
+
+	switch *dialect {
+	case "googlesql", "postgresql":
+	default:
+		log.Fatalf("unknown dialect: %s", *dialect)
+	}
+
+	switch *op {
+	case "delete", "update", "insert", "insert_or_update":
+	case "replace":
+		if dmlDeleteModes[*deleteMode] {
+			log.Fatalf("-op=replace has no DML form; use a mutation -delete mode, not %s", *deleteMode)
+		}
+	default:
+		log.Fatalf("unknown op: %s", *op)
+	}
+
+	if *rows < 1 {
+		log.Fatalf("-rows must be at least 1, got %d", *rows)
+	}
+	if *keyRange {
+		if *keySet != "single" && *keySet != "range" {
+			log.Fatalf("-key-range conflicts with -keyset=%s", *keySet)
+		}
+		*keySet = "range"
+	}
+	switch *keySet {
+	case "single", "range", "keys", "all", "prefix":
+	default:
+		log.Fatalf("unknown key set: %s", *keySet)
+	}
+	if *keySet != "single" && *op != "delete" {
+		log.Fatalf("-keyset=%s requires -op=delete", *keySet)
+	}
+	if *isolationCheck && *op != "delete" {
+		log.Fatal("-isolation-check checks the visibility of a DELETE; it requires -op=delete")
+	}
+
+	switch *cancelAt {
+	case "":
+		if flagSet("cancel-kind") {
+			log.Fatal("-cancel-kind requires -cancel-at")
+		}
+	case "before-commit", "during-commit", "after-buffer":
+		if *cancelKind != "cancel" && *cancelKind != "deadline" {
+			log.Fatalf("unknown -cancel-kind: %s", *cancelKind)
+		}
+		if *deleteMode == "pdml" || *deleteMode == "batchwrite" {
+			log.Fatalf("-cancel-at does not support -delete=%s, which makes no Commit RPC", *deleteMode)
+		}
+		if *cancelAt == "after-buffer" && beginIgnored(*deleteMode) {
+			log.Fatalf("-cancel-at=after-buffer does not support -delete=%s, which buffers nothing before its commit", *deleteMode)
+		}
+		if *op != "delete" || *keySet != "single" {
+			log.Fatal("-cancel-at requires -op=delete and -keyset=single")
+		}
+	default:
+		log.Fatalf("unknown cancel point: %s", *cancelAt)
+	}
+	if *commitStats && !*matrixMode && (*deleteMode == "pdml" || *deleteMode == "batchwrite") {
+		log.Fatalf("-commit-stats does not support -delete=%s, which makes no Commit RPC", *deleteMode)
+	}
+
+	if len(faults) > 0 {
+		if _, err := parseFaults(); err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case *realSpanner, *protocol == "rest":
+			log.Fatal("-fault proxies the emulator's gRPC endpoint; drop -real and -protocol=rest")
+		case flag.Arg(0) == "bisect", flag.Arg(0) == "client-versions", flag.Arg(0) == "report":
+			log.Fatalf("-fault does not support the %s subcommand", flag.Arg(0))
+		case *matrixMode, *repeat > 1, *count > 1, *multiplexed == "both", *confirmFails > 0:
+			// Each fault fires once per process, so only the first run
+			// would see it.
+			log.Fatal("-fault injects each fault once and does not support -matrix, -repeat, -count, -multiplexed=both, or -confirm-failures")
+		}
+	}
+
+	if *soak > 0 {
+		// The default -timeout is for a single run; without an explicit
+		// one, -soak gets it on top of its own duration.
+		if !flagSet("timeout") {
+			*timeout += *soak
+		}
+		switch {
+		case *soakInterval <= 0:
+			log.Fatal("-soak-interval must be positive")
+		case *timeout > 0 && *timeout <= *soak:
+			log.Fatalf("-soak runs for %s, longer than -timeout=%s; raise -timeout or set it to 0", *soak, *timeout)
+		}
+	}
+	if *maxRetries < 0 {
+		log.Fatal("-max-retries must not be negative")
+	}
+	switch {
+	case *confirmFails < 0:
+		log.Fatal("-confirm-failures must not be negative")
+	case *confirmFails > 0 && *repeat > 1:
+		log.Fatal("-confirm-failures re-runs a failed run, which -repeat already repeats; use one or the other")
+	}
+	if *listSessions {
+		switch {
+		case sc.name != scenarios[0].name || flag.Arg(0) == "fuzz":
+			log.Fatal("-list-sessions applies to the default scenario only")
+		case *matrixMode:
+			log.Fatal("-list-sessions lists the sessions of a single run; drop -matrix")
+		case *checkModel:
+			log.Fatal("-list-sessions does not support -check-model, which runs its own transactions")
+		}
+	}
+	if *dumpStateMode && (sc.name != scenarios[0].name || flag.Arg(0) == "fuzz") {
+		log.Fatal("-dump-state applies to the default scenario only")
+	}
+	if *dumpDir != "" {
+		if !*dumpStateMode {
+			log.Fatal("-dump-dir requires -dump-state")
+		}
+		if fi, err := os.Stat(*dumpDir); err != nil || !fi.IsDir() {
+			log.Fatalf("-dump-dir: %s is not a directory", *dumpDir)
+		}
+	}
+	if *clearExisting && !*realSpanner {
+		log.Fatal("-clear-existing applies to -real; setup always clears an existing emulator database")
+	}
+	if *nondestructive {
+		switch {
+		case sc.name != scenarios[0].name || flag.Arg(0) != "":
+			log.Fatalf("-nondestructive runs only the %s scenario, without a subcommand", scenarios[0].name)
+		case *matrixMode, *repeat > 1, *count > 1, *multiplexed == "both", *checkModel:
+			log.Fatal("-nondestructive does not support -matrix, -repeat, -count, -multiplexed=both, or -check-model, which clear or check the whole table")
+		case *confirmFails > 0:
+			log.Fatal("-nondestructive does not support -confirm-failures, which creates a database for each re-run")
+		case *cleanup:
+			log.Fatal("-nondestructive does not support -cleanup, which drops the shared database; the run deletes its own keys afterward")
+		case *keySet == "all" || *keySet == "prefix":
+			log.Fatalf("-keyset=%s would delete every row of the shared table", *keySet)
+		case *insertSQL != "" || *deleteSQL != "":
+			log.Fatal("-nondestructive generates the keys it writes; drop -insert-sql and -delete-sql")
+		case *rows+insertOffset >= runKeySpan:
+			log.Fatalf("-nondestructive supports up to %d -rows", runKeySpan-insertOffset-1)
+		}
+	}
+
+	if _, err := isolationLevel(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := lockMode(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := requestPriority(); err != nil {
+		log.Fatal(err)
+	}
+
+	switch *verifyMode {
+	case "strong", "exact-staleness", "max-staleness", "read-timestamp":
+	case "changestream":
+		if isPostgreSQL() {
+			log.Fatal("-verify=changestream requires -dialect=googlesql")
+		}
+	default:
+		log.Fatalf("unknown verify mode: %s", *verifyMode)
+	}
+	if *typedValues && isPostgreSQL() {
+		log.Fatal("-typed-values requires -dialect=googlesql")
+	}
+	if *multiDatabase > 0 && *realSpanner {
+		log.Fatal("-multi-database creates its second database on the emulator; drop -real")
+	}
+	switch *verifyVia {
+	case "readrow", "query", "read-index":
+	case "batch-read":
+		if *verifyMode == "max-staleness" {
+			log.Fatal("-verify-via=batch-read does not support -verify=max-staleness")
+		}
+	default:
+		log.Fatalf("unknown verify path: %s", *verifyVia)
+	}
+
+	switch *pool {
+	case "default", "warmed":
+	default:
+		log.Fatalf("unknown pool preset: %s", *pool)
+	}
+
+	switch *protocol {
+	case "grpc":
+	case "rest":
+		log.Printf("Transport: admin=REST (%s), data=gRPC (the Go client has no REST transport for sessions and transactions)", *restHost)
+	default:
+		log.Fatalf("unknown protocol: %s", *protocol)
+	}
+
+	if *dryRun {
+		if err := printPlan(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if *otelEndpoint != "" && flag.Arg(0) != "client-versions" {
+		if err := startOTel(ctx); err != nil {
+			finish(fmt.Errorf("-otel-endpoint: %w", err))
+		}
+	}
+	if *emulatorMode == "auto" && flag.Arg(0) != "client-versions" {
+		if err := startAutoEmulator(ctx); err != nil {
+			finish(stepError(stepSetup, fmt.Errorf("start emulator: %w", err)))
+		}
+	}
+	logEnvironment()
+
+	if len(faults) > 0 {
+		if err := startFaultProxy(); err != nil {
+			finish(stepError(stepSetup, fmt.Errorf("-fault: %w", err)))
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "setup":
+		if err := setup(ctx); err != nil {
+			finish(stepError(stepSetup, fmt.Errorf("setup: %w", err)))
+		}
+		log.Printf("setup: %s is ready", databaseName())
+		return
+	case "teardown":
+		enterPhase("cleanup")
+		if err := teardown(ctx); err != nil {
+			finish(stepError(stepSetup, fmt.Errorf("teardown: %w", err)))
+		}
+		return
+	case "client-versions":
+		finish(clientVersions(ctx, flag.Args()[1:]))
+		return
+	}
+
+	var images []string
+	if flag.Arg(0) == "bisect" {
+		if images, err = bisectImages(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	} else if !*skipSetup && !*nondestructive {
+		if err := setup(ctx); err != nil {
+			finish(stepError(stepSetup, fmt.Errorf("setup: %w", err)))
+		}
+	}
+	run := sc.run
+	if sc.name == scenarios[0].name && *realSpanner {
+		run = compareWithEmulator(run)
+	}
+	if flag.Arg(0) == "fuzz" {
+		run = fuzz
+	}
+	if *repeat > 1 {
+		run = repeated(run)
+	}
+	if *confirmFails > 0 && !*matrixMode {
+		run = confirmed(run)
+	}
+	if *nondestructive {
+		run = withRunKeys(run)
+	}
+	if *matrixMode {
+		run = matrix(run)
+	}
+	if *multiplexed == "both" {
+		run = bothSessionModes(run)
+	}
+	if images != nil {
+		run = bisect(run, images)
+	}
+	if flag.Arg(0) == "report" {
+		run = issueReport(sc, run)
+	}
+	finish(run(ctx))
+}
+
+// cleanupTimeout bounds the teardown run by -cleanup.
+const cleanupTimeout = 30 * time.Second
+
+// finish runs -cleanup, removes the -emulator=auto container, reports the
+// result of the run in the format selected by -output, and exits with the
+// matching code.
+func finish(err error) {
+	if exitCode(err) == exitTimeout {
+		err = fmt.Errorf("timed out during %s: %w", currentPhase(), err)
+	}
+	if *cleanup {
+		enterPhase("cleanup")
+		// A fresh context, so that an expired -timeout does not prevent
+		// the teardown. A failed teardown turns a PASS into a setup error,
+		// as it leaves the database behind, but never masks another result.
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		if cerr := teardown(ctx); cerr != nil {
+			if err == nil {
+				err = stepError(stepSetup, fmt.Errorf("cleanup: %w", cerr))
+			} else {
+				log.Printf("cleanup: %v", cerr)
+			}
+		}
+		cancel()
+	}
+	if activeFaultProxy != nil {
+		activeFaultProxy.stop()
+	}
+	if autoEmulator != nil {
+		autoEmulator.stop()
+	}
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		stopOTel(ctx)
+		cancel()
+	}
+	enterPhase("report")
+	if *metricsMode {
+		logMetrics("", collectedMetrics())
+	}
+	if *output == "json" && *outputFile != "" {
+		if werr := writeJSONFile(*outputFile, err); werr != nil {
+			log.Printf("write JSON result: %v", werr)
+			os.Exit(exitError)
+		}
+	} else if *output == "json" {
+		if werr := writeJSONResult(os.Stdout, err); werr != nil {
+			fmt.Fprintf(os.Stderr, "write JSON result: %v\n", werr)
+			os.Exit(exitError)
+		}
+	}
+	if err != nil {
+		if s := errorStep(err); s != "" {
+			log.Printf("FAIL [%s]: %v", s, err)
+		} else {
+			log.Printf("FAIL: %v", err)
+		}
+		os.Exit(exitCode(err))
+	}
+	log.Println("PASS")
+}
+
+// setup creates the instance (unless -real) and the database with table T.
+// Either may already exist from an earlier run without -cleanup; an existing
+// database is reused with T emptied, which -real allows only with
+// -clear-existing.
+func setup(ctx context.Context) error {
+	return setupDatabase(ctx, databaseName())
+}
+
+// setupDatabase is setup for the database db, a full database name in
+// -instance.
+func setupDatabase(ctx context.Context, db string) error {
+	enterPhase("setup")
+	if *realSpanner {
+		log.Printf("-real: using existing instance %s", instanceName())
+	} else if err := retrySetup(ctx, "create instance", createInstance); err != nil {
+		return err
+	}
+	return retrySetup(ctx, "create database", func(ctx context.Context) error {
+		return createDatabase(ctx, db)
+	})
+}
+
+// createDatabase creates the database db with table T, or the -ddl-file
+// schema, for setupDatabase. An existing database is reused with T emptied,
+// or refused under -real without -clear-existing.
+func createDatabase(ctx context.Context, db string) error {
+	ddl, err := schemaDDL()
+	if err != nil {
+		return err
+	}
+	dc, err := newDatabaseAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	// PostgreSQL-dialect databases do not accept extra statements at
+	// creation, so their table is created by a separate schema update.
+	req := &databasepb.CreateDatabaseRequest{
+		Parent:          instanceName(),
+		CreateStatement: createDatabaseStatement(path.Base(db)),
+		DatabaseDialect: databaseDialect(),
+	}
+	if !isPostgreSQL() {
+		req.ExtraStatements = ddl
+	}
+	dop, err := dc.CreateDatabase(ctx, req)
+	if err == nil {
+		_, err = dop.Wait(ctx)
+	}
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		// A database left by a run with the other -dialect would run every
+		// statement in the wrong dialect.
+		existing, err := dc.GetDatabase(ctx, &databasepb.GetDatabaseRequest{Name: db})
+		if err != nil {
+			return fmt.Errorf("get existing database: %w", err)
+		}
+		if existing.GetDatabaseDialect() != databaseDialect() {
+			return fmt.Errorf("database %s already exists with dialect %s, not %s; drop it or pick another -database",
+				db, existing.GetDatabaseDialect(), databaseDialect())
+		}
+		// On Cloud Spanner the database may hold someone else's data and
+		// schema, so refuse before changing either.
+		if *realSpanner && !*clearExisting {
+			return fmt.Errorf("database %s already exists; setup would delete every row of %s: pass -clear-existing to allow it, or -nondestructive to write only the run's own keys", db, *table)
+		}
+		if *verifyVia == "read-index" {
+			if err := updateDDLFor(ctx, db, verifyIndexDDL()); err != nil {
+				return fmt.Errorf("create %s: %w", verifyIndex, err)
+			}
+		}
+		if *verifyMode == "changestream" {
+			if err := ensureChangeStream(ctx, dc, db); err != nil {
+				return fmt.Errorf("create %s: %w", changeStream, err)
+			}
+		}
+		if *typedValues {
+			if err := ensureTypedTable(ctx, dc, db); err != nil {
+				return fmt.Errorf("create %s: %w", typedTable, err)
+			}
+		}
+		log.Printf("Database %s already exists; clearing %s", db, *table)
+		return resetTableOf(ctx, db)
+	}
+	if err == nil && isPostgreSQL() {
+		err = updateDDLFor(ctx, db, ddl...)
+	}
+	if err == nil && *typedValues {
+		if err := ensureTypedTable(ctx, dc, db); err != nil {
+			return fmt.Errorf("create %s: %w", typedTable, err)
+		}
+	}
+	return err
+}
+
+// schemaDDL returns the statements setup creates after the database: those
+// in -ddl-file, or table T, followed by the -schema statements and, for
+// -verify-via=read-index and -verify=changestream, verifyIndex and
+// changeStream.
+func schemaDDL() ([]string, error) {
+	var extra []string
+	if *verifyVia == "read-index" {
+		extra = append(extra, verifyIndexDDL())
+	}
+	if *verifyMode == "changestream" {
+		extra = append(extra, changeStreamDDL())
+	}
+	extra = append(extra, extraSchema...)
+	if *ddlFile == "" {
+		return append([]string{sqlFor(schema)}, extra...), nil
+	}
+	b, err := os.ReadFile(*ddlFile)
+	if err != nil {
+		return nil, fmt.Errorf("-ddl-file: %w", err)
+	}
+	var ddl []string
+	for _, stmt := range strings.Split(string(b), ";") {
+		var lines []string
+		for _, line := range strings.Split(stmt, "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+				lines = append(lines, line)
+			}
+		}
+		if stmt := strings.TrimSpace(strings.Join(lines, "\n")); stmt != "" {
+			ddl = append(ddl, stmt)
+		}
+	}
+	if len(ddl) == 0 {
+		return nil, fmt.Errorf("-ddl-file: no statements in %s", *ddlFile)
+	}
+	return append(ddl, extra...), nil
+}
+
+// retrySetup runs fn, retrying with exponential backoff up to -setup-retries
+// times while it fails with Unavailable or DeadlineExceeded, as a freshly
+// started emulator does until it is ready.
+func retrySetup(ctx context.Context, what string, fn func(context.Context) error) error {
+	backoff := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		code := spanner.ErrCode(err)
+		if err == nil || attempt >= *setupRetries || ctx.Err() != nil ||
+			(code != codes.Unavailable && code != codes.DeadlineExceeded) {
+			return err
+		}
+		log.Printf("%s: %v; retrying in %s (%d/%d)", what, err, backoff, attempt+1, *setupRetries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// createInstance creates the emulator instance for setup. An existing
+// instance is reused.
+func createInstance(ctx context.Context) error {
+	ic, err := newInstanceAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer ic.Close()
+
+	iop, err := ic.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     projectName(),
+		InstanceId: *instanceID,
+		Instance: &instancepb.Instance{
+			Config:      projectName() + "/instanceConfigs/emulator-config",
+			DisplayName: *instanceID,
+			NodeCount:   1,
+		},
+	})
+	if err == nil {
+		_, err = iop.Wait(ctx)
+	}
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		log.Printf("Instance %s already exists", instanceName())
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// teardown drops the database and deletes the instance created by setup. It
+// tries both even if the first fails, and returns what failed.
+func teardown(ctx context.Context) error {
+	var errs []error
+	if err := dropDatabase(ctx, databaseName()); err != nil {
+		errs = append(errs, fmt.Errorf("drop database: %w", err))
+	} else {
+		log.Printf("cleanup: dropped %s", databaseName())
+	}
+
+	if *realSpanner {
+		log.Printf("cleanup: -real: leaving instance %s in place", instanceName())
+		return errors.Join(errs...)
+	}
+	ic, err := newInstanceAdminClient(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	defer ic.Close()
+	if err := ic.DeleteInstance(ctx, &instancepb.DeleteInstanceRequest{Name: instanceName()}); err != nil {
+		errs = append(errs, fmt.Errorf("delete instance: %w", err))
+	} else {
+		log.Printf("cleanup: deleted %s", instanceName())
+	}
+	return errors.Join(errs...)
+}
+
+// dropDatabase drops the database db, a full database name.
+func dropDatabase(ctx context.Context, db string) error {
+	dc, err := newDatabaseAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	return dc.DropDatabase(ctx, &databasepb.DropDatabaseRequest{Database: db})
+}
+
+// errNoEmulator is the checkTarget error for a run with neither the emulator
+// nor -real, which exits with exitSetup rather than as a flag error.
+var errNoEmulator = errors.New("SPANNER_EMULATOR_HOST is not set (use -real to run against Cloud Spanner)")
+
+// checkTarget guards against running against production by accident: the
+// emulator is required unless -real is given, and -real requires every
+// resource name to be spelled out rather than taken from the defaults.
+func checkTarget() error {
+	emulator := os.Getenv("SPANNER_EMULATOR_HOST")
+	if flag.Arg(0) == "bisect" {
+		switch {
+		case *realSpanner:
+			return errors.New("bisect runs against the emulator, not -real")
+		case *emulatorMode != "":
+			return errors.New("bisect starts an emulator for each version; drop -emulator")
+		case *skipSetup:
+			return errors.New("bisect sets up each emulator it starts; drop -skip-setup")
+		}
+		return nil
+	}
+	if *emulatorMode != "" {
+		switch {
+		case *emulatorMode != "auto":
+			return fmt.Errorf("unknown -emulator: %s", *emulatorMode)
+		case *realSpanner:
+			return errors.New("-real and -emulator=auto are mutually exclusive")
+		case flag.Arg(0) == "setup", flag.Arg(0) == "teardown":
+			return fmt.Errorf("the %s subcommand needs a running emulator; -emulator=auto removes it on exit", flag.Arg(0))
+		}
+		return nil
+	}
+	if !*realSpanner {
+		if emulator == "" {
+			return errNoEmulator
+		}
+		return nil
+	}
+	if emulator != "" {
+		return fmt.Errorf("-real is set but SPANNER_EMULATOR_HOST=%s would redirect the clients to the emulator", emulator)
+	}
+	if *protocol == "rest" {
+		return errors.New("-real does not support -protocol=rest, which targets the emulator's REST port")
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, name := range []string{"project", "instance", "database"} {
+		if !set[name] {
+			return fmt.Errorf("-real requires an explicit -%s", name)
+		}
+	}
+	log.Printf("Target: Cloud Spanner %s", databaseName())
+	return nil
+}
+
+// newInstanceAdminClient and newDatabaseAdminClient honor -protocol. The gRPC
+// clients find the emulator through SPANNER_EMULATOR_HOST themselves; the REST
+// clients have to be pointed at its HTTP port.
+func newInstanceAdminClient(ctx context.Context) (*instance.InstanceAdminClient, error) {
+	if *protocol == "rest" {
+		return instance.NewInstanceAdminRESTClient(ctx, restOptions()...)
+	}
+	return instance.NewInstanceAdminClient(ctx, rpcTraceOptions()...)
+}
+
+func newDatabaseAdminClient(ctx context.Context) (*database.DatabaseAdminClient, error) {
+	if *protocol == "rest" {
+		return database.NewDatabaseAdminRESTClient(ctx, restOptions()...)
+	}
+	return database.NewDatabaseAdminClient(ctx, rpcTraceOptions()...)
+}
+
+// rpcTraceOptions returns the interceptors -trace, -trace-rpc, and
+// -trace-callers install on the data client and the gRPC admin clients.
+func rpcTraceOptions() []option.ClientOption {
+	if rpcTraceDetail() == traceOff {
+		return nil
+	}
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(rpcTraceUnaryInterceptor)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(rpcTraceStreamInterceptor)),
+	}
+}
+
+func restOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint("http://" + *restHost),
+		option.WithoutAuthentication(),
+	}
+}
+
+func clientOptions() []option.ClientOption {
+	opts := []option.ClientOption{option.WithGRPCConnectionPool(*grpcPool)}
+	if *verbosity >= 2 {
+		opts = append(opts,
+			option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(rpcTimingUnaryInterceptor)),
+			option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(rpcTimingStreamInterceptor)),
+		)
+	}
+	if *verbosity >= 1 {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(commitResponseInterceptor)))
+	}
+	if *metricsMode {
+		opts = append(opts,
+			option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(metricsUnaryInterceptor)),
+			option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(metricsStreamInterceptor)),
+		)
+	}
+	if *requestTag != "" || *priority != "default" {
+		// Ahead of the tracing interceptors, so that they show the options.
+		opts = append(opts,
+			option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(requestOptionsUnaryInterceptor)),
+			option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(requestOptionsStreamInterceptor)),
+		)
+	}
+	opts = append(opts, rpcTraceOptions()...)
+	if *commitStats {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(commitStatsInterceptor)))
+	}
+	return opts
+}
+
+// outcome classifies the result of one run as PASS, BUG, or ERROR.
+func outcome(err error) string { return repro.Outcome(err) }
+
+// repeatIteration is the -repeat iteration in flight, from 1, or 0 outside
+// of repeated.
+var repeatIteration int
+
+// repeated wraps run so that it is executed -repeat times on an empty table.
+// Every iteration whose outcome differs from the first is flagged, since a bug
+// that flips between PASS and BUG is a different finding from one that always
+// loses the write.
+func repeated(run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		var (
+			outcomes    []string
+			transitions int
+			firstErr    error
+		)
+		defer func() { repeatIteration = 0 }()
+		for i := 1; i <= *repeat; i++ {
+			if err := resetTable(ctx); err != nil {
+				return fmt.Errorf("reset before iteration %d: %w", i, err)
+			}
+			repeatIteration = i
+			err := run(ctx)
+			o := outcome(err)
+			if err != nil {
+				log.Printf("iteration %d: %s: %v", i, o, err)
+			} else {
+				log.Printf("iteration %d: %s", i, o)
+			}
+			if i > 1 && o != outcomes[0] {
+				log.Printf("iteration %d differs from first iteration (%s)", i, outcomes[0])
+			}
+			if i > 1 && o != outcomes[i-2] {
+				log.Printf("TRANSITION at iteration %d: %s -> %s", i, outcomes[i-2], o)
+				transitions++
+			}
+			outcomes = append(outcomes, o)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if *untilFail && err != nil {
+				log.Printf("-until-fail: stopping after iteration %d", i)
+				break
+			}
+		}
+		log.Printf("outcomes: %s", strings.Join(outcomes, " "))
+		var lost, n int
+		for _, o := range outcomes {
+			switch o {
+			case "BUG":
+				lost++
+				n++
+			case "PASS":
+				n++
+			}
+		}
+		log.Printf("reproduction: %s", estimateLoss(lost, n))
+		if *assertMonotonic && transitions > 0 {
+			return fmt.Errorf("outcome changed %d time(s) across %d iterations: %s", transitions, len(outcomes), strings.Join(outcomes, " "))
+		}
+		return firstErr
+	}
+}
+
+// resetTable deletes every row of T so an iteration starts from the same
+// state as a fresh database.
+func resetTable(ctx context.Context) error {
+	return resetTableOf(ctx, databaseName())
+}
+
+// resetTableOf is resetTable for the database db.
+func resetTableOf(ctx context.Context, db string) error {
+	enterPhase("reset")
+	client, err := newClientFor(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return clearTable(ctx, client)
+}
+
+func clearTable(ctx context.Context, client *spanner.Client) error {
+	_, err := client.Apply(ctx, []*spanner.Mutation{spanner.Delete(*table, spanner.AllKeys())}, spanner.TransactionTag(runTag()))
+	return err
+}
+
+// reproduceCount runs the insert/delete/verify cycle -count times on one
+// client, clearing T before each cycle, and reports how many cycles lost the
+// write. Unlike -repeat, the session pool and multiplexed session carry over
+// from one cycle to the next.
+func reproduceCount(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var lost, n int
+	for i := 1; i <= *count; i++ {
+		n = i
+		if err := clearTable(ctx, client); err != nil {
+			return fmt.Errorf("reset before iteration %d: %w", i, err)
+		}
+		if err := insertRow(ctx, client); err != nil {
+			return fmt.Errorf("iteration %d: %w", i, err)
+		}
+		reported, commitTs, err := deleteRow(ctx, client, txnOpts, deleteHooks())
+		if err != nil {
+			return fmt.Errorf("iteration %d: %w", i, err)
+		}
+		err = checkReported(verifyDeleted(ctx, client, commitTs), reported)
+		if errors.Is(err, errWriteLost) {
+			lost++
+			log.Printf("iteration %d: BUG: %v", i, err)
+			if *untilFail {
+				log.Printf("-until-fail: stopping after iteration %d", i)
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("iteration %d: %w", i, err)
+		}
+		log.Printf("iteration %d: PASS", i)
+	}
+	log.Printf("%d/%d iterations lost the write; %s", lost, n, estimateLoss(lost, n))
+	if lost > 0 {
+		return fmt.Errorf("%w: %d/%d iterations lost the write", errWriteLost, lost, n)
+	}
+	return nil
+}
+
+func transactionOptions() (spanner.TransactionOptions, error) {
+	beginOpt, err := parseBeginOption()
+	if err != nil {
+		return spanner.TransactionOptions{}, err
+	}
+	isolationLevel, err := isolationLevel()
+	if err != nil {
+		return spanner.TransactionOptions{}, err
+	}
+	lockMode, err := lockMode()
+	if err != nil {
+		return spanner.TransactionOptions{}, err
+	}
+	opts := spanner.TransactionOptions{
+		BeginTransactionOption:      beginOpt,
+		TransactionTag:              runTag(),
+		IsolationLevel:              isolationLevel,
+		ReadLockMode:                lockMode,
+		ExcludeTxnFromChangeStreams: *excludeStreams,
+	}
+	if *maxCommitDelay > 0 {
+		opts.CommitOptions.MaxCommitDelay = maxCommitDelay
+	}
+	opts.CommitOptions.ReturnCommitStats = *commitStats
+	return opts, nil
+}
+
+// runTag is the transaction tag: -transaction-tag, or one carrying runID.
+func runTag() string {
+	if *transactionTag != "" {
+		return *transactionTag
+	}
+	return "run-" + runID
+}
+
+// runRequestTag is the request tag of the verifying reads: -request-tag, or
+// one carrying runID. With -request-tag, setRequestOptions sets it on every
+// other request too.
+func runRequestTag() string {
+	if *requestTag != "" {
+		return *requestTag
 	}
+	return "run-" + runID
 }
 
-func main() {
-	flag.Parse()
-	log.SetFlags(0)
+func newClient(ctx context.Context, opts ...option.ClientOption) (*spanner.Client, error) {
+	return newClientFor(ctx, databaseName(), opts...)
+}
 
-	if os.Getenv("SPANNER_EMULATOR_HOST") == "" {
-		log.Fatal("SPANNER_EMULATOR_HOST is not set")
+// newClientFor is newClient for the database db.
+func newClientFor(ctx context.Context, db string, opts ...option.ClientOption) (*spanner.Client, error) {
+	opts = append(clientOptions(), opts...)
+	client, err := spanner.NewClientWithConfig(ctx, db,
+		spanner.ClientConfig{
+			DisableNativeMetrics: true,
+			DisableRouteToLeader: !*routeToLeader,
+			SessionPoolConfig:    sessionPoolConfig(),
+		},
+		opts...,
+	)
+	if err == nil {
+		clientOpts.Store(client, opts)
 	}
+	return client, err
+}
 
-	ctx := context.Background()
+// clientOpts maps each client newClientFor created to the options it was
+// created with, for the RPCs -delete=autocommit makes outside of it.
+var clientOpts sync.Map
 
-	if !*skipSetup {
-		if err := setup(ctx); err != nil {
-			log.Fatalf("Setup: %v", err)
-		}
+// clientOptionsOf returns the options client was created with by
+// newClientFor, or clientOptions for a client it did not create.
+func clientOptionsOf(client *spanner.Client) []option.ClientOption {
+	if opts, ok := clientOpts.Load(client); ok {
+		return opts.([]option.ClientOption)
+	}
+	return clientOptions()
+}
+
+func sessionPoolConfig() spanner.SessionPoolConfig {
+	cfg := spanner.SessionPoolConfig{
+		MinOpened:                     *minOpened,
+		MaxOpened:                     *maxOpened,
+		MaxIdle:                       *maxIdle,
+		HealthCheckInterval:           *sessionMaintenanceInterval,
+		MultiplexSessionCheckInterval: *sessionMaintenanceInterval,
 	}
-	if err := reproduce(ctx); err != nil {
-		log.Fatalf("FAIL: %v", err)
+	if *pool == "warmed" {
+		cfg.MinOpened = cfg.MaxOpened
 	}
-	log.Println("PASS")
+	return cfg
 }
 
-func setup(ctx context.Context) error {
-	ic, err := instance.NewInstanceAdminClient(ctx)
+func reproduce(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
 	if err != nil {
 		return err
 	}
-	defer ic.Close()
 
-	iop, err := ic.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
-		Parent:     "projects/test-project",
-		InstanceId: "test-instance",
-		Instance: &instancepb.Instance{
-			Config:      "projects/test-project/instanceConfigs/emulator-config",
-			DisplayName: "test-instance",
-			NodeCount:   1,
-		},
-	})
+	var opts []option.ClientOption
+	var watcher *poolWatcher
+	if *pool == "warmed" || *poolStats || *listSessions {
+		watcher = newPoolWatcher()
+		opts = watcher.clientOptions()
+	}
+	client, err := newClient(ctx, opts...)
 	if err != nil {
 		return err
 	}
-	if _, err := iop.Wait(ctx); err != nil {
-		return err
+	defer client.Close()
+	if *poolStats {
+		defer watcher.logSummary(sessionPoolConfig())
+	}
+	if *pool == "warmed" {
+		if err := watcher.await(ctx, sessionPoolConfig()); err != nil {
+			return err
+		}
 	}
 
-	dc, err := database.NewDatabaseAdminClient(ctx)
-	if err != nil {
-		return err
+	if *checkModel {
+		return reproduceWithModel(ctx, client, txnOpts)
 	}
-	defer dc.Close()
 
-	dop, err := dc.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
-		Parent:          "projects/test-project/instances/test-instance",
-		CreateStatement: "CREATE DATABASE `test-database`",
-		ExtraStatements: []string{
-			"CREATE TABLE T (PK INT64 NOT NULL, Val INT64) PRIMARY KEY(PK)",
-		},
-	})
-	if err != nil {
+	if *listSessions {
+		logSessions(ctx, "before", watcher)
+		defer func() {
+			// A fresh context, so that an expired -timeout still lets
+			// the listing show where the run stopped.
+			ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+			defer cancel()
+			logSessions(ctx, "after", watcher)
+		}()
+	}
+
+	dumpState(ctx, client, "setup")
+	if err := insertRow(ctx, client); err != nil {
+		return stepError(stepInsert, err)
+	}
+	dumpState(ctx, client, "insert")
+	if err := awaitSessionMaintenance(ctx); err != nil {
 		return err
 	}
-	_, err = dop.Wait(ctx)
-	return err
+	reported, commitTs, err := deleteRow(ctx, client, txnOpts, deleteHooks())
+	if err != nil {
+		return stepError(stepDelete, err)
+	}
+	dumpState(ctx, client, *op)
+	return stepError(stepVerify, checkReported(verifyDeleted(ctx, client, commitTs), reported))
 }
 
-func reproduce(ctx context.Context) error {
-	beginOpt, err := parseBeginOption()
-	if err != nil {
+// reproduceWithModel is reproduce with the expected-state model checked
+// against the server before and after every step. After the DELETE the check
+// only applies to control modes: in the other modes a divergence there is the
+// bug under test, which verifyDeleted reports.
+func reproduceWithModel(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions) error {
+	model := newTableModel()
+	if err := model.guard(ctx, client, "setup"); err != nil {
+		return err
+	}
+	dumpState(ctx, client, "setup")
+	if err := insertRow(ctx, client); err != nil {
+		return stepError(stepInsert, err)
+	}
+	dumpState(ctx, client, "insert")
+	for pk := int64(1); pk <= int64(*rows); pk++ {
+		model.put(pk, pk)
+	}
+	if err := model.guard(ctx, client, "INSERT"); err != nil {
+		return err
+	}
+	if err := awaitSessionMaintenance(ctx); err != nil {
 		return err
 	}
-	txnOpts := spanner.TransactionOptions{
-		BeginTransactionOption: beginOpt,
+	reported, commitTs, err := deleteRow(ctx, client, txnOpts, deleteHooks())
+	if err != nil {
+		return stepError(stepDelete, err)
+	}
+	dumpState(ctx, client, *op)
+	if *op != "delete" {
+		model.put(writtenPK(1), updatedVal)
+	} else if *keySet != "single" {
+		for pk := int64(1); pk <= int64(*rows); pk++ {
+			model.delete(pk)
+		}
+	} else {
+		model.delete(1)
+	}
+	if controlDeleteModes[*deleteMode] {
+		if err := model.guard(ctx, client, strings.ToUpper(*op)); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("model: -delete=%s is not a control mode, leaving the post-DELETE check to verification", *deleteMode)
 	}
+	return stepError(stepVerify, checkReported(verifyDeleted(ctx, client, commitTs), reported))
+}
 
-	client, err := spanner.NewClientWithConfig(ctx, db,
-		spanner.ClientConfig{
-			DisableNativeMetrics: true,
-			SessionPoolConfig: spanner.SessionPoolConfig{
-				MinOpened: 1,
-				MaxOpened: 10,
-			},
-		},
-		option.WithGRPCConnectionPool(1),
-	)
+// awaitSessionMaintenance gives the session pool two
+// -session-maintenance-interval intervals to ping, recycle, and refresh
+// sessions, so that the DELETE runs on a session that has been through
+// maintenance.
+func awaitSessionMaintenance(ctx context.Context) error {
+	if *sessionMaintenanceInterval <= 0 {
+		return nil
+	}
+	wait := 2 * *sessionMaintenanceInterval
+	cfg := sessionPoolConfig()
+	log.Printf("Session pool: MinOpened=%d MaxOpened=%d MaxIdle=%d maintenance interval=%s; waiting %s before DELETE",
+		cfg.MinOpened, cfg.MaxOpened, cfg.MaxIdle, *sessionMaintenanceInterval, wait)
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// insertSQLText returns the statement used by -insert=dml.
+func insertSQLText() string {
+	if *insertSQL != "" {
+		return *insertSQL
+	}
+	values := make([]string, *rows)
+	for i := range values {
+		values[i] = fmt.Sprintf("(%d, %d)", rowPK(int64(i+1)), i+1)
+	}
+	return sqlFor("INSERT INTO T (PK, Val) VALUES " + strings.Join(values, ", "))
+}
+
+// insertedRows returns the -rows insert mutations for PK=1..N.
+func insertedRows() []*spanner.Mutation {
+	ms := make([]*spanner.Mutation, *rows)
+	for i := range ms {
+		ms[i] = spanner.Insert(*table, []string{*pkColumn, "Val"}, []any{rowPK(int64(i + 1)), i + 1})
+	}
+	return ms
+}
+
+// insertRow is Step 1: INSERT PK=1 (PK=1..-rows) using the mode selected by
+// -insert.
+func insertRow(ctx context.Context, client *spanner.Client) error {
+	enterPhase("insert")
+	beginOpt, err := parseBeginOption()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	opts := spanner.TransactionOptions{TransactionTag: runTag(), BeginTransactionOption: beginOpt}
+	row := insertedRows()
 
-	// Step 1: INSERT via DML (fixed, not relevant to the bug).
-	log.Println("INSERT: ReadWriteTransaction (DML)")
-	_, err = client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		_, err := txn.Update(ctx, spanner.Statement{SQL: "INSERT INTO T (PK, Val) VALUES (1, 1)"})
-		return err
-	})
+	var commitTs time.Time
+
+	switch *insertMode {
+	case "dml":
+		log.Printf("INSERT: ReadWriteTransaction (DML, begin=%s)", *beginMode)
+		var resp spanner.CommitResponse
+		resp, err = client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			_, err := txn.Update(ctx, spanner.Statement{SQL: insertSQLText()})
+			return err
+		}, opts)
+		commitTs = resp.CommitTs
+	case "mutation":
+		log.Printf("INSERT: ReadWriteTransaction (BufferWrite, begin=%s)", *beginMode)
+		var resp spanner.CommitResponse
+		resp, err = client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			return txn.BufferWrite(row)
+		}, opts)
+		commitTs = resp.CommitTs
+	case "apply":
+		log.Printf("INSERT: client.Apply (at-least-once=%t)", *atLeastOnce)
+		commitTs, err = client.Apply(ctx, row, applyOptions(spanner.TransactionTag(runTag()))...)
+	default:
+		return fmt.Errorf("unknown insert mode: %s", *insertMode)
+	}
 	if err != nil {
 		return fmt.Errorf("insert: %w", err)
 	}
+	log.Printf("INSERT committed at %s", commitTs.Format(time.RFC3339Nano))
+	recordCommit("insert", commitTs)
+	return nil
+}
+
+// applyOptions returns opts, with ApplyAtLeastOnce added for -at-least-once.
+func applyOptions(opts ...spanner.ApplyOption) []spanner.ApplyOption {
+	if *atLeastOnce {
+		opts = append(opts, spanner.ApplyAtLeastOnce())
+	}
+	return opts
+}
+
+// txnHooks are optional callbacks run inside the DELETE transaction. Modes
+// without a caller-visible transaction (apply, autocommit, pdml) do not run
+// them.
+type txnHooks struct {
+	// beforeWrite runs once the transaction exists, before the DELETE is
+	// buffered or executed.
+	beforeWrite func(context.Context, *spanner.ReadWriteTransaction) error
+	// afterWrite runs once the DELETE has been buffered or executed, before
+	// the transaction commits.
+	afterWrite func(context.Context, *spanner.ReadWriteTransaction) error
+}
+
+func (h txnHooks) runBeforeWrite(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	return runHook(ctx, txn, "before write", h.beforeWrite)
+}
+
+func (h txnHooks) runAfterWrite(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	return runHook(ctx, txn, "after write", h.afterWrite)
+}
+
+func runHook(ctx context.Context, txn *spanner.ReadWriteTransaction, stage string, hook func(context.Context, *spanner.ReadWriteTransaction) error) error {
+	if hook == nil {
+		return nil
+	}
+	if err := hook(ctx, txn); err != nil {
+		return fmt.Errorf("%s: %w", stage, err)
+	}
+	return nil
+}
+
+// deleteHooks returns the hooks requested by flags for the DELETE transaction.
+func deleteHooks() txnHooks {
+	var before []func(context.Context, *spanner.ReadWriteTransaction) error
+	if *invalidTableThenDelete {
+		before = append(before, queryMissingTable)
+	}
+	if *concurrentReads > 0 {
+		before = append(before, readConcurrently(*concurrentReads))
+	}
+	var after []func(context.Context, *spanner.ReadWriteTransaction) error
+	if *readYourWrites {
+		after = append(after, checkReadYourWrites)
+	}
+	return txnHooks{beforeWrite: chainHooks(before...), afterWrite: chainHooks(after...)}
+}
+
+// checkReadYourWrites reads the written row inside the transaction after the
+// write and checks it against what the -delete mode guarantees: DML is
+// visible to later reads in the same transaction, buffered mutations are not
+// applied until commit. A row that reads as expected here but survives the
+// commit was lost at commit, not when the write was issued.
+func checkReadYourWrites(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	dml := dmlDeleteModes[*deleteMode]
+	pk := writtenPK(1)
+	row, err := txn.ReadRow(ctx, *table, spanner.Key{pk}, []string{"Val"})
+	exists := err == nil
+	if err != nil && spanner.ErrCode(err) != codes.NotFound {
+		return fmt.Errorf("read-your-writes: %w", err)
+	}
+	var val spanner.NullInt64
+	if exists {
+		if err := row.Column(0, &val); err != nil {
+			return fmt.Errorf("read-your-writes: scan: %w", err)
+		}
+	}
+
+	var visible bool
+	if *op == "delete" {
+		visible = !exists
+	} else {
+		visible = exists && val.Valid && val.Int64 == updatedVal
+	}
+	log.Printf("read-your-writes: before commit PK=%d exists=%t Val=%v; write visible=%t (expected %t for -delete=%s)",
+		pk, exists, val, visible, dml, *deleteMode)
+	if visible != dml {
+		return fmt.Errorf("read-your-writes: write visible=%t inside the transaction, expected %t for -delete=%s", visible, dml, *deleteMode)
+	}
+	return nil
+}
+
+// chainHooks returns a hook running each non-nil hook of hooks in order, or
+// nil if there are none.
+func chainHooks(hooks ...func(context.Context, *spanner.ReadWriteTransaction) error) func(context.Context, *spanner.ReadWriteTransaction) error {
+	hooks = slices.DeleteFunc(hooks, func(h func(context.Context, *spanner.ReadWriteTransaction) error) bool { return h == nil })
+	if len(hooks) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		for _, hook := range hooks {
+			if err := hook(ctx, txn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// queryMissingTable runs a query against a table that does not exist and
+// swallows the expected error, leaving the transaction to continue with the
+// DELETE. With an inlined begin this is the statement that was supposed to
+// start the transaction, so the client has to recover from the failed begin.
+func queryMissingTable(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	err := txn.Query(ctx, spanner.Statement{SQL: sqlFor("SELECT PK FROM MissingTable")}).Do(func(*spanner.Row) error { return nil })
+	if err == nil {
+		return errors.New("query on MissingTable unexpectedly succeeded")
+	}
+	log.Printf("Query on MissingTable failed as expected (%s): %v", spanner.ErrCode(err), err)
+	return nil
+}
+
+// readConcurrently returns a hook that reads the rows of writePKs from n
+// goroutines at once within the transaction, stressing the transaction's
+// shared state (inlined begin, precommit token tracking) before the write.
+func readConcurrently(n int) func(context.Context, *spanner.ReadWriteTransaction) error {
+	return func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		pks := writePKs()
+		log.Printf("Reading PK=%d (%d row(s)) from %d goroutines inside the transaction", pks[0], len(pks), n)
+		g, ctx := errgroup.WithContext(ctx)
+		for i := 0; i < n; i++ {
+			g.Go(func() error {
+				defer exitOnPanic()
+				err := txn.Read(ctx, *table, keySetOf(pks), []string{*pkColumn, "Val"}).Do(func(*spanner.Row) error { return nil })
+				if err != nil {
+					return fmt.Errorf("concurrent read %d: %w", i, err)
+				}
+				return nil
+			})
+		}
+		return g.Wait()
+	}
+}
+
+// writePKs returns the keys the write made by -op and -delete targets: the
+// first row of the run, or with a -keyset other than single, its -rows rows.
+func writePKs() []int64 {
+	if *keySet == "single" {
+		return []int64{writtenPK(rowPK(1))}
+	}
+	pks := make([]int64, *rows)
+	for i := range pks {
+		pks[i] = rowPK(int64(i + 1))
+	}
+	return pks
+}
+
+// keySetOf returns the key set of the rows pks.
+func keySetOf(pks []int64) spanner.KeySet {
+	keys := make([]spanner.KeySet, len(pks))
+	for i, pk := range pks {
+		keys[i] = spanner.Key{pk}
+	}
+	return spanner.KeySets(keys...)
+}
+
+// deleteRow is Step 2: DELETE using the mode selected by -delete. With
+// -op=update it writes Val=99 instead, through the same mode. It returns the
+// number of rows the server reported writing, or noRowCount, and the commit
+// timestamp, or zero for the modes that report none.
+func deleteRow(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions, hooks txnHooks) (int64, time.Time, error) {
+	return deleteRowPK(ctx, client, txnOpts, hooks, rowPK(1))
+}
+
+// writeFor returns the write -op and -delete make to the row pk, as a log
+// label, a mutation for the mutation modes, and a statement for the DML modes.
+func writeFor(pk int64) (string, *spanner.Mutation, spanner.Statement) {
+	label := "DELETE"
+	m := spanner.Delete(*table, spanner.Key{pk})
+	stmt := spanner.Statement{
+		SQL:    sqlFor("DELETE FROM T WHERE PK = @p1"),
+		Params: map[string]any{"p1": pk},
+	}
+	end := pk + int64(*rows) - 1
+	switch *keySet {
+	case "range":
+		m = spanner.Delete(*table, spanner.KeyRange{Start: spanner.Key{pk}, End: spanner.Key{end}, Kind: spanner.ClosedClosed})
+		stmt = spanner.Statement{
+			SQL:    sqlFor("DELETE FROM T WHERE PK BETWEEN @p1 AND @p2"),
+			Params: map[string]any{"p1": pk, "p2": end},
+		}
+	case "keys":
+		var keys []spanner.KeySet
+		var in []string
+		for k := pk; k <= end; k++ {
+			keys = append(keys, spanner.Key{k})
+			in = append(in, strconv.FormatInt(k, 10))
+		}
+		m = spanner.Delete(*table, spanner.KeySets(keys...))
+		stmt = spanner.Statement{SQL: sqlFor("DELETE FROM T WHERE PK IN (" + strings.Join(in, ", ") + ")")}
+	case "all", "prefix":
+		// A KeyRange between two empty prefixes covers every key,
+		// like AllKeys, but reaches the emulator as a range.
+		ks := spanner.AllKeys()
+		if *keySet == "prefix" {
+			ks = spanner.KeyRange{Start: spanner.Key{}, End: spanner.Key{}, Kind: spanner.ClosedClosed}
+		}
+		m = spanner.Delete(*table, ks)
+		stmt = spanner.Statement{SQL: sqlFor("DELETE FROM T WHERE true")}
+	}
+	if *keySet != "single" {
+		label = "DELETE " + *keySet
+	}
+	if *deleteSQL != "" {
+		stmt = spanner.Statement{SQL: *deleteSQL}
+	}
+	cols, vals := []string{*pkColumn, "Val"}, []any{writtenPK(pk), int64(updatedVal)}
+	switch *op {
+	case "update":
+		label = "UPDATE"
+		m = spanner.Update(*table, cols, vals)
+		stmt = spanner.Statement{
+			SQL:    sqlFor("UPDATE T SET Val = @p1 WHERE PK = @p2"),
+			Params: map[string]any{"p1": int64(updatedVal), "p2": pk},
+		}
+	case "insert":
+		label = "INSERT"
+		m = spanner.Insert(*table, cols, vals)
+		stmt = spanner.Statement{
+			SQL:    sqlFor("INSERT INTO T (PK, Val) VALUES (@p1, @p2)"),
+			Params: map[string]any{"p1": writtenPK(pk), "p2": int64(updatedVal)},
+		}
+	case "insert_or_update":
+		label = "INSERT_OR_UPDATE"
+		m = spanner.InsertOrUpdate(*table, cols, vals)
+		stmt = spanner.Statement{
+			SQL:    sqlFor("INSERT OR UPDATE INTO T (PK, Val) VALUES (@p1, @p2)"),
+			Params: map[string]any{"p1": writtenPK(pk), "p2": int64(updatedVal)},
+		}
+		if isPostgreSQL() {
+			stmt.SQL = sqlFor("INSERT INTO T (PK, Val) VALUES (@p1, @p2) ON CONFLICT (PK) DO UPDATE SET Val = excluded.Val")
+		}
+	case "replace":
+		// Rejected for the DML modes in main, so stmt is never used.
+		label = "REPLACE"
+		m = spanner.Replace(*table, cols, vals)
+	}
+	return label, m, stmt
+}
 
-	// Step 2: DELETE
+// deleteRowPK is deleteRow for the row pk.
+func deleteRowPK(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions, hooks txnHooks, pk int64) (int64, time.Time, error) {
+	label, m, stmt := writeFor(pk)
+	enterPhase(strings.ToLower(label))
+	ctx, stats := withCommitStats(ctx)
+	var (
+		commitTs time.Time
+		rowCount int64 = noRowCount
+		err      error
+	)
+	start := time.Now()
 	switch *deleteMode {
 	case "stmt-mutation":
-		log.Printf("DELETE: StmtBasedTransaction (BufferWrite, begin=%s)", *beginMode)
-		err = execStmtMutation(ctx, client, txnOpts)
+		log.Printf("%s: StmtBasedTransaction (BufferWrite, begin=%s)", label, *beginMode)
+		commitTs, err = execStmtMutation(ctx, client, txnOpts, hooks, m)
 	case "rw-mutation":
-		log.Printf("DELETE: ReadWriteTransaction (BufferWrite, begin=%s)", *beginMode)
-		_, err = client.ReadWriteTransactionWithOptions(ctx,
+		log.Printf("%s: ReadWriteTransaction (BufferWrite, begin=%s)", label, *beginMode)
+		var resp spanner.CommitResponse
+		resp, err = client.ReadWriteTransactionWithOptions(ctx,
 			func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-				return txn.BufferWrite([]*spanner.Mutation{
-					spanner.Delete("T", spanner.Key{1}),
-				})
+				if err := hooks.runBeforeWrite(ctx, txn); err != nil {
+					return err
+				}
+				if err := txn.BufferWrite([]*spanner.Mutation{m}); err != nil {
+					return err
+				}
+				return hooks.runAfterWrite(ctx, txn)
 			}, txnOpts)
+		commitTs = resp.CommitTs
 	case "apply":
-		log.Println("DELETE: client.Apply (begin option N/A)")
-		_, err = client.Apply(ctx, []*spanner.Mutation{
-			spanner.Delete("T", spanner.Key{1}),
-		})
+		log.Printf("%s: client.Apply (begin option N/A, at-least-once=%t)", label, *atLeastOnce)
+		commitTs, err = client.Apply(ctx, []*spanner.Mutation{m}, applyOptions(spanner.ApplyCommitOptions(txnOpts.CommitOptions), spanner.TransactionTag(txnOpts.TransactionTag))...)
 	case "stmt-dml":
-		log.Printf("DELETE: StmtBasedTransaction (DML, begin=%s)", *beginMode)
-		err = execStmtDML(ctx, client, txnOpts, "DELETE FROM T WHERE PK = 1")
+		log.Printf("%s: StmtBasedTransaction (DML, begin=%s)", label, *beginMode)
+		commitTs, rowCount, err = execStmtDML(ctx, client, txnOpts, hooks, stmt)
+	case "stmt-dml-return":
+		log.Printf("%s: StmtBasedTransaction (DML with %s, begin=%s)", label, returningClause(), *beginMode)
+		commitTs, rowCount, err = execStmtDMLReturn(ctx, client, txnOpts, hooks, stmt)
+	case "stmt-batch-dml":
+		log.Printf("%s: StmtBasedTransaction (BatchUpdate, begin=%s)", label, *beginMode)
+		commitTs, rowCount, err = execStmtBatchDML(ctx, client, txnOpts, hooks, stmt)
+	case "rw-batch-dml":
+		log.Printf("%s: ReadWriteTransaction (BatchUpdate, begin=%s)", label, *beginMode)
+		var resp spanner.CommitResponse
+		resp, err = client.ReadWriteTransactionWithOptions(ctx,
+			func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+				if err := hooks.runBeforeWrite(ctx, txn); err != nil {
+					return err
+				}
+				counts, err := txn.BatchUpdate(ctx, []spanner.Statement{stmt})
+				if err != nil {
+					return fmt.Errorf("batch update: %w", err)
+				}
+				log.Printf("BatchUpdate row counts: %v", counts)
+				rowCount = 0
+				for _, c := range counts {
+					rowCount += c
+				}
+				return hooks.runAfterWrite(ctx, txn)
+			}, txnOpts)
+		commitTs = resp.CommitTs
+	case "mixed":
+		log.Printf("%s: StmtBasedTransaction (DML UPDATE, then BufferWrite, begin=%s)", label, *beginMode)
+		commitTs, err = execStmtMixed(ctx, client, txnOpts, hooks, pk, m)
+	case "autocommit":
+		log.Printf("%s: autocommit DML, raw ExecuteSql beginning the transaction + Commit (begin option N/A)", label)
+		commitTs, rowCount, err = execAutocommitDML(ctx, client, txnOpts, stmt)
+	case "pdml":
+		log.Printf("%s: client.PartitionedUpdate (begin option N/A; no commit timestamp)", label)
+		rowCount, err = client.PartitionedUpdate(ctx, stmt)
+		if err == nil {
+			log.Printf("pdml: lower bound of %d row(s) affected", rowCount)
+		}
+	case "batchwrite":
+		log.Printf("%s: client.BatchWrite, one mutation group (begin option N/A)", label)
+		commitTs, err = execBatchWrite(ctx, client, txnOpts, []*spanner.MutationGroup{{Mutations: []*spanner.Mutation{m}}})
 	default:
-		return fmt.Errorf("unknown delete mode: %s", *deleteMode)
+		return noRowCount, time.Time{}, fmt.Errorf("unknown delete mode: %s", *deleteMode)
 	}
 	if err != nil {
-		return fmt.Errorf("delete: %w", err)
+		return noRowCount, time.Time{}, fmt.Errorf("%s: %w", strings.ToLower(label), err)
+	}
+	if !commitTs.IsZero() {
+		log.Printf("%s committed at %s", label, commitTs.Format(time.RFC3339Nano))
+		recordCommit(label, commitTs)
+	}
+	if rowCount != noRowCount {
+		log.Printf("%s: server reported %d row(s) affected", label, rowCount)
+	}
+	if *commitStats {
+		if err := checkCommitStats(label, stats); err != nil {
+			return rowCount, commitTs, err
+		}
+	}
+	if d := txnOpts.CommitOptions.MaxCommitDelay; d != nil {
+		log.Printf("%s took %s with MaxCommitDelay=%s", label, time.Since(start).Round(time.Millisecond), *d)
 	}
+	return rowCount, commitTs, nil
+}
 
-	// Step 3: Verify deletion.
-	row, err := client.Single().ReadRow(ctx, "T", spanner.Key{1}, []string{"PK"})
+// verifyDeleted is Step 3: verify that PK=1 is gone. writeTs is the commit
+// timestamp of the write, or zero if it reported none.
+func verifyDeleted(ctx context.Context, client *spanner.Client, writeTs time.Time) error {
+	enterPhase("verify")
+	if *op != "delete" {
+		return verifyWritten(ctx, client, writeTs)
+	}
+	if *verifyColumns {
+		return verifyDeletedColumns(ctx, client, writeTs)
+	}
+	if *keySet != "single" {
+		return verifyRangeDeleted(ctx, client)
+	}
+	pk := rowPK(1)
+	exists, readTs, err := rowExists(ctx, client, pk, []string{*pkColumn}, writeTs)
 	if err != nil {
-		if spanner.ErrCode(err) == codes.NotFound {
-			return nil
+		return err
+	}
+	log.Printf("verify (%s) read at %s: PK=%d exists=%t", *verifyMode, readTs.Format(time.RFC3339Nano), pk, exists)
+	if err := checkReadAfterWrite(readTs, writeTs); err != nil {
+		return err
+	}
+	if *verifyMode == "changestream" {
+		if err := checkChangeStream(ctx, client, pk, exists); err != nil {
+			return err
 		}
-		return fmt.Errorf("read: %w", err)
 	}
+	if exists {
+		return &survivedError{pk: pk, rows: 1}
+	}
+	return nil
+}
 
-	var pk int64
-	if err := row.Column(0, &pk); err != nil {
-		return fmt.Errorf("scan: %w", err)
+// verifyRangeDeleted is Step 3 for every -keyset but single: verify that
+// PK=1..-rows, which the key set covers, are all gone.
+func verifyRangeDeleted(ctx context.Context, client *spanner.Client) error {
+	pks := make([]int64, *rows)
+	for i := range pks {
+		pks[i] = rowPK(int64(i + 1))
+	}
+	survived, err := survivingRows(ctx, client, pks)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("BUG: row PK=%d still exists after DELETE succeeded without error", pk)
+	if len(survived) == 0 {
+		return nil
+	}
+	first := slices.Min(slices.Collect(maps.Keys(survived)))
+	return &survivedError{pk: first, rows: len(survived), detail: fmt.Sprintf(" (%d of %d rows in -keyset=%s survived)", len(survived), len(pks), *keySet)}
 }
 
-func execStmtDML(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, sql string) error {
-	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+// survivingRows is Step 3 for scenarios that delete more than one row. It
+// reads all of T in one query, logs every row it finds, and returns which of
+// the deleted keys pks are still present.
+func survivingRows(ctx context.Context, client *spanner.Client, pks []int64) (map[int64]bool, error) {
+	enterPhase("verify")
+	rows, err := readRows(ctx, client)
 	if err != nil {
-		return fmt.Errorf("begin: %w", err)
+		return nil, err
 	}
-	iter := txn.Query(ctx, spanner.Statement{SQL: sql})
-	if err := iter.Do(func(_ *spanner.Row) error { return nil }); err != nil {
-		txn.Rollback(ctx)
-		return fmt.Errorf("query: %w", err)
+	var all []string
+	for _, pk := range slices.Sorted(maps.Keys(rows)) {
+		all = append(all, fmt.Sprintf("PK=%d Val=%v", pk, rows[pk]))
 	}
-	_, err = txn.CommitWithReturnResp(ctx)
-	return err
+	log.Printf("verify: T has %d row(s): %s", len(rows), strings.Join(all, ", "))
+	survived := make(map[int64]bool)
+	for _, pk := range pks {
+		if _, ok := rows[pk]; ok {
+			survived[pk] = true
+		}
+	}
+	return survived, nil
+}
+
+// updatedVal is the value every -op but delete writes.
+const updatedVal = 99
+
+// insertOffset keeps the row -op=insert writes apart from the rows the
+// scenario inserts: the write to pk inserts PK=pk+insertOffset.
+const insertOffset = 1000
+
+// writtenPK returns the key the -op write to the row pk goes to.
+func writtenPK(pk int64) int64 {
+	if *op == "insert" {
+		return pk + insertOffset
+	}
+	return pk
 }
 
-func execStmtMutation(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions) error {
-	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+// verifyWritten is Step 3 for every -op but delete: verify that the written
+// row has Val=99.
+func verifyWritten(ctx context.Context, client *spanner.Client, writeTs time.Time) error {
+	label := strings.ToUpper(*op)
+	pk := writtenPK(rowPK(1))
+	ro := client.Single().WithTimestampBound(verifyBound(writeTs))
+	row, err := ro.ReadRowWithOptions(ctx, *table, spanner.Key{pk}, []string{"Val"}, &spanner.ReadOptions{RequestTag: runRequestTag()})
+	if spanner.ErrCode(err) == codes.NotFound {
+		if *op == "update" {
+			return fmt.Errorf("row PK=%d is missing after %s", pk, label)
+		}
+		return fmt.Errorf("%w: row PK=%d is missing after %s succeeded without error", errWriteLost, pk, label)
+	}
 	if err != nil {
-		return fmt.Errorf("begin: %w", err)
+		return fmt.Errorf("read: %w", err)
 	}
-	if err := txn.BufferWrite([]*spanner.Mutation{
-		spanner.Delete("T", spanner.Key{1}),
-	}); err != nil {
-		txn.Rollback(ctx)
-		return fmt.Errorf("buffer write: %w", err)
+	var val spanner.NullInt64
+	if err := row.Column(0, &val); err != nil {
+		return fmt.Errorf("scan: %w", err)
 	}
-	_, err = txn.CommitWithReturnResp(ctx)
-	return err
+	readTs, _ := ro.Timestamp()
+	log.Printf("verify (%s) read at %s: PK=%d Val=%v", *verifyMode, readTs.Format(time.RFC3339Nano), pk, val)
+	if err := checkReadAfterWrite(readTs, writeTs); err != nil {
+		return err
+	}
+	if !val.Valid || val.Int64 != updatedVal {
+		return fmt.Errorf("%w: Val=%v after %s to %d succeeded without error", errWriteLost, val, label, updatedVal)
+	}
+	return nil
+}
+
+// verifyColumnSets returns the projections read by -verify-columns. Survival of
+// the row must not depend on which columns the read asks for.
+func verifyColumnSets() [][]string {
+	return [][]string{{*pkColumn}, {*pkColumn, "Val"}, {"Val"}}
+}
+
+// verifyDeletedColumns reads PK=1 once per column set in verifyColumnSets and
+// reports each result, failing if the row survived in any of them.
+func verifyDeletedColumns(ctx context.Context, client *spanner.Client, writeTs time.Time) error {
+	var survived, deleted []string
+	for _, cols := range verifyColumnSets() {
+		exists, readTs, err := rowExists(ctx, client, rowPK(1), cols, writeTs)
+		if err != nil {
+			return fmt.Errorf("columns %v: %w", cols, err)
+		}
+		log.Printf("verify columns %v (%s) read at %s: exists=%t", cols, *verifyMode, readTs.Format(time.RFC3339Nano), exists)
+		if err := checkReadAfterWrite(readTs, writeTs); err != nil {
+			return fmt.Errorf("columns %v: %w", cols, err)
+		}
+		if exists {
+			survived = append(survived, fmt.Sprint(cols))
+		} else {
+			deleted = append(deleted, fmt.Sprint(cols))
+		}
+	}
+	switch {
+	case len(survived) == 0:
+		return nil
+	case len(deleted) == 0:
+		return &survivedError{pk: rowPK(1), rows: 1, detail: " (all column sets)"}
+	default:
+		return fmt.Errorf("%w: column sets disagree: row PK=%d exists reading %s but not reading %s",
+			errWriteLost, rowPK(1), strings.Join(survived, ", "), strings.Join(deleted, ", "))
+	}
+}
+
+// rowExists reports whether the row pk is visible to a single read of cols
+// with the -verify timestamp bound for the write committed at writeTs,
+// through the -verify-via read path, and the timestamp the read ran at.
+func rowExists(ctx context.Context, client *spanner.Client, pk int64, cols []string, writeTs time.Time) (bool, time.Time, error) {
+	bound := verifyBound(writeTs)
+	if *verifyVia != "readrow" {
+		return rowExistsVia(ctx, client, pk, cols, bound)
+	}
+	ro := client.Single().WithTimestampBound(bound)
+	_, err := ro.ReadRowWithOptions(ctx, *table, spanner.Key{pk}, cols, &spanner.ReadOptions{RequestTag: runRequestTag()})
+	readTs, _ := ro.Timestamp()
+	if err == nil {
+		return true, readTs, nil
+	}
+	if spanner.ErrCode(err) == codes.NotFound {
+		return false, readTs, nil
+	}
+	return false, readTs, fmt.Errorf("read: %w", err)
+}
+
+// verifyBound returns the timestamp bound selected by -verify for the write
+// committed at writeTs. -verify=read-timestamp reads at the commit timestamp
+// of the write, so a row that survives there was never deleted by that
+// commit, while one that survives only a strong read points at visibility
+// rather than a dropped commit. Writes without a commit timestamp, such as
+// -delete=pdml, fall back to a strong read.
+func verifyBound(writeTs time.Time) spanner.TimestampBound {
+	switch *verifyMode {
+	case "exact-staleness":
+		return spanner.ExactStaleness(*verifyStaleness)
+	case "max-staleness":
+		return spanner.MaxStaleness(*verifyStaleness)
+	case "read-timestamp":
+		if !writeTs.IsZero() {
+			return spanner.ReadTimestamp(writeTs)
+		}
+		log.Printf("verify: no commit timestamp to read at, reading strong")
+		return spanner.StrongRead()
+	default:
+		return spanner.StrongRead()
+	}
+}
+
+// checkReadAfterWrite returns an errInconclusive error if the verifying read
+// at readTs, under a stale -verify bound, ran before the write committed at
+// writeTs and so could not have seen it. A write without a commit timestamp,
+// such as -delete=pdml, cannot be placed against a stale read at all.
+func checkReadAfterWrite(readTs, writeTs time.Time) error {
+	if *verifyMode != "exact-staleness" && *verifyMode != "max-staleness" {
+		return nil
+	}
+	if writeTs.IsZero() {
+		return fmt.Errorf("%w: -verify=%s read at %s, but the write reported no commit timestamp to place it after; use -verify=strong",
+			errInconclusive, *verifyMode, readTs.Format(time.RFC3339Nano))
+	}
+	if readTs.Before(writeTs) {
+		return fmt.Errorf("%w: -verify=%s read at %s, before the write committed at %s; lower -verify-staleness",
+			errInconclusive, *verifyMode, readTs.Format(time.RFC3339Nano), writeTs.Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// returningClause returns the clause -delete=stmt-dml-return appends to the
+// statement, in the dialect selected by -dialect.
+func returningClause() string {
+	if isPostgreSQL() {
+		return sqlFor("RETURNING PK")
+	}
+	return sqlFor("THEN RETURN PK")
+}
+
+// execStmtDMLReturn runs stmt with returningClause in a statement-based
+// transaction and commits it, returning the commit timestamp and the number
+// of rows the statement returned. The row count in the result stats must
+// agree with it; if it does not, the server disagrees with itself about what
+// the statement wrote.
+func execStmtDMLReturn(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, hooks txnHooks, stmt spanner.Statement) (time.Time, int64, error) {
+	if *deleteSQL == "" {
+		stmt.SQL += " " + returningClause()
+	}
+	rowCount := int64(noRowCount)
+	resp, err := runStmtTxn(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		rowCount = noRowCount
+		if err := hooks.runBeforeWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		var returned []int64
+		iter := txn.Query(ctx, stmt)
+		if err := iter.Do(func(row *spanner.Row) error {
+			var pk int64
+			if err := row.Column(0, &pk); err != nil {
+				return err
+			}
+			returned = append(returned, pk)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("query: %w", err)
+		}
+		log.Printf("THEN RETURN: %d row(s) returned, PK=%v; stats row count %d", len(returned), returned, iter.RowCount)
+		if iter.RowCount != int64(len(returned)) {
+			return fmt.Errorf("statement returned %d row(s) but its stats report %d", len(returned), iter.RowCount)
+		}
+		if err := hooks.runAfterWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		rowCount = int64(len(returned))
+		return nil
+	})
+	return resp.CommitTs, rowCount, err
+}
+
+// execStmtDML runs stmt in a statement-based transaction and commits it,
+// returning the commit timestamp and the row count of stmt.
+func execStmtDML(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, hooks txnHooks, stmt spanner.Statement) (time.Time, int64, error) {
+	rowCount := int64(noRowCount)
+	resp, err := runStmtTxn(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		rowCount = noRowCount
+		if err := hooks.runBeforeWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		iter := txn.Query(ctx, stmt)
+		if err := iter.Do(func(_ *spanner.Row) error { return nil }); err != nil {
+			return fmt.Errorf("query: %w", err)
+		}
+		if err := hooks.runAfterWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		rowCount = iter.RowCount
+		return nil
+	})
+	return resp.CommitTs, rowCount, err
+}
+
+// execStmtBatchDML is execStmtDML with sql sent through BatchUpdate, which
+// uses ExecuteBatchDml instead of ExecuteSql.
+func execStmtBatchDML(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, hooks txnHooks, stmt spanner.Statement) (time.Time, int64, error) {
+	rowCount := int64(noRowCount)
+	resp, err := runStmtTxn(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		rowCount = noRowCount
+		if err := hooks.runBeforeWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		counts, err := txn.BatchUpdate(ctx, []spanner.Statement{stmt})
+		if err != nil {
+			return fmt.Errorf("batch update: %w", err)
+		}
+		log.Printf("BatchUpdate row counts: %v", counts)
+		if err := hooks.runAfterWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		rowCount = 0
+		for _, c := range counts {
+			rowCount += c
+		}
+		return nil
+	})
+	return resp.CommitTs, rowCount, err
+}
+
+func execStmtMutation(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, hooks txnHooks, m *spanner.Mutation) (time.Time, error) {
+	resp, err := runStmtTxn(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		if err := hooks.runBeforeWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		if err := txn.BufferWrite([]*spanner.Mutation{m}); err != nil {
+			return fmt.Errorf("buffer write: %w", err)
+		}
+		return hooks.runAfterWrite(ctx, &txn.ReadWriteTransaction)
+	})
+	return resp.CommitTs, err
+}
+
+// execStmtMixed is execStmtMutation with an UPDATE of pk run as DML before m
+// is buffered, so that one commit carries both. With an inlined begin the
+// DML starts the transaction. m is applied last, so it must win.
+func execStmtMixed(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, hooks txnHooks, pk int64, m *spanner.Mutation) (time.Time, error) {
+	resp, err := runStmtTxn(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+		if err := hooks.runBeforeWrite(ctx, &txn.ReadWriteTransaction); err != nil {
+			return err
+		}
+		rowCount, err := txn.Update(ctx, spanner.Statement{
+			SQL:    sqlFor("UPDATE T SET Val = Val + 1 WHERE PK = @p1"),
+			Params: map[string]any{"p1": pk},
+		})
+		if err != nil {
+			return fmt.Errorf("update: %w", err)
+		}
+		log.Printf("mixed: DML UPDATE affected %d row(s)", rowCount)
+		if err := txn.BufferWrite([]*spanner.Mutation{m}); err != nil {
+			return fmt.Errorf("buffer write: %w", err)
+		}
+		return hooks.runAfterWrite(ctx, &txn.ReadWriteTransaction)
+	})
+	return resp.CommitTs, err
+}
+
+// execBatchWrite applies groups with client.BatchWrite and checks the
+// response for every group: each must be reported exactly once, with an OK
+// status. It returns the latest commit timestamp among the groups.
+func execBatchWrite(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, groups []*spanner.MutationGroup) (time.Time, error) {
+	var commitTs time.Time
+	applied := make([]bool, len(groups))
+	err := client.BatchWriteWithOptions(ctx, groups, spanner.BatchWriteOptions{TransactionTag: opts.TransactionTag}).
+		Do(func(r *spannerpb.BatchWriteResponse) error {
+			code := codes.Code(r.GetStatus().GetCode())
+			log.Printf("BatchWrite: groups %v: %s %s", r.GetIndexes(), code, r.GetStatus().GetMessage())
+			if code != codes.OK {
+				return fmt.Errorf("groups %v: %s: %s", r.GetIndexes(), code, r.GetStatus().GetMessage())
+			}
+			for _, i := range r.GetIndexes() {
+				if int(i) >= len(groups) || applied[i] {
+					return fmt.Errorf("unexpected response for group %d", i)
+				}
+				applied[i] = true
+			}
+			if ts := r.GetCommitTimestamp().AsTime(); ts.After(commitTs) {
+				commitTs = ts
+			}
+			return nil
+		})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if i := slices.Index(applied, false); i >= 0 {
+		return time.Time{}, fmt.Errorf("no response for group %d", i)
+	}
+	return commitTs, nil
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+
+	"spanner-mux-session-repro/repro"
+)
+
+// startEmulator starts the -emulator=auto image in a Docker container on a
+// free port and points SPANNER_EMULATOR_HOST at it for the rest of the test.
+// It skips the test if Docker is unavailable.
+func startEmulator(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not found")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skipf("docker unavailable: %v", err)
+	}
+	e, err := startDockerEmulator(context.Background(), emulatorImageName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.stop)
+	t.Setenv("SPANNER_EMULATOR_HOST", e.grpcHost)
+}
+
+// setupEmulator starts an emulator for the test and sets up the instance and
+// database in it, returning a context bounding the test.
+func setupEmulator(t *testing.T) context.Context {
+	t.Helper()
+	startEmulator(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	t.Cleanup(cancel)
+	// setup retries while the emulator in the new container starts up.
+	if err := setup(ctx); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	return ctx
+}
+
+// TestWriteLoss runs the scenario for every -delete/-begin combination, as
+// -matrix does, against a fresh emulator with the client library's default
+// session settings. For the combinations in emulatorOutcomes it checks which
+// lose the write; a combination that stops losing the write fails the test as
+// well, so that a fixed emulator shows up. The outcomes of the others are
+// logged.
+func TestWriteLoss(t *testing.T) {
+	ctx := setupEmulator(t)
+
+	origDelete, origBegin := *deleteMode, *beginMode
+	t.Cleanup(func() { *deleteMode, *beginMode = origDelete, origBegin })
+
+	for _, d := range deleteModes {
+		for _, b := range beginModes {
+			if beginIgnored(d) && b != "default" {
+				continue
+			}
+			t.Run(d+"/"+b, func(t *testing.T) {
+				*deleteMode, *beginMode = d, b
+				if err := resetTable(ctx); err != nil {
+					t.Fatalf("reset: %v", err)
+				}
+				err := reproduce(ctx)
+				got := outcome(err)
+				if got == "ERROR" {
+					t.Fatalf("reproduce: %v", err)
+				}
+				want, ok := emulatorOutcomes[[2]string{d, b}]
+				if !ok {
+					t.Logf("%s (no recorded outcome)", got)
+					return
+				}
+				if got != want {
+					t.Errorf("outcome = %s, want %s (err: %v)", got, want, err)
+				}
+			})
+		}
+	}
+}
+
+// TestLibraryMatrix runs repro.Matrix, the check of the importable package,
+// against a fresh emulator and holds it to emulatorOutcomes as TestWriteLoss
+// holds the command, so that the two cannot drift apart.
+func TestLibraryMatrix(t *testing.T) {
+	ctx := setupEmulator(t)
+	client, err := spanner.NewClient(ctx, databaseName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for c, got := range repro.Matrix(ctx, client) {
+		want, ok := emulatorOutcomes[[2]string{c.Delete, c.Begin}]
+		switch {
+		case got == "ERROR":
+			t.Errorf("%s/%s: ERROR", c.Delete, c.Begin)
+		case ok && got != want:
+			t.Errorf("%s/%s: outcome = %s, want %s", c.Delete, c.Begin, got, want)
+		}
+	}
+}
+
+// longScenarios are the scenarios TestScenarios skips with -short.
+var longScenarios = []string{"soak", "multi-database", "large-batch"}
+
+// TestScenarios runs every scenario of the registry other than the default,
+// which TestWriteLoss covers, selected as -scenario does. No outcomes are
+// recorded for them, so a scenario fails only if it cannot reach a verdict;
+// whether it lost the write is logged. The scenarios whose transactions
+// conflict retry their aborts with their own budget, which -max-retries
+// would override.
+func TestScenarios(t *testing.T) {
+	ctx := setupEmulator(t)
+
+	for _, s := range scenarios[1:] {
+		t.Run(s.name, func(t *testing.T) {
+			if testing.Short() && slices.Contains(longScenarios, s.name) {
+				t.Skip("long scenario; skipped with -short")
+			}
+			f := flag.Lookup(s.flag)
+			enable := s.enable
+			switch s.name {
+			case "script":
+				enable = "scripts/stmt-mutation-explicit.json"
+			case "soak":
+				// One cycle: the next would start after -soak-interval.
+				enable = "1s"
+			}
+			if err := flag.Set(s.flag, enable); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { flag.Set(s.flag, f.DefValue) })
+			if err := resetTable(ctx); err != nil {
+				t.Fatalf("reset: %v", err)
+			}
+			err := s.run(ctx)
+			switch outcome(err) {
+			case "ERROR":
+				t.Fatalf("%s: %v", s.name, err)
+			case "BUG":
+				t.Logf("BUG: %v", err)
+			default:
+				t.Logf("PASS")
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"text/tabwriter"
+
+	"spanner-mux-session-repro/repro"
+)
+
+// deleteModes and beginModes are the values accepted by -delete and -begin, in
+// the order -matrix runs them.
+var (
+	deleteModes = repro.DeleteModes
+	beginModes  = repro.BeginModes
+)
+
+// emulatorOutcomes are the outcomes run_all_output.txt records for emulator
+// 1.5.50 with the client library's default session settings, which use
+// multiplexed sessions for read/write transactions, by -delete and -begin.
+// The later -delete modes were added after it was recorded.
+var emulatorOutcomes = map[[2]string]string{
+	{"stmt-mutation", "default"}:  "BUG",
+	{"stmt-mutation", "inlined"}:  "PASS",
+	{"stmt-mutation", "explicit"}: "BUG",
+	{"rw-mutation", "default"}:    "PASS",
+	{"rw-mutation", "inlined"}:    "PASS",
+	{"rw-mutation", "explicit"}:   "BUG",
+	{"apply", "default"}:          "PASS",
+	{"stmt-dml", "default"}:       "PASS",
+	{"stmt-dml", "inlined"}:       "PASS",
+	{"stmt-dml", "explicit"}:      "PASS",
+}
+
+// compareWithEmulator wraps run, for -real, so that its outcome on Cloud
+// Spanner is reported next to the one emulatorOutcomes records for the same
+// -delete/-begin combination, stating whether the two diverge.
+func compareWithEmulator(run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		err := run(ctx)
+		got := outcome(err)
+		want, ok := emulatorOutcomes[[2]string{*deleteMode, *beginMode}]
+		switch {
+		case !multiplexedForRW():
+			log.Printf("parity: Cloud Spanner %s; no emulator outcome recorded without multiplexed sessions", got)
+		case !ok:
+			log.Printf("parity: Cloud Spanner %s; no emulator outcome recorded for -delete=%s -begin=%s", got, *deleteMode, *beginMode)
+		case got == want:
+			log.Printf("parity: Cloud Spanner %s, emulator 1.5.50 %s: same behavior", got, want)
+		default:
+			log.Printf("parity: Cloud Spanner %s, emulator 1.5.50 %s: DIVERGES", got, want)
+		}
+		return err
+	}
+}
+
+// beginIgnored reports whether -begin has no effect on mode, because the
+// client library begins the transaction itself.
+func beginIgnored(mode string) bool { return repro.BeginIgnored(mode) }
+
+// matrixCells holds the outcomes of the last -matrix run, by -delete and
+// -begin, for the report subcommand.
+var matrixCells map[[2]string]string
+
+// formatMatrix renders the outcomes of -matrix as a grid with a row per
+// -delete mode and a column per -begin mode.
+func formatMatrix(cells map[[2]string]string) string {
+	var buf strings.Builder
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "delete\t%s\n", strings.Join(beginModes, "\t"))
+	for _, d := range deleteModes {
+		row := []string{d}
+		for _, b := range beginModes {
+			o, ok := cells[[2]string{d, b}]
+			if !ok {
+				o = "-"
+			}
+			row = append(row, o)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+// matrix wraps run so that it is executed once for every -delete/-begin
+// combination on an empty table, then prints a grid of outcomes. Modes that
+// ignore -begin only run with the default. The returned error wraps
+// errWriteLost if any cell lost the write or, with -expectations, if any cell
+// not known to be broken did.
+func matrix(run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		origDelete, origBegin := *deleteMode, *beginMode
+		defer func() { *deleteMode, *beginMode = origDelete, origBegin }()
+
+		cells := make(map[[2]string]string)
+		var bugs, errs, n int
+		for _, d := range deleteModes {
+			for _, b := range beginModes {
+				if beginIgnored(d) && b != "default" {
+					continue
+				}
+				*deleteMode, *beginMode = d, b
+				if err := resetTable(ctx); err != nil {
+					return fmt.Errorf("reset before -delete=%s -begin=%s: %w", d, b, err)
+				}
+				err := run(ctx)
+				o := outcome(err)
+				if err != nil {
+					log.Printf("-delete=%s -begin=%s: %s: %v", d, b, o, err)
+				} else {
+					log.Printf("-delete=%s -begin=%s: %s", d, b, o)
+				}
+				cells[[2]string{d, b}] = o
+				if *metricsMode {
+					// Ends the cell's last phase, so that it is
+					// counted with the cell.
+					enterPhase("matrix")
+					logMetrics(fmt.Sprintf("-delete=%s -begin=%s: ", d, b), takeMetrics())
+				}
+				n++
+				switch o {
+				case "BUG":
+					bugs++
+				case "ERROR":
+					errs++
+				}
+			}
+		}
+
+		matrixCells = cells
+		for _, line := range strings.Split(strings.TrimRight(formatMatrix(cells), "\n"), "\n") {
+			log.Print(line)
+		}
+		if *confirmFails > 0 {
+			if err := confirmCells(ctx, run, cells); err != nil {
+				return err
+			}
+		}
+
+		if knownBroken != nil {
+			return gateMatrix(cells)
+		}
+		switch {
+		case bugs > 0:
+			return fmt.Errorf("%w: %d of %d cells lost the write", errWriteLost, bugs, n)
+		case errs > 0:
+			return fmt.Errorf("%d of %d cells failed", errs, n)
+		}
+		return nil
+	}
+}
+
+// confirmCells implements -confirm-failures for -matrix: it re-runs every
+// cell of cells that lost a write, as run_all.sh does, and logs whether each
+// failure was confirmed.
+func confirmCells(ctx context.Context, run func(context.Context) error, cells map[[2]string]string) error {
+	var confirmations []string
+	for _, d := range deleteModes {
+		for _, b := range beginModes {
+			if o, ok := cells[[2]string{d, b}]; !ok || o != "BUG" {
+				continue
+			}
+			*deleteMode, *beginMode = d, b
+			log.Printf("confirming -delete=%s -begin=%s (%d runs)", d, b, *confirmFails)
+			c, err := confirmFailure(ctx, run)
+			if err != nil {
+				return err
+			}
+			confirmations = append(confirmations, fmt.Sprintf("%s  -delete=%s -begin=%s", c, d, b))
+		}
+	}
+	log.Print("confirmations:")
+	if len(confirmations) == 0 {
+		log.Print("no failing cells")
+	}
+	for _, c := range confirmations {
+		log.Print(c)
+	}
+	return nil
+}
+
+// confirmDatabaseSuffix, followed by the confirmation number, names the
+// database each -confirm-failures re-run creates next to -database.
+const confirmDatabaseSuffix = "-confirm-"
+
+// confirmFailure runs run -confirm-failures more times after it lost a
+// write, each in a database of its own, and returns CONFIRMED if every
+// re-run lost a write too, or UNCONFIRMED, with the count of re-runs that
+// did. A re-run that passes or fails otherwise does not confirm the loss.
+func confirmFailure(ctx context.Context, run func(context.Context) error) (string, error) {
+	lost := 0
+	for i := 1; i <= *confirmFails; i++ {
+		runErr, err := inFreshDatabase(ctx, fmt.Sprintf("%s%s%d", *databaseID, confirmDatabaseSuffix, i), run)
+		if err != nil {
+			return "", fmt.Errorf("confirmation %d: %w", i, err)
+		}
+		if errors.Is(runErr, errWriteLost) {
+			lost++
+		}
+		if runErr != nil {
+			log.Printf("confirmation %d: %s: %v", i, outcome(runErr), runErr)
+		} else {
+			log.Printf("confirmation %d: PASS", i)
+		}
+	}
+	status := "UNCONFIRMED"
+	if lost == *confirmFails {
+		status = "CONFIRMED"
+	}
+	return fmt.Sprintf("%-11s %d/%d", status, lost, *confirmFails), nil
+}
+
+// inFreshDatabase creates the database id in -instance, runs run with
+// -database pointing at it, and drops it afterward. It returns the result
+// of run as runErr, and the error of creating the database, in which case
+// run did not run, as err.
+func inFreshDatabase(ctx context.Context, id string, run func(context.Context) error) (runErr, err error) {
+	db := instanceName() + "/databases/" + id
+	if err := setupDatabase(ctx, db); err != nil {
+		return nil, fmt.Errorf("setup %s: %w", id, err)
+	}
+	defer func() {
+		if err := dropDatabase(ctx, db); err != nil {
+			log.Printf("drop %s: %v", id, err)
+		}
+	}()
+	defer func(orig string) { *databaseID = orig }(*databaseID)
+	*databaseID = id
+	return run(ctx), nil
+}
+
+// confirmed implements -confirm-failures for a single run: when run loses a
+// write, it is confirmed with confirmFailure. The result is that of the
+// first run.
+func confirmed(run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		err := run(ctx)
+		if !errors.Is(err, errWriteLost) {
+			return err
+		}
+		c, cerr := confirmFailure(ctx, run)
+		if cerr != nil {
+			log.Printf("confirm: %v", cerr)
+			return err
+		}
+		log.Printf("confirm: %s", c)
+		return err
+	}
+}
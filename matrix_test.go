@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestFormatMatrix(t *testing.T) {
+	got := formatMatrix(map[[2]string]string{
+		{"stmt-mutation", "default"}:  "PASS",
+		{"stmt-mutation", "explicit"}: "BUG",
+		{"apply", "inlined"}:          "ERROR",
+	})
+	want := `delete           default  inlined  explicit
+stmt-mutation    PASS     -        BUG
+rw-mutation      -        -        -
+apply            -        ERROR    -
+stmt-dml         -        -        -
+stmt-dml-return  -        -        -
+stmt-batch-dml   -        -        -
+rw-batch-dml     -        -        -
+mixed            -        -        -
+autocommit       -        -        -
+pdml             -        -        -
+batchwrite       -        -        -
+`
+	if got != want {
+		t.Errorf("formatMatrix() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// phaseMetrics are the -metrics of one phase: how long it took, summed over
+// every time it was entered, and the Spanner RPCs started in it.
+type phaseMetrics struct {
+	Phase      string                 `json:"phase"`
+	Entered    int                    `json:"entered"`
+	DurationMS float64                `json:"duration_ms"`
+	RPCs       map[string]*rpcMetrics `json:"rpcs,omitempty"`
+}
+
+// rpcMetrics are the calls of one RPC method within a phase.
+type rpcMetrics struct {
+	Count      int     `json:"count"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// metrics collects -metrics by phase, in the order the phases were first
+// entered.
+var metrics struct {
+	sync.Mutex
+	phases []*phaseMetrics
+}
+
+// phaseMetricsLocked returns the metrics of phase name, adding them if
+// needed. The caller holds metrics.
+func phaseMetricsLocked(name string) *phaseMetrics {
+	for _, p := range metrics.phases {
+		if p.Phase == name {
+			return p
+		}
+	}
+	p := &phaseMetrics{Phase: name, RPCs: make(map[string]*rpcMetrics)}
+	metrics.phases = append(metrics.phases, p)
+	return p
+}
+
+// recordPhase records that phase name ran for d.
+func recordPhase(name string, d time.Duration) {
+	if !*metricsMode {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	p := phaseMetricsLocked(name)
+	p.Entered++
+	p.DurationMS += float64(d.Microseconds()) / 1000
+}
+
+// recordRPC records a call of method, started in phase, that took d.
+func recordRPC(phase, method string, d time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	p := phaseMetricsLocked(phase)
+	method = method[strings.LastIndex(method, "/")+1:]
+	r, ok := p.RPCs[method]
+	if !ok {
+		r = &rpcMetrics{}
+		p.RPCs[method] = r
+	}
+	r.Count++
+	r.DurationMS += float64(d.Microseconds()) / 1000
+}
+
+// collectedMetrics returns the metrics collected so far.
+func collectedMetrics() []*phaseMetrics {
+	metrics.Lock()
+	defer metrics.Unlock()
+	return slices.Clone(metrics.phases)
+}
+
+// takeMetrics returns the metrics collected so far and starts over.
+func takeMetrics() []*phaseMetrics {
+	metrics.Lock()
+	defer metrics.Unlock()
+	phases := metrics.phases
+	metrics.phases = nil
+	return phases
+}
+
+// logMetrics logs phases, one line per phase with its RPC counts, under
+// label. With -begin=inlined it also checks what the option is for: that the
+// delete phase made no BeginTransaction call.
+func logMetrics(label string, phases []*phaseMetrics) {
+	for _, p := range phases {
+		var rpcs []string
+		for _, m := range slices.Sorted(maps.Keys(p.RPCs)) {
+			r := p.RPCs[m]
+			rpcs = append(rpcs, fmt.Sprintf("%s=%d (%.3fms)", m, r.Count, r.DurationMS))
+		}
+		if len(rpcs) == 0 {
+			rpcs = []string{"no RPCs"}
+		}
+		log.Printf("metrics: %s%s took %.3fms: %s", label, p.Phase, p.DurationMS, strings.Join(rpcs, ", "))
+		if p.Phase == "delete" && *beginMode == "inlined" && !beginIgnored(*deleteMode) {
+			if r := p.RPCs["BeginTransaction"]; r != nil {
+				log.Printf("metrics: %s-begin=inlined still made %d BeginTransaction call(s) in the delete phase", label, r.Count)
+			}
+		}
+	}
+}
+
+// metricsUnaryInterceptor and metricsStreamInterceptor time every Spanner
+// RPC for -metrics, attributing it to the phase it was started in. A stream
+// lasts until its last message is received.
+func metricsUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	phase, start := currentPhase(), time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	recordRPC(phase, method, time.Since(start))
+	return err
+}
+
+func metricsStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	phase, start := currentPhase(), time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		recordRPC(phase, method, time.Since(start))
+		return nil, err
+	}
+	return &metricsStream{ClientStream: cs, phase: phase, method: method, start: start}, nil
+}
+
+// metricsStream records a streaming RPC once it ends.
+type metricsStream struct {
+	grpc.ClientStream
+	phase, method string
+	start         time.Time
+	once          sync.Once
+}
+
+func (s *metricsStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() { recordRPC(s.phase, s.method, time.Since(s.start)) })
+	}
+	return err
+}
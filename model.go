@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+)
+
+// errModelDiverged marks a mismatch between the harness's expected state and
+// the server in a mode that is known to work, which means the harness itself
+// is wrong and no verification built on the model can be trusted.
+var errModelDiverged = errors.New("MODEL DIVERGED")
+
+// controlDeleteModes are the -delete modes that do not lose writes on any
+// emulator version tested (see run_all_output.txt).
+var controlDeleteModes = map[string]bool{
+	"apply":    true,
+	"stmt-dml": true,
+}
+
+// tableModel is the harness's expectation of the contents of T, keyed by PK.
+type tableModel struct {
+	rows map[int64]int64
+}
+
+func newTableModel() *tableModel {
+	return &tableModel{rows: make(map[int64]int64)}
+}
+
+func (m *tableModel) put(pk, val int64) {
+	m.rows[pk] = val
+}
+
+func (m *tableModel) delete(pk int64) {
+	delete(m.rows, pk)
+}
+
+// diff returns one description per key where the server disagrees with the
+// model, in key order.
+func (m *tableModel) diff(ctx context.Context, client *spanner.Client) ([]string, error) {
+	actual, err := readRows(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]int64, 0, len(m.rows)+len(actual))
+	for pk := range m.rows {
+		keys = append(keys, pk)
+	}
+	for pk := range actual {
+		if _, ok := m.rows[pk]; !ok {
+			keys = append(keys, pk)
+		}
+	}
+	slices.Sort(keys)
+
+	var diffs []string
+	for _, pk := range keys {
+		want, expected := m.rows[pk]
+		got, present := actual[pk]
+		switch {
+		case expected && !present:
+			diffs = append(diffs, fmt.Sprintf("PK=%d: expected Val=%d, server has no row", pk, want))
+		case !expected && present:
+			diffs = append(diffs, fmt.Sprintf("PK=%d: expected no row, server has Val=%v", pk, got))
+		case !got.Valid || got.Int64 != want:
+			diffs = append(diffs, fmt.Sprintf("PK=%d: expected Val=%d, server has Val=%v", pk, want, got))
+		}
+	}
+	return diffs, nil
+}
+
+// guard checks the model against the server and fails loudly, naming every
+// diverging key, if they disagree.
+func (m *tableModel) guard(ctx context.Context, client *spanner.Client, after string) error {
+	diffs, err := m.diff(ctx, client)
+	if err != nil {
+		return fmt.Errorf("model check after %s: %w", after, err)
+	}
+	if len(diffs) == 0 {
+		log.Printf("model: consistent with server after %s", after)
+		return nil
+	}
+	for _, d := range diffs {
+		log.Printf("MODEL DIVERGENCE after %s: %s", after, d)
+	}
+	return fmt.Errorf("%w after %s: %s", errModelDiverged, after, strings.Join(diffs, "; "))
+}
+
+// readRows returns every row of T as a map from PK to Val.
+func readRows(ctx context.Context, client *spanner.Client) (map[int64]spanner.NullInt64, error) {
+	rows := make(map[int64]spanner.NullInt64)
+	iter := client.Single().Query(ctx, spanner.Statement{SQL: sqlFor("SELECT PK, Val FROM T ORDER BY PK")})
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query: %w", err)
+		}
+		var (
+			pk  int64
+			val spanner.NullInt64
+		)
+		if err := row.Columns(&pk, &val); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		rows[pk] = val
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+)
+
+// secondDatabaseSuffix names the other database of -multi-database, created
+// next to -database.
+const secondDatabaseSuffix = "-b"
+
+// reproduceMultiDatabase runs transactions on two databases of the same
+// emulator, each through its own client and multiplexed session, and
+// interleaves them: each round begins a transaction on both, buffers a
+// write in each, and commits the second database's before the first's.
+// Both databases get PK=1..-multi-database rows, with Val=PK in the first
+// and Val=-PK in the second; then the first deletes the odd keys and the
+// second the even ones. Every write must land in its own database and
+// nowhere else. -begin is honored; -delete is ignored.
+func reproduceMultiDatabase(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	other := *databaseID + secondDatabaseSuffix
+	if err := setupDatabase(ctx, instanceName()+"/databases/"+other); err != nil {
+		return stepError(stepSetup, fmt.Errorf("setup %s: %w", other, err))
+	}
+
+	a, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := newClientFor(ctx, instanceName()+"/databases/"+other)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	dbs := []struct {
+		name   string
+		client *spanner.Client
+		model  *tableModel
+		sign   int64
+	}{
+		{*databaseID, a, newTableModel(), 1},
+		{other, b, newTableModel(), -1},
+	}
+	for _, db := range dbs {
+		if err := clearTable(ctx, db.client); err != nil {
+			return fmt.Errorf("clear %s: %w", db.name, err)
+		}
+	}
+
+	n := int64(*multiDatabase)
+	for pk := int64(1); pk <= n; pk++ {
+		enterPhase("insert")
+		var ms [2]*spanner.Mutation
+		for i, db := range dbs {
+			ms[i] = spanner.Insert(*table, []string{*pkColumn, "Val"}, []any{pk, db.sign * pk})
+			db.model.put(pk, db.sign*pk)
+		}
+		if err := commitInterleaved(ctx, a, b, txnOpts, ms); err != nil {
+			return stepError(stepInsert, fmt.Errorf("insert PK=%d: %w", pk, err))
+		}
+	}
+	for pk := int64(1); pk+1 <= n; pk += 2 {
+		enterPhase("delete")
+		ms := [2]*spanner.Mutation{spanner.Delete(*table, spanner.Key{pk}), spanner.Delete(*table, spanner.Key{pk + 1})}
+		dbs[0].model.delete(pk)
+		dbs[1].model.delete(pk + 1)
+		if err := commitInterleaved(ctx, a, b, txnOpts, ms); err != nil {
+			return stepError(stepDelete, fmt.Errorf("delete PK=%d and PK=%d: %w", pk, pk+1, err))
+		}
+	}
+
+	enterPhase("verify")
+	var diffs []string
+	for _, db := range dbs {
+		d, err := db.model.diff(ctx, db.client)
+		if err != nil {
+			return stepError(stepVerify, fmt.Errorf("%s: %w", db.name, err))
+		}
+		log.Printf("multi-database: %s: %d row(s) expected, %d difference(s)", db.name, len(db.model.rows), len(d))
+		for _, s := range d {
+			diffs = append(diffs, db.name+": "+s)
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%w: interleaved transactions on two databases committed, but %s", errWriteLost, strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// commitInterleaved begins a statement-based transaction on a and on b,
+// buffers ms[0] in the first and ms[1] in the second, and commits them in
+// reverse order, so that both are open on their sessions at once.
+func commitInterleaved(ctx context.Context, a, b *spanner.Client, txnOpts spanner.TransactionOptions, ms [2]*spanner.Mutation) error {
+	var txns [2]*spanner.ReadWriteStmtBasedTransaction
+	for i, c := range []*spanner.Client{a, b} {
+		txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, c, txnOpts)
+		if err != nil {
+			for _, t := range txns[:i] {
+				t.Rollback(ctx)
+			}
+			return fmt.Errorf("begin: %w", err)
+		}
+		txns[i] = txn
+	}
+	for i, txn := range txns {
+		if err := txn.BufferWrite([]*spanner.Mutation{ms[i]}); err != nil {
+			for _, t := range txns {
+				t.Rollback(ctx)
+			}
+			return fmt.Errorf("buffer write: %w", err)
+		}
+	}
+	if _, err := txns[1].Commit(ctx); err != nil {
+		txns[0].Rollback(ctx)
+		return fmt.Errorf("commit on the second database: %w", err)
+	}
+	if _, err := txns[0].Commit(ctx); err != nil {
+		return fmt.Errorf("commit on the first database: %w", err)
+	}
+	return nil
+}
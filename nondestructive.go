@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+
+	"cloud.google.com/go/spanner"
+)
+
+// runKeyPrefix and runKeySpan place the keys of a -nondestructive run: each
+// run writes only keys in [pkBase, pkBase+runKeySpan), where pkBase is
+// runKeyPrefix plus a multiple of runKeySpan picked from the run ID. In
+// decimal the keys are 19 digits starting with 7, far above the keys a
+// shared table is likely to hold, and their middle digits identify the run.
+const (
+	runKeyPrefix = 7_000_000_000_000_000_000
+	runKeySpan   = 1_000_000
+)
+
+// pkBase is added to every key the default scenario writes: 0, or the base
+// of this run's keys with -nondestructive.
+var pkBase int64
+
+// rowPK returns the key of row n of the scenario, numbered from 1.
+func rowPK(n int64) int64 { return pkBase + n }
+
+// withRunKeys implements -nondestructive: it runs run on keys under a base
+// unique to this run, and deletes every key under that base afterward, even
+// if the run failed, leaving the rest of -table as it was.
+func withRunKeys(run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		h := fnv.New64a()
+		h.Write([]byte(runID))
+		pkBase = runKeyPrefix + int64(h.Sum64()%1_000_000_000_000)*runKeySpan
+		log.Printf("nondestructive: writing %s keys %d to %d only", *table, pkBase, pkBase+runKeySpan-1)
+
+		err := run(ctx)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if cerr := deleteRunKeys(ctx); cerr != nil {
+			log.Printf("nondestructive: cleanup: %v", cerr)
+			if err == nil {
+				err = fmt.Errorf("cleanup: %w", cerr)
+			}
+		}
+		return err
+	}
+}
+
+// deleteRunKeys deletes the keys of this run from -table.
+func deleteRunKeys(ctx context.Context) error {
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	keys := spanner.KeyRange{Start: spanner.Key{pkBase}, End: spanner.Key{pkBase + runKeySpan}, Kind: spanner.ClosedOpen}
+	if _, err := client.Apply(ctx, []*spanner.Mutation{spanner.Delete(*table, keys)}, spanner.TransactionTag(runTag())); err != nil {
+		return err
+	}
+	log.Printf("nondestructive: deleted keys %d to %d", pkBase, pkBase+runKeySpan-1)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracerProvider exports the client library's spans for -otel-endpoint, or is
+// nil without it.
+var tracerProvider *sdktrace.TracerProvider
+
+// startOTel implements -otel-endpoint: it installs a global tracer provider,
+// which the client library picks up for its spans, exporting every span over
+// OTLP/gRPC. Spans carry the run ID, so that the timeline of one run can be
+// found among others in the trace backend.
+func startOTel(ctx context.Context) error {
+	exp, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(*otelEndpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return fmt.Errorf("OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "spanner-mux-session-repro"),
+		attribute.String("repro.run_id", runID),
+		attribute.String("repro.delete", *deleteMode),
+		attribute.String("repro.begin", *beginMode),
+	))
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	log.Printf("OpenTelemetry: exporting spans to %s", *otelEndpoint)
+	return nil
+}
+
+// stopOTel flushes the spans not yet exported.
+func stopOTel(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("OpenTelemetry: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonResult is the object written by -output=json.
+type jsonResult struct {
+	RunID            string            `json:"run_id"`
+	Op               string            `json:"op"`
+	Insert           string            `json:"insert"`
+	Delete           string            `json:"delete"`
+	Begin            string            `json:"begin"`
+	Multiplexed      bool              `json:"multiplexed"`
+	EmulatorHost     string            `json:"emulator_host,omitempty"`
+	LibraryVersion   string            `json:"library_version"`
+	Outcome          string            `json:"outcome"`
+	ExitCode         int               `json:"exit_code"`
+	Step             string            `json:"step,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	SurvivingPK      *int64            `json:"surviving_pk,omitempty"`
+	CommitTimestamps map[string]string `json:"commit_timestamps,omitempty"`
+	TransactionTag   string            `json:"transaction_tag"`
+	RequestTag       string            `json:"request_tag,omitempty"`
+	Metrics          []*phaseMetrics   `json:"metrics,omitempty"`
+	StmtAttempts     []stmtAttempt     `json:"stmt_attempts,omitempty"`
+	Environment      *environment      `json:"environment"`
+}
+
+// commitTimes holds the commit timestamp of the most recent write of each
+// kind, keyed by its lower-case log label ("insert", "delete", ...), for
+// -output=json.
+var commitTimes = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// recordCommit records that the write label committed at ts.
+func recordCommit(label string, ts time.Time) {
+	commitTimes.Lock()
+	defer commitTimes.Unlock()
+	commitTimes.m[strings.ToLower(label)] = ts
+}
+
+// commitTime returns the commit timestamp recorded for the write label, or
+// zero if none was.
+func commitTime(label string) time.Time {
+	commitTimes.Lock()
+	defer commitTimes.Unlock()
+	return commitTimes.m[strings.ToLower(label)]
+}
+
+func writeJSONResult(w io.Writer, err error) error {
+	r := jsonResult{
+		RunID:          runID,
+		Op:             *op,
+		Insert:         *insertMode,
+		Delete:         *deleteMode,
+		Begin:          *beginMode,
+		Multiplexed:    multiplexedForRW(),
+		EmulatorHost:   os.Getenv("SPANNER_EMULATOR_HOST"),
+		LibraryVersion: moduleVersion("cloud.google.com/go/spanner"),
+		TransactionTag: runTag(),
+		RequestTag:     *requestTag,
+		Outcome:        strings.ToLower(outcome(err)),
+		ExitCode:       exitCode(err),
+		Metrics:        collectedMetrics(),
+		StmtAttempts:   recordedStmtAttempts(),
+		Environment:    reportedEnvironment(),
+	}
+	if err != nil {
+		r.Step = string(errorStep(err))
+		r.Error = err.Error()
+	}
+	var survived *survivedError
+	if errors.As(err, &survived) {
+		r.SurvivingPK = &survived.pk
+	}
+	commitTimes.Lock()
+	for label, ts := range commitTimes.m {
+		if r.CommitTimestamps == nil {
+			r.CommitTimestamps = make(map[string]string)
+		}
+		r.CommitTimestamps[label] = ts.Format(time.RFC3339Nano)
+	}
+	commitTimes.Unlock()
+	return json.NewEncoder(w).Encode(r)
+}
+
+// writeJSONFile writes the -output=json result to -output-file.
+func writeJSONFile(path string, err error) error {
+	f, ferr := os.Create(path)
+	if ferr != nil {
+		return ferr
+	}
+	if werr := writeJSONResult(f, err); werr != nil {
+		f.Close()
+		return werr
+	}
+	return f.Close()
+}
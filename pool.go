@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// poolWarmTimeout bounds how long -pool=warmed waits for the pool to fill.
+const poolWarmTimeout = 30 * time.Second
+
+// poolWatcher counts the sessions the server creates for a client and the
+// requests sent on each, so that -pool=warmed can wait until the pool has
+// reached its target size, -pool-stats can summarize session use, and
+// -list-sessions can tell which sessions the run used. The client library
+// exposes none of these.
+type poolWatcher struct {
+	mu          sync.Mutex
+	regular     int
+	multiplexed int
+	muxNames    map[string]bool
+	requests    map[string]int
+	methods     map[string]map[string]bool
+	changed     chan struct{}
+}
+
+func newPoolWatcher() *poolWatcher {
+	return &poolWatcher{
+		muxNames: make(map[string]bool),
+		requests: make(map[string]int),
+		methods:  make(map[string]map[string]bool),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+func (w *poolWatcher) clientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(w.unaryInterceptor)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(w.streamInterceptor)),
+	}
+}
+
+func (w *poolWatcher) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	w.countRequest(method, req)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		return err
+	}
+	switch r := reply.(type) {
+	case *spannerpb.BatchCreateSessionsResponse:
+		w.add(len(r.GetSession()), 0)
+	case *spannerpb.Session:
+		if r.GetMultiplexed() {
+			w.mu.Lock()
+			w.muxNames[r.GetName()] = true
+			w.mu.Unlock()
+			w.add(0, 1)
+		} else {
+			w.add(1, 0)
+		}
+	}
+	return nil
+}
+
+func (w *poolWatcher) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStream{ClientStream: cs, w: w, method: method}, nil
+}
+
+// countRequest counts req, a request of method, against the session it is
+// sent on.
+func (w *poolWatcher) countRequest(method string, req any) {
+	s, ok := req.(interface{ GetSession() string })
+	if !ok || s.GetSession() == "" {
+		return
+	}
+	w.mu.Lock()
+	w.requests[s.GetSession()]++
+	if w.methods[s.GetSession()] == nil {
+		w.methods[s.GetSession()] = make(map[string]bool)
+	}
+	w.methods[s.GetSession()][method[strings.LastIndex(method, "/")+1:]] = true
+	w.mu.Unlock()
+}
+
+// usedSessions returns the names of the sessions requests were sent on,
+// sorted.
+func (w *poolWatcher) usedSessions() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Sorted(maps.Keys(w.requests))
+}
+
+// sessionMethods returns the RPCs sent on the session name, sorted.
+func (w *poolWatcher) sessionMethods(name string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Sorted(maps.Keys(w.methods[name]))
+}
+
+// logSummary logs the sessions created against cfg and how requests were
+// spread over regular and multiplexed sessions.
+func (w *poolWatcher) logSummary(cfg spanner.SessionPoolConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var muxRequests, regularRequests, regularUsed int
+	for name, n := range w.requests {
+		if w.muxNames[name] {
+			muxRequests += n
+		} else {
+			regularRequests += n
+			regularUsed++
+		}
+	}
+	log.Printf("pool stats: created %d regular sessions (MinOpened=%d MaxOpened=%d) and %d multiplexed",
+		w.regular, cfg.MinOpened, cfg.MaxOpened, w.multiplexed)
+	log.Printf("pool stats: %d requests on multiplexed sessions, %d requests on %d distinct regular sessions",
+		muxRequests, regularRequests, regularUsed)
+}
+
+// countingStream counts the requests of a streaming RPC such as
+// ExecuteStreamingSql.
+type countingStream struct {
+	grpc.ClientStream
+	w      *poolWatcher
+	method string
+}
+
+func (s *countingStream) SendMsg(m any) error {
+	s.w.countRequest(s.method, m)
+	return s.ClientStream.SendMsg(m)
+}
+
+func (w *poolWatcher) add(regular, multiplexed int) {
+	w.mu.Lock()
+	w.regular += regular
+	w.multiplexed += multiplexed
+	w.mu.Unlock()
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (w *poolWatcher) counts() (regular, multiplexed int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.regular, w.multiplexed
+}
+
+// await blocks until the server has created MinOpened regular sessions and,
+// unless multiplexed sessions are disabled, the multiplexed session.
+func (w *poolWatcher) await(ctx context.Context, cfg spanner.SessionPoolConfig) error {
+	wantMux := 1
+	if os.Getenv("GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS") == "false" {
+		wantMux = 0
+	}
+	start := time.Now()
+	timeout := time.After(poolWarmTimeout)
+	for {
+		regular, multiplexed := w.counts()
+		if regular >= int(cfg.MinOpened) && multiplexed >= wantMux {
+			log.Printf("Session pool warmed in %s: %d regular sessions (MinOpened=%d MaxOpened=%d), %d multiplexed",
+				time.Since(start).Round(time.Millisecond), regular, cfg.MinOpened, cfg.MaxOpened, multiplexed)
+			return nil
+		}
+		select {
+		case <-w.changed:
+		case <-timeout:
+			return fmt.Errorf("session pool not warmed after %s: %d/%d regular sessions, %d/%d multiplexed",
+				poolWarmTimeout, regular, cfg.MinOpened, multiplexed, wantMux)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// multiplexedEnv are the client library's switches for multiplexed sessions,
+// for all transactions and for read/write transactions. Both default to true.
+var multiplexedEnv = []string{
+	"GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS",
+	"GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS_FOR_RW",
+}
+
+// multiplexedPartitionedEnv is the client library's switch for multiplexed
+// sessions in partitioned operations such as -delete=pdml. It defaults to
+// true and, like the read/write switch, only applies if
+// GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS does.
+const multiplexedPartitionedEnv = "GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS_PARTITIONED_OPS"
+
+// setMultiplexed implements -multiplexed. The client library reads the
+// environment when a client is created, so this must run before newClient.
+func setMultiplexed(v string) error {
+	if v != "true" && v != "false" {
+		return fmt.Errorf("-multiplexed must be true, false, or both, got %q", v)
+	}
+	for _, name := range slices.Concat(multiplexedEnv, []string{multiplexedPartitionedEnv}) {
+		if err := os.Setenv(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envEnabled reports whether none of the switches names is set to false,
+// parsed the way the client library does.
+func envEnabled(names ...string) bool {
+	for _, name := range names {
+		if v, ok := os.LookupEnv(name); ok {
+			if b, err := strconv.ParseBool(strings.ToLower(v)); err == nil && !b {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// multiplexedForRW reports whether read/write transactions will use
+// multiplexed sessions under the current environment.
+func multiplexedForRW() bool { return envEnabled(multiplexedEnv...) }
+
+// multiplexedForPartitioned reports whether partitioned DML will use
+// multiplexed sessions under the current environment.
+func multiplexedForPartitioned() bool {
+	return envEnabled(multiplexedEnv[0], multiplexedPartitionedEnv)
+}
+
+// sessionMode describes which sessions read/write transactions, and with
+// -delete=pdml partitioned DML, will use under the current environment.
+func sessionMode() string {
+	names := multiplexedEnv
+	if *deleteMode == "pdml" {
+		names = slices.Concat(names, []string{multiplexedPartitionedEnv})
+	}
+	var settings []string
+	for _, name := range names {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			v = "unset"
+		}
+		settings = append(settings, name+"="+v)
+	}
+	mode := sessionKind(multiplexedForRW()) + " sessions for read/write transactions"
+	if *deleteMode == "pdml" {
+		mode += ", " + sessionKind(multiplexedForPartitioned()) + " sessions for partitioned DML"
+	}
+	return mode + " (" + strings.Join(settings, " ") + ")"
+}
+
+func sessionKind(multiplexed bool) string {
+	if multiplexed {
+		return "multiplexed"
+	}
+	return "regular"
+}
+
+// bothSessionModes implements -multiplexed=both: it wraps run so that it is
+// executed on an empty table once with multiplexed sessions and once with
+// regular sessions, and reports whether the write loss is specific to
+// multiplexed sessions. The returned error wraps errWriteLost if either run
+// lost the write.
+func bothSessionModes(run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		errs := make(map[string]error)
+		for _, v := range []string{"true", "false"} {
+			if err := setMultiplexed(v); err != nil {
+				return err
+			}
+			log.Printf("-multiplexed=%s: %s", v, sessionMode())
+			if err := resetTable(ctx); err != nil {
+				return fmt.Errorf("reset before -multiplexed=%s: %w", v, err)
+			}
+			errs[v] = run(ctx)
+			if errs[v] != nil {
+				log.Printf("-multiplexed=%s: %s: %v", v, outcome(errs[v]), errs[v])
+			} else {
+				log.Printf("-multiplexed=%s: %s", v, outcome(errs[v]))
+			}
+		}
+
+		mux, regular := outcome(errs["true"]), outcome(errs["false"])
+		log.Printf("multiplexed sessions: %s, regular sessions: %s", mux, regular)
+		switch {
+		case mux == "BUG" && regular == "PASS":
+			log.Printf("the write loss is specific to multiplexed sessions")
+			return fmt.Errorf("%w: lost the write with multiplexed sessions only", errWriteLost)
+		case mux == "BUG" && regular == "BUG":
+			log.Printf("the write loss is not specific to multiplexed sessions")
+			return fmt.Errorf("%w: lost the write with both multiplexed and regular sessions", errWriteLost)
+		case regular == "BUG":
+			return fmt.Errorf("%w: lost the write with regular sessions only", errWriteLost)
+		case errs["true"] != nil:
+			return errs["true"]
+		}
+		return errs["false"]
+	}
+}
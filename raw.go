@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	gapic "cloud.google.com/go/spanner/apiv1"
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"spanner-mux-session-repro/repro"
+)
+
+// rawSession is a session created through the generated API client, with the
+// highest precommit token the server has returned for the transaction in
+// flight on it.
+type rawSession struct {
+	client *gapic.Client
+	name   string
+	token  *spannerpb.MultiplexedSessionPrecommitToken
+	// tag, commitOptions, and commitPriority are the transaction tag,
+	// commit options, and Commit priority of the transaction in flight.
+	tag            string
+	commitOptions  spanner.CommitOptions
+	commitPriority spannerpb.RequestOptions_Priority
+}
+
+// reproduceRaw implements -raw: the insert/delete/verify scenario driven
+// through the generated API client, without the client library's session
+// pool and transaction runner, on a session created with
+// multiplexed=-raw-multiplexed. -delete=stmt-mutation commits a buffered
+// DELETE in a transaction begun with BeginTransaction; -delete=stmt-dml
+// executes the DELETE in a transaction begun explicitly or, with
+// -begin=inlined, by the DML itself.
+func reproduceRaw(ctx context.Context) error {
+	if *deleteMode != "stmt-mutation" && *deleteMode != "stmt-dml" {
+		return fmt.Errorf("-raw supports -delete=stmt-mutation and stmt-dml, not %s", *deleteMode)
+	}
+	client, err := gapic.NewClient(ctx, rawClientOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.CreateSession(ctx, &spannerpb.CreateSessionRequest{
+		Database: databaseName(),
+		Session:  &spannerpb.Session{Multiplexed: *rawMultiplexed},
+	})
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	log.Printf("raw: session %s multiplexed=%t", session.GetName(), session.GetMultiplexed())
+	if !session.GetMultiplexed() {
+		defer client.DeleteSession(context.Background(), &spannerpb.DeleteSessionRequest{Name: session.GetName()})
+	}
+	s := &rawSession{client: client, name: session.GetName()}
+
+	enterPhase("insert")
+	insert := &spannerpb.Mutation{Operation: &spannerpb.Mutation_Insert{Insert: &spannerpb.Mutation_Write{
+		Table:   *table,
+		Columns: []string{*pkColumn, "Val"},
+		Values:  []*structpb.ListValue{{Values: []*structpb.Value{structpb.NewStringValue("1"), structpb.NewStringValue("1")}}},
+	}}}
+	resp, err := client.Commit(ctx, &spannerpb.CommitRequest{
+		Session: s.name,
+		Transaction: &spannerpb.CommitRequest_SingleUseTransaction{SingleUseTransaction: &spannerpb.TransactionOptions{
+			Mode: &spannerpb.TransactionOptions_ReadWrite_{ReadWrite: &spannerpb.TransactionOptions_ReadWrite{}},
+		}},
+		Mutations: []*spannerpb.Mutation{insert},
+	})
+	if err != nil {
+		return stepError(stepInsert, fmt.Errorf("insert: %w", err))
+	}
+	log.Printf("INSERT committed at %s", resp.GetCommitTimestamp().AsTime().Format(time.RFC3339Nano))
+
+	enterPhase("delete")
+	if *deleteMode == "stmt-mutation" {
+		err = s.deleteMutation(ctx)
+	} else {
+		err = s.deleteDML(ctx)
+	}
+	if err != nil {
+		return stepError(stepDelete, err)
+	}
+
+	enterPhase("verify")
+	return stepError(stepVerify, s.verify(ctx))
+}
+
+// rawClientOptions connects the generated API client, which unlike the
+// client library does not read SPANNER_EMULATOR_HOST, to the emulator.
+func rawClientOptions() []option.ClientOption {
+	opts := rpcTraceOptions()
+	if *verbosity >= 1 {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(commitResponseInterceptor)))
+	}
+	return append(opts, repro.EmulatorOptions()...)
+}
+
+// pk1 is the key set of the row PK=1.
+func pk1() *spannerpb.KeySet {
+	return &spannerpb.KeySet{Keys: []*structpb.ListValue{{Values: []*structpb.Value{structpb.NewStringValue("1")}}}}
+}
+
+func readWriteOptions() *spannerpb.TransactionOptions {
+	return &spannerpb.TransactionOptions{Mode: &spannerpb.TransactionOptions_ReadWrite_{ReadWrite: &spannerpb.TransactionOptions_ReadWrite{}}}
+}
+
+// track keeps the precommit token with the highest sequence number, which is
+// the one Commit must carry on a multiplexed session. At -v=1 it logs every
+// token, with the RPC that returned it.
+func (s *rawSession) track(from string, token *spannerpb.MultiplexedSessionPrecommitToken) {
+	if token != nil {
+		vlogf(1, "raw: %s returned precommit token %s", from, protoJSON(token))
+	}
+	if token != nil && (s.token == nil || token.GetSeqNum() > s.token.GetSeqNum()) {
+		s.token = token
+	}
+}
+
+// deleteMutation begins a transaction with BeginTransaction and commits a
+// DELETE mutation in it. On a multiplexed session, a mutation-only
+// transaction names one of its mutations as the mutation key.
+func (s *rawSession) deleteMutation(ctx context.Context) error {
+	del := &spannerpb.Mutation{Operation: &spannerpb.Mutation_Delete_{Delete: &spannerpb.Mutation_Delete{Table: *table, KeySet: pk1()}}}
+	req := &spannerpb.BeginTransactionRequest{Session: s.name, Options: readWriteOptions()}
+	if *rawMultiplexed {
+		req.MutationKey = del
+	}
+	log.Printf("DELETE: raw BeginTransaction + Commit (mutation)")
+	txn, err := s.client.BeginTransaction(ctx, req)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	s.track("BeginTransaction", txn.GetPrecommitToken())
+	commitTs, err := s.commit(ctx, txn.GetId(), []*spannerpb.Mutation{del})
+	if err != nil {
+		return err
+	}
+	log.Printf("DELETE committed at %s", commitTs.Format(time.RFC3339Nano))
+	return nil
+}
+
+// deleteDML executes the DELETE as DML, in a transaction begun by
+// BeginTransaction or, with -begin=inlined, by the ExecuteSql request.
+func (s *rawSession) deleteDML(ctx context.Context) error {
+	req := &spannerpb.ExecuteSqlRequest{
+		Session: s.name,
+		Sql:     sqlFor("DELETE FROM T WHERE PK = 1"),
+		Seqno:   1,
+	}
+	if *beginMode == "inlined" {
+		log.Printf("DELETE: raw ExecuteSql (inlined begin) + Commit (DML)")
+		req.Transaction = &spannerpb.TransactionSelector{Selector: &spannerpb.TransactionSelector_Begin{Begin: readWriteOptions()}}
+	} else {
+		log.Printf("DELETE: raw BeginTransaction + ExecuteSql + Commit (DML)")
+		txn, err := s.client.BeginTransaction(ctx, &spannerpb.BeginTransactionRequest{Session: s.name, Options: readWriteOptions()})
+		if err != nil {
+			return fmt.Errorf("begin: %w", err)
+		}
+		s.track("BeginTransaction", txn.GetPrecommitToken())
+		req.Transaction = &spannerpb.TransactionSelector{Selector: &spannerpb.TransactionSelector_Id{Id: txn.GetId()}}
+	}
+	rs, err := s.client.ExecuteSql(ctx, req)
+	if err != nil {
+		return fmt.Errorf("execute sql: %w", err)
+	}
+	s.track("ExecuteSql", rs.GetPrecommitToken())
+	log.Printf("DELETE: server reported %d row(s) affected", rs.GetStats().GetRowCountExact())
+	id := req.GetTransaction().GetId()
+	if id == nil {
+		id = rs.GetMetadata().GetTransaction().GetId()
+	}
+	commitTs, err := s.commit(ctx, id, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("DELETE committed at %s", commitTs.Format(time.RFC3339Nano))
+	return nil
+}
+
+// commit commits the transaction id with mutations and returns its commit
+// timestamp. If the server asks for a retry with a newer precommit token, as
+// it may on a multiplexed session, the commit is retried once with that
+// token.
+func (s *rawSession) commit(ctx context.Context, id []byte, mutations []*spannerpb.Mutation) (time.Time, error) {
+	req := &spannerpb.CommitRequest{
+		Session:           s.name,
+		Transaction:       &spannerpb.CommitRequest_TransactionId{TransactionId: id},
+		Mutations:         mutations,
+		PrecommitToken:    s.token,
+		ReturnCommitStats: s.commitOptions.ReturnCommitStats,
+	}
+	if d := s.commitOptions.MaxCommitDelay; d != nil {
+		req.MaxCommitDelay = durationpb.New(*d)
+	}
+	if s.tag != "" || s.commitPriority != spannerpb.RequestOptions_PRIORITY_UNSPECIFIED {
+		req.RequestOptions = &spannerpb.RequestOptions{TransactionTag: s.tag, Priority: s.commitPriority}
+	}
+	resp, err := s.client.Commit(ctx, req)
+	if err == nil && resp.GetPrecommitToken() != nil {
+		log.Printf("raw: Commit asked for a retry with precommit token seq %d", resp.GetPrecommitToken().GetSeqNum())
+		req.PrecommitToken = resp.GetPrecommitToken()
+		resp, err = s.client.Commit(ctx, req)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("commit: %w", err)
+	}
+	return resp.GetCommitTimestamp().AsTime(), nil
+}
+
+// execAutocommitDML implements -delete=autocommit: it runs stmt as a single
+// autocommit DML statement, the way drivers without a client-side
+// transaction send one, through the generated API client: an ExecuteSql
+// whose TransactionSelector begins a read/write transaction, and a Commit of
+// the transaction its result set names, on a session of the kind
+// -multiplexed selects. The client library has no single-use read/write
+// path for DML, and its transaction runner would decide the begin itself.
+// The generated client is built with the options of sc, so that its RPCs
+// pass through the same interceptors. The begin option in opts is ignored;
+// every other option is sent as the client library would send it.
+func execAutocommitDML(ctx context.Context, sc *spanner.Client, opts spanner.TransactionOptions, stmt spanner.Statement) (time.Time, int64, error) {
+	params, types, err := repro.Params(stmt.Params)
+	if err != nil {
+		return time.Time{}, noRowCount, err
+	}
+	client, err := gapic.NewClient(ctx, append(repro.EmulatorOptions(), clientOptionsOf(sc)...)...)
+	if err != nil {
+		return time.Time{}, noRowCount, err
+	}
+	defer client.Close()
+
+	session, err := client.CreateSession(ctx, &spannerpb.CreateSessionRequest{
+		Database: databaseName(),
+		Session:  &spannerpb.Session{Multiplexed: multiplexedForRW()},
+	})
+	if err != nil {
+		return time.Time{}, noRowCount, fmt.Errorf("create session: %w", err)
+	}
+	if !session.GetMultiplexed() {
+		defer client.DeleteSession(context.Background(), &spannerpb.DeleteSessionRequest{Name: session.GetName()})
+	}
+	s := &rawSession{client: client, name: session.GetName(), tag: opts.TransactionTag, commitOptions: opts.CommitOptions, commitPriority: opts.CommitPriority}
+
+	req := &spannerpb.ExecuteSqlRequest{
+		Session:     s.name,
+		Transaction: &spannerpb.TransactionSelector{Selector: &spannerpb.TransactionSelector_Begin{Begin: repro.ReadWriteOptions(opts)}},
+		Sql:         stmt.SQL,
+		Params:      params,
+		ParamTypes:  types,
+		Seqno:       1,
+	}
+	if s.tag != "" {
+		req.RequestOptions = &spannerpb.RequestOptions{TransactionTag: s.tag}
+	}
+	rs, err := client.ExecuteSql(ctx, req)
+	if err != nil {
+		return time.Time{}, noRowCount, fmt.Errorf("execute sql: %w", err)
+	}
+	s.track("ExecuteSql", rs.GetPrecommitToken())
+	id := rs.GetMetadata().GetTransaction().GetId()
+	if id == nil {
+		return time.Time{}, noRowCount, fmt.Errorf("execute sql: the result set names no transaction begun by its selector")
+	}
+	log.Printf("autocommit: ExecuteSql on a %s session began transaction %x", sessionKind(session.GetMultiplexed()), id)
+	commitTs, err := s.commit(ctx, id, nil)
+	if err != nil {
+		return time.Time{}, noRowCount, err
+	}
+	return commitTs, rs.GetStats().GetRowCountExact(), nil
+}
+
+// verify reads PK=1 in a strong single-use read-only transaction.
+func (s *rawSession) verify(ctx context.Context) error {
+	rs, err := s.client.Read(ctx, &spannerpb.ReadRequest{
+		Session: s.name,
+		Transaction: &spannerpb.TransactionSelector{Selector: &spannerpb.TransactionSelector_SingleUse{SingleUse: &spannerpb.TransactionOptions{
+			Mode: &spannerpb.TransactionOptions_ReadOnly_{ReadOnly: &spannerpb.TransactionOptions_ReadOnly{
+				TimestampBound:      &spannerpb.TransactionOptions_ReadOnly_Strong{Strong: true},
+				ReturnReadTimestamp: true,
+			}},
+		}}},
+		Table:   *table,
+		Columns: []string{*pkColumn},
+		KeySet:  pk1(),
+	})
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	exists := len(rs.GetRows()) > 0
+	readTs := rs.GetMetadata().GetTransaction().GetReadTimestamp().AsTime()
+	log.Printf("verify (strong) read at %s: PK=1 exists=%t", readTs.Format(time.RFC3339Nano), exists)
+	if exists {
+		return &survivedError{pk: 1, rows: 1}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+)
+
+// readOnlyStaleness is how long reproduceReadOnly waits before its
+// exact-staleness read, so that the read timestamp falls after the write.
+const readOnlyStaleness = time.Second
+
+// reproduceReadOnly writes PK=1..3 with Val=PK and reads them back through
+// every read-only path, each of which should see exactly those rows: strong
+// single-use reads and queries, reads at the commit timestamp, at an exact
+// staleness, and with a minimum read timestamp, a multi-use
+// ReadOnlyTransaction, and the partitions of a BatchReadOnlyTransaction.
+// With the client library's defaults these all run on the multiplexed
+// session. -delete and -begin are ignored.
+func reproduceReadOnly(ctx context.Context) error {
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	want := map[int64]int64{1: 1, 2: 2, 3: 3}
+	var ms []*spanner.Mutation
+	for _, pk := range slices.Sorted(maps.Keys(want)) {
+		ms = append(ms, spanner.InsertOrUpdate(*table, []string{*pkColumn, "Val"}, []any{pk, want[pk]}))
+	}
+	enterPhase("insert")
+	commitTs, err := client.Apply(ctx, ms, spanner.TransactionTag(runTag()))
+	if err != nil {
+		return stepError(stepInsert, fmt.Errorf("insert: %w", err))
+	}
+	log.Printf("INSERT PK=1..3 committed at %s", commitTs.Format(time.RFC3339Nano))
+
+	all := spanner.Statement{SQL: sqlFor("SELECT PK, Val FROM T")}
+	cols := []string{*pkColumn, "Val"}
+	read := func(tx interface {
+		Read(context.Context, string, spanner.KeySet, []string) *spanner.RowIterator
+	}) (map[int64]int64, error) {
+		return collectRows(tx.Read(ctx, *table, spanner.AllKeys(), cols))
+	}
+	paths := []struct {
+		name string
+		read func() (map[int64]int64, error)
+	}{
+		{"strong read", func() (map[int64]int64, error) { return read(client.Single()) }},
+		{"strong query", func() (map[int64]int64, error) { return collectRows(client.Single().Query(ctx, all)) }},
+		{"read at commit timestamp", func() (map[int64]int64, error) {
+			return read(client.Single().WithTimestampBound(spanner.ReadTimestamp(commitTs)))
+		}},
+		{"exact staleness", func() (map[int64]int64, error) {
+			time.Sleep(time.Until(commitTs.Add(readOnlyStaleness)))
+			return read(client.Single().WithTimestampBound(spanner.ExactStaleness(readOnlyStaleness)))
+		}},
+		{"min read timestamp", func() (map[int64]int64, error) {
+			return read(client.Single().WithTimestampBound(spanner.MinReadTimestamp(commitTs)))
+		}},
+		{"multi-use read-only transaction", func() (map[int64]int64, error) {
+			ro := client.ReadOnlyTransaction()
+			defer ro.Close()
+			byRead, err := read(ro)
+			if err != nil {
+				return nil, err
+			}
+			byQuery, err := collectRows(ro.Query(ctx, all))
+			if err != nil {
+				return nil, err
+			}
+			if !maps.Equal(byRead, byQuery) {
+				return nil, fmt.Errorf("read %v and query %v disagree in one transaction", byRead, byQuery)
+			}
+			return byRead, nil
+		}},
+		{"batch read-only partitions", func() (map[int64]int64, error) {
+			txn, err := client.BatchReadOnlyTransaction(ctx, spanner.StrongRead())
+			if err != nil {
+				return nil, err
+			}
+			defer txn.Close()
+			defer txn.Cleanup(context.Background())
+			parts, err := txn.PartitionQuery(ctx, all, spanner.PartitionOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("partition query: %w", err)
+			}
+			rows := make(map[int64]int64)
+			for _, p := range parts {
+				got, err := collectRows(txn.Execute(ctx, p))
+				if err != nil {
+					return nil, fmt.Errorf("execute partition: %w", err)
+				}
+				maps.Copy(rows, got)
+			}
+			log.Printf("batch read-only partitions: %d partition(s)", len(parts))
+			return rows, nil
+		}},
+	}
+
+	enterPhase("verify")
+	var wrong []string
+	for _, p := range paths {
+		got, err := p.read()
+		if err != nil {
+			return stepError(stepVerify, fmt.Errorf("%s: %w", p.name, err))
+		}
+		log.Printf("%s: %v", p.name, got)
+		if !maps.Equal(got, want) {
+			wrong = append(wrong, fmt.Sprintf("%s read %v", p.name, got))
+		}
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("%w: expected %v after the INSERT committed, but %s", errWriteLost, want, strings.Join(wrong, "; "))
+	}
+	return nil
+}
+
+// collectRows returns the PK and Val columns of the rows of iter.
+func collectRows(iter *spanner.RowIterator) (map[int64]int64, error) {
+	defer iter.Stop()
+	rows := make(map[int64]int64)
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var pk, val int64
+		if err := row.Columns(&pk, &val); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		rows[pk] = val
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// maxReportTrace bounds the trace section of the report, since GitHub
+// rejects issue bodies over 65536 characters.
+const maxReportTrace = 40000
+
+// issueReport implements the report subcommand. It wraps run, the scenario
+// sc with the other flags applied, so that it runs once with -trace on, and
+// then, unless run is already -matrix or sc does not honor -delete and
+// -begin, runs sc on its own as -matrix without the trace. It then writes a
+// GitHub issue body to stdout: the environment, the command, the outcome,
+// the matrix, and the trace and log of the first run in collapsible
+// sections. It returns the error of the first run.
+func issueReport(sc scenario, run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		orig := log.Writer()
+		defer log.SetOutput(orig)
+		var captured bytes.Buffer
+		log.SetOutput(io.MultiWriter(orig, &captured))
+
+		traced := *traceWire
+		*traceWire = true
+		runErr := run(ctx)
+		*traceWire = traced
+		runLog := captured.String()
+		attempts := recordedStmtAttempts()
+
+		if !*matrixMode && sc.honorsModes {
+			if err := resetTable(ctx); err != nil {
+				return fmt.Errorf("reset before the matrix: %w", err)
+			}
+			// Its failures are in the grid.
+			matrix(sc.run)(ctx)
+		}
+		log.SetOutput(orig)
+
+		var traceLines, logLines []string
+		for _, line := range strings.Split(strings.TrimRight(runLog, "\n"), "\n") {
+			if strings.Contains(line, " TRACE> ") || strings.Contains(line, " TRACE< ") {
+				traceLines = append(traceLines, line)
+			} else {
+				logLines = append(logLines, line)
+			}
+		}
+		writeIssueReport(os.Stdout, sc, runErr, attempts, traceLines, logLines)
+		return runErr
+	}
+}
+
+// writeIssueReport writes the report subcommand's issue body to w, with
+// attempts, the retried statement-based transactions of the traced run.
+func writeIssueReport(w io.Writer, sc scenario, runErr error, attempts []stmtAttempt, traceLines, logLines []string) {
+	fmt.Fprintf(w, "### Summary\n\n")
+	fmt.Fprintf(w, "Scenario `%s`: %s.\n\n", sc.name, sc.description)
+	fmt.Fprintf(w, "- Expected: %s.\n", sc.expected)
+	fmt.Fprintf(w, "- Actual: **%s**", outcome(runErr))
+	if runErr != nil {
+		fmt.Fprintf(w, " (`%v`)", runErr)
+	}
+	fmt.Fprintf(w, "\n\n")
+
+	env := reportedEnvironment()
+	fmt.Fprintf(w, "### Environment\n\n")
+	fmt.Fprintf(w, "| | |\n|---|---|\n")
+	fmt.Fprintf(w, "| Client library | `cloud.google.com/go/spanner@%s` |\n", env.LibraryVersion)
+	fmt.Fprintf(w, "| Go | `%s %s` |\n", env.GoVersion, env.Platform)
+	fmt.Fprintf(w, "| Emulator host | `%s` |\n", env.EmulatorHost)
+	if env.EmulatorImage != "" {
+		fmt.Fprintf(w, "| Emulator image | `%s` |\n", env.EmulatorImage)
+	}
+	fmt.Fprintf(w, "| Multiplexed sessions for read/write | `%t` |\n", multiplexedForRW())
+	for _, name := range slices.Sorted(maps.Keys(env.Env)) {
+		fmt.Fprintf(w, "| `%s` | `%s` |\n", name, env.Env[name])
+	}
+
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	fmt.Fprintf(w, "\n### Reproduction\n\n")
+	fmt.Fprintf(w, "```sh\ngo run . %s\n```\n\n", strings.Join(args, " "))
+
+	if len(attempts) > 0 {
+		fmt.Fprintf(w, "### Retried statement-based transactions\n\n")
+		fmt.Fprintf(w, "| Phase | Attempt | ResetForRetry | Duration | Error |\n|---|---|---|---|---|\n")
+		for _, a := range attempts {
+			fmt.Fprintf(w, "| %s | %d | %t | %s | %s |\n", a.Phase, a.Attempt, a.Reset, a.Duration, strings.NewReplacer("|", "\\|", "\n", " ").Replace(a.Error))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	if matrixCells != nil {
+		fmt.Fprintf(w, "### Outcomes by -delete and -begin\n\n")
+		fmt.Fprintf(w, "PASS: the write took effect; BUG: it was lost after a successful commit; ERROR: the run failed.\n\n")
+		fmt.Fprintf(w, "```\n%s```\n\n", formatMatrix(matrixCells))
+	}
+
+	trace := strings.Join(traceLines, "\n")
+	if len(trace) > maxReportTrace {
+		trace = trace[:maxReportTrace] + "\n... (truncated; rerun with -trace for the rest)"
+	}
+	writeDetails(w, fmt.Sprintf("gRPC trace (%d messages)", len(traceLines)), trace)
+	writeDetails(w, "Log", strings.Join(logLines, "\n"))
+	writeDetails(w, fmt.Sprintf("Effective flags (%d)", len(env.Flags)), strings.Join(formatFlags(env.Flags), "\n"))
+}
+
+// writeDetails writes body as a collapsible section titled summary.
+func writeDetails(w io.Writer, summary, body string) {
+	fmt.Fprintf(w, "<details>\n<summary>%s</summary>\n\n```\n%s\n```\n\n</details>\n\n", summary, body)
+}
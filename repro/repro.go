@@ -0,0 +1,373 @@
+// Package repro checks a Spanner database, normally the emulator, for the
+// write loss of https://github.com/GoogleCloudPlatform/cloud-spanner-emulator/issues/282:
+// a DELETE of one row, committed successfully in a read/write transaction on
+// a multiplexed session, that leaves the row in place.
+//
+// It is the core of the command in the parent directory without its flags,
+// for use from other programs and test suites:
+//
+//	target := repro.Target{Project: "p", Instance: "i", Database: "d"}
+//	if err := repro.Setup(ctx, target); err != nil { ... }
+//	client, err := spanner.NewClient(ctx, target.DatabaseName())
+//	...
+//	err = repro.Run(ctx, client, repro.Case{Delete: "stmt-mutation", Begin: "explicit"})
+//	if errors.Is(err, repro.ErrWriteLost) { ... }
+//
+// The command takes its outcomes, its -delete and -begin modes, and the
+// options it sends through the generated API client from this package.
+package repro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
+	"cloud.google.com/go/spanner/admin/instance/apiv1/instancepb"
+	gapic "cloud.google.com/go/spanner/apiv1"
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ErrWriteLost marks the silent write loss this package checks for, as
+// opposed to infrastructure or API errors.
+var ErrWriteLost = errors.New("BUG")
+
+// Schema is the DDL of the table the check writes.
+const Schema = "CREATE TABLE T (PK INT64 NOT NULL, Val INT64) PRIMARY KEY(PK)"
+
+// DeleteModes and BeginModes are the ways a Case can delete the row and
+// begin its transaction, in the order Matrix runs them.
+var (
+	DeleteModes = []string{"stmt-mutation", "rw-mutation", "apply", "stmt-dml", "stmt-dml-return", "stmt-batch-dml", "rw-batch-dml", "mixed", "autocommit", "pdml", "batchwrite"}
+	BeginModes  = []string{"default", "inlined", "explicit"}
+)
+
+// BeginIgnored reports whether the Begin mode has no effect on the Delete
+// mode, because the client library, or the server, begins the transaction
+// itself.
+func BeginIgnored(deleteMode string) bool {
+	return deleteMode == "apply" || deleteMode == "autocommit" || deleteMode == "pdml" || deleteMode == "batchwrite"
+}
+
+// Outcome classifies the result of Run: PASS, BUG for ErrWriteLost, or ERROR.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return "PASS"
+	case errors.Is(err, ErrWriteLost):
+		return "BUG"
+	default:
+		return "ERROR"
+	}
+}
+
+// Target names the database the check runs against.
+type Target struct {
+	Project, Instance, Database string
+}
+
+func (t Target) instanceName() string { return "projects/" + t.Project + "/instances/" + t.Instance }
+
+// DatabaseName returns the resource name of the database.
+func (t Target) DatabaseName() string { return t.instanceName() + "/databases/" + t.Database }
+
+// Setup creates the instance, on the emulator's instance configuration, and
+// the database with table T. Either may already exist; an existing database
+// must already have T.
+func Setup(ctx context.Context, t Target, opts ...option.ClientOption) error {
+	ic, err := instance.NewInstanceAdminClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer ic.Close()
+	iop, err := ic.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     "projects/" + t.Project,
+		InstanceId: t.Instance,
+		Instance: &instancepb.Instance{
+			Config:      "projects/" + t.Project + "/instanceConfigs/emulator-config",
+			DisplayName: t.Instance,
+			NodeCount:   1,
+		},
+	})
+	if err == nil {
+		_, err = iop.Wait(ctx)
+	}
+	if err != nil && spanner.ErrCode(err) != codes.AlreadyExists {
+		return fmt.Errorf("create instance: %w", err)
+	}
+
+	dc, err := database.NewDatabaseAdminClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	dop, err := dc.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+		Parent:          t.instanceName(),
+		CreateStatement: "CREATE DATABASE `" + t.Database + "`",
+		ExtraStatements: []string{Schema},
+	})
+	if err == nil {
+		_, err = dop.Wait(ctx)
+	}
+	if err != nil && spanner.ErrCode(err) != codes.AlreadyExists {
+		return fmt.Errorf("create database: %w", err)
+	}
+	return nil
+}
+
+// Case is one way of deleting the row: a Delete mode, and for the modes that
+// use it a Begin mode. The zero Begin is "default".
+type Case struct {
+	Delete, Begin string
+}
+
+// Run empties T, inserts PK=1, deletes it as c says, and reads it back
+// strongly. It returns an error wrapping ErrWriteLost if the row survived a
+// DELETE that committed successfully.
+func Run(ctx context.Context, client *spanner.Client, c Case) error {
+	if !slices.Contains(DeleteModes, c.Delete) {
+		return fmt.Errorf("unknown delete mode: %s", c.Delete)
+	}
+	opts, err := transactionOptions(c.Begin)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Apply(ctx, []*spanner.Mutation{spanner.Delete("T", spanner.AllKeys())}); err != nil {
+		return fmt.Errorf("clear: %w", err)
+	}
+	if _, err := client.Apply(ctx, []*spanner.Mutation{spanner.Insert("T", []string{"PK", "Val"}, []any{1, 1})}); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	if err := deleteRow(ctx, client, c.Delete, opts); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	_, err = client.Single().ReadRow(ctx, "T", spanner.Key{1}, []string{"PK"})
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: row PK=1 still exists after the DELETE committed", ErrWriteLost)
+	case spanner.ErrCode(err) == codes.NotFound:
+		return nil
+	default:
+		return fmt.Errorf("verify: %w", err)
+	}
+}
+
+// Matrix runs every Case, skipping the Begin modes of Delete modes that
+// ignore them, and returns the outcome of each.
+func Matrix(ctx context.Context, client *spanner.Client) map[Case]string {
+	outcomes := make(map[Case]string)
+	for _, d := range DeleteModes {
+		for _, b := range BeginModes {
+			if BeginIgnored(d) && b != "default" {
+				continue
+			}
+			c := Case{Delete: d, Begin: b}
+			outcomes[c] = Outcome(Run(ctx, client, c))
+		}
+	}
+	return outcomes
+}
+
+func transactionOptions(begin string) (spanner.TransactionOptions, error) {
+	var opts spanner.TransactionOptions
+	switch begin {
+	case "", "default":
+		opts.BeginTransactionOption = spanner.DefaultBeginTransaction
+	case "inlined":
+		opts.BeginTransactionOption = spanner.InlinedBeginTransaction
+	case "explicit":
+		opts.BeginTransactionOption = spanner.ExplicitBeginTransaction
+	default:
+		return opts, fmt.Errorf("unknown begin mode: %s", begin)
+	}
+	return opts, nil
+}
+
+// deleteRow deletes PK=1 with mode.
+func deleteRow(ctx context.Context, client *spanner.Client, mode string, opts spanner.TransactionOptions) error {
+	m := spanner.Delete("T", spanner.Key{1})
+	stmt := spanner.Statement{SQL: "DELETE FROM T WHERE PK = @p1", Params: map[string]any{"p1": int64(1)}}
+	var err error
+	switch mode {
+	case "stmt-mutation":
+		err = stmtBased(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			return txn.BufferWrite([]*spanner.Mutation{m})
+		})
+	case "stmt-dml":
+		err = stmtBased(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			_, err := txn.Update(ctx, stmt)
+			return err
+		})
+	case "stmt-dml-return":
+		err = stmtBased(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			returned := 0
+			iter := txn.Query(ctx, spanner.Statement{SQL: stmt.SQL + " THEN RETURN PK", Params: stmt.Params})
+			if err := iter.Do(func(*spanner.Row) error { returned++; return nil }); err != nil {
+				return err
+			}
+			if iter.RowCount != int64(returned) {
+				return fmt.Errorf("statement returned %d row(s) but its stats report %d", returned, iter.RowCount)
+			}
+			return nil
+		})
+	case "stmt-batch-dml":
+		err = stmtBased(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			_, err := txn.BatchUpdate(ctx, []spanner.Statement{stmt})
+			return err
+		})
+	case "mixed":
+		err = stmtBased(ctx, client, opts, func(txn *spanner.ReadWriteStmtBasedTransaction) error {
+			if _, err := txn.Update(ctx, spanner.Statement{SQL: "UPDATE T SET Val = Val + 1 WHERE PK = 1"}); err != nil {
+				return err
+			}
+			return txn.BufferWrite([]*spanner.Mutation{m})
+		})
+	case "rw-mutation":
+		_, err = client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			return txn.BufferWrite([]*spanner.Mutation{m})
+		}, opts)
+	case "rw-batch-dml":
+		_, err = client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			_, err := txn.BatchUpdate(ctx, []spanner.Statement{stmt})
+			return err
+		}, opts)
+	case "apply":
+		_, err = client.Apply(ctx, []*spanner.Mutation{m})
+	case "autocommit":
+		err = autocommit(ctx, client.DatabaseName(), opts, stmt)
+	case "pdml":
+		_, err = client.PartitionedUpdate(ctx, stmt)
+	case "batchwrite":
+		err = client.BatchWrite(ctx, []*spanner.MutationGroup{{Mutations: []*spanner.Mutation{m}}}).
+			Do(func(r *spannerpb.BatchWriteResponse) error {
+				if code := codes.Code(r.GetStatus().GetCode()); code != codes.OK {
+					return fmt.Errorf("batch write: %s: %s", code, r.GetStatus().GetMessage())
+				}
+				return nil
+			})
+	}
+	return err
+}
+
+// stmtBased runs write in a statement-based transaction and commits it.
+func stmtBased(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, write func(*spanner.ReadWriteStmtBasedTransaction) error) error {
+	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	if err := write(txn); err != nil {
+		txn.Rollback(ctx)
+		return err
+	}
+	_, err = txn.Commit(ctx)
+	return err
+}
+
+// autocommit runs stmt as a single autocommit DML statement on a
+// multiplexed session of db: an ExecuteSql whose TransactionSelector begins
+// a read/write transaction, and a Commit of the transaction its result set
+// names. The client library has no such path, so it goes through the
+// generated API client.
+func autocommit(ctx context.Context, db string, opts spanner.TransactionOptions, stmt spanner.Statement) error {
+	params, types, err := Params(stmt.Params)
+	if err != nil {
+		return err
+	}
+	client, err := gapic.NewClient(ctx, EmulatorOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.CreateSession(ctx, &spannerpb.CreateSessionRequest{
+		Database: db,
+		Session:  &spannerpb.Session{Multiplexed: true},
+	})
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	rs, err := client.ExecuteSql(ctx, &spannerpb.ExecuteSqlRequest{
+		Session:     session.GetName(),
+		Transaction: &spannerpb.TransactionSelector{Selector: &spannerpb.TransactionSelector_Begin{Begin: ReadWriteOptions(opts)}},
+		Sql:         stmt.SQL,
+		Params:      params,
+		ParamTypes:  types,
+		Seqno:       1,
+	})
+	if err != nil {
+		return fmt.Errorf("execute sql: %w", err)
+	}
+	id := rs.GetMetadata().GetTransaction().GetId()
+	if id == nil {
+		return errors.New("execute sql: the result set names no transaction begun by its selector")
+	}
+	req := &spannerpb.CommitRequest{
+		Session:        session.GetName(),
+		Transaction:    &spannerpb.CommitRequest_TransactionId{TransactionId: id},
+		PrecommitToken: rs.GetPrecommitToken(),
+	}
+	resp, err := client.Commit(ctx, req)
+	if err == nil && resp.GetPrecommitToken() != nil {
+		req.PrecommitToken = resp.GetPrecommitToken()
+		_, err = client.Commit(ctx, req)
+	}
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// EmulatorOptions points the generated API client, which unlike the client
+// library does not read SPANNER_EMULATOR_HOST, at that emulator, if set.
+func EmulatorOptions() []option.ClientOption {
+	host := os.Getenv("SPANNER_EMULATOR_HOST")
+	if host == "" {
+		return nil
+	}
+	return []option.ClientOption{
+		option.WithEndpoint(host),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// ReadWriteOptions returns the read/write transaction options of opts as
+// the client library would send them when beginning the transaction.
+func ReadWriteOptions(opts spanner.TransactionOptions) *spannerpb.TransactionOptions {
+	return &spannerpb.TransactionOptions{
+		Mode: &spannerpb.TransactionOptions_ReadWrite_{ReadWrite: &spannerpb.TransactionOptions_ReadWrite{
+			ReadLockMode: opts.ReadLockMode,
+		}},
+		IsolationLevel:              opts.IsolationLevel,
+		ExcludeTxnFromChangeStreams: opts.ExcludeTxnFromChangeStreams,
+	}
+}
+
+// Params encodes the parameters of a statement for ExecuteSql. Only INT64
+// parameters, the only kind the delete modes bind, are supported.
+func Params(params map[string]any) (*structpb.Struct, map[string]*spannerpb.Type, error) {
+	if len(params) == 0 {
+		return nil, nil, nil
+	}
+	fields := make(map[string]*structpb.Value, len(params))
+	types := make(map[string]*spannerpb.Type, len(params))
+	for name, v := range params {
+		n, ok := v.(int64)
+		if !ok {
+			return nil, nil, fmt.Errorf("parameter %s: %T is not an INT64", name, v)
+		}
+		fields[name] = structpb.NewStringValue(strconv.FormatInt(n, 10))
+		types[name] = &spannerpb.Type{Code: spannerpb.TypeCode_INT64}
+	}
+	return &structpb.Struct{Fields: fields}, types, nil
+}
@@ -5,16 +5,38 @@ EMULATOR_IMAGE="${EMULATOR_IMAGE:-gcr.io/cloud-spanner-emulator/emulator:1.5.50}
 EMULATOR_HOST="localhost:9010"
 CONTAINER_NAME="spanner-emu-test"
 
+# -confirm-failures=N is passed through to every cell, which then re-runs
+# itself N more times, each in a fresh database, if it lost a write, as
+# -matrix does, and reports how many of the re-runs lost a write again.
+CONFIRM_FAILURES=0
+# -dialect=postgresql runs every cell against a PostgreSQL-dialect database.
+DIALECT=googlesql
+# The transaction option flags are passed to every cell, adding them to the
+# matrix as a dimension fixed for the run.
+TXN_FLAGS=()
+for arg in "$@"; do
+  case "$arg" in
+    -confirm-failures=*) CONFIRM_FAILURES="${arg#*=}" ;;
+    -dialect=*) DIALECT="${arg#*=}" ;;
+    -isolation=* | -read-lock-mode=* | -priority=* | -max-commit-delay=* | -exclude-txn-from-change-streams*) TXN_FLAGS+=("$arg") ;;
+    *) echo "unknown argument: $arg" >&2; exit 1 ;;
+  esac
+done
+
 # Build first.
 echo "Building..."
-go build -o repro . || exit 1
+go build -o repro-bin . || exit 1
 
 # Collect results.
 results=()
+confirmations=()
 
-run_test() {
+# confirmation is the -confirm-failures result of the last cell run_once ran.
+confirmation=""
+
+# run_once runs one cell against a fresh emulator and succeeds if it passed.
+run_once() {
   local rw_env="$1" delete="$2" begin="$3"
-  local label="RW=${rw_env:-unset} delete=${delete} begin=${begin}"
 
   # Restart emulator.
   docker rm -f "$CONTAINER_NAME" &>/dev/null || true
@@ -28,22 +50,35 @@ run_test() {
   fi
 
   # Run.
-  local args=(-delete="$delete" -begin="$begin")
-  if env "${env[@]}" ./repro "${args[@]}" 2>&1 | tail -1 | grep -q "^PASS"; then
+  local args=(-delete="$delete" -begin="$begin" -dialect="$DIALECT" -confirm-failures="$CONFIRM_FAILURES" ${TXN_FLAGS[@]+"${TXN_FLAGS[@]}"})
+  local output
+  output=$(env "${env[@]}" ./repro-bin "${args[@]}" 2>&1) || true
+  confirmation=$(sed -n 's/.* confirm: //p' <<<"$output")
+  tail -1 <<<"$output" | grep -q " PASS$"
+}
+
+run_test() {
+  local rw_env="$1" delete="$2" begin="$3"
+  local label="RW=${rw_env:-unset} delete=${delete} begin=${begin}"
+
+  if run_once "$rw_env" "$delete" "$begin"; then
     results+=("PASS  $label")
   else
     results+=("BUG   $label")
+    if (( CONFIRM_FAILURES > 0 )); then
+      confirmations+=("${confirmation:-UNKNOWN}  $label")
+    fi
   fi
 }
 
-echo "Running tests with ${EMULATOR_IMAGE}..."
+echo "Running tests with ${EMULATOR_IMAGE} (${DIALECT}${TXN_FLAGS[*]+ ${TXN_FLAGS[*]}})..."
 echo ""
 
 for rw_env in "true" "false" ""; do
-  for delete in "stmt-mutation" "rw-mutation" "apply" "stmt-dml"; do
+  for delete in "stmt-mutation" "rw-mutation" "apply" "stmt-dml" "stmt-dml-return" "stmt-batch-dml" "rw-batch-dml" "mixed" "autocommit" "pdml" "batchwrite"; do
     for begin in "default" "inlined" "explicit"; do
-      # client.Apply ignores begin option, only run once with default.
-      if [[ "$delete" == "apply" && "$begin" != "default" ]]; then
+      # client.Apply, autocommit, pdml, and batchwrite ignore begin option, only run once with default.
+      if [[ ( "$delete" == "apply" || "$delete" == "autocommit" || "$delete" == "pdml" || "$delete" == "batchwrite" ) && "$begin" != "default" ]]; then
         continue
       fi
       run_test "$rw_env" "$delete" "$begin"
@@ -67,3 +102,14 @@ for r in "${results[@]}"; do
   begin_val=$(echo "$rest" | sed 's/.*begin=\([^ ]*\).*/\1/')
   printf "%-6s %-10s %-15s %-10s\n" "$result" "$rw_val" "$del_val" "$begin_val"
 done
+
+if (( CONFIRM_FAILURES > 0 )); then
+  echo ""
+  echo "============================== Confirmations =============================="
+  if (( ${#confirmations[@]} == 0 )); then
+    echo "no failing cells"
+  fi
+  for c in "${confirmations[@]}"; do
+    echo "$c"
+  done
+fi
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// scenario is one reproduction this program runs, selected by -scenario or by
+// its own flag.
+type scenario struct {
+	name string
+	// flag selects the scenario, and -scenario=name sets it to enable
+	// unless it is already set. The default scenario has no flag.
+	flag, enable string
+	description  string
+	// expected is what a correct emulator does; the scenario fails
+	// otherwise.
+	expected string
+	// honorsModes is set for the scenarios that delete through -delete
+	// with -begin in every mode, the only ones -matrix and report vary
+	// them for.
+	honorsModes bool
+	run         func(context.Context) error
+}
+
+// scenarios are the reproductions this program runs, in the order -list
+// prints them. The first is the default.
+var scenarios = []scenario{
+	{name: "write-loss", description: "insert PK=1, delete it with -delete and -begin, and verify it is gone (issue 282)",
+		expected: "the row is gone; emulator 1.5.50 loses it with multiplexed sessions in the cells of -matrix marked BUG", honorsModes: true, run: reproduce},
+	{name: "raw", flag: "raw", enable: "true", description: "write-loss through the generated API client instead of the client library",
+		expected: "the row is gone", run: reproduceRaw},
+	{name: "three-clients", flag: "three-clients", enable: "true", description: "insert, delete, and verify with three separate clients",
+		expected: "the row is gone", honorsModes: true, run: reproduceThreeClients},
+	{name: "verify-reopen", flag: "verify-reopen", enable: "true", description: "verify the delete with the deleting client and again with a new one",
+		expected: "both clients see the row gone", honorsModes: true, run: reproduceVerifyReopen},
+	{name: "isolation-check", flag: "isolation-check", enable: "true", description: "read the row from another transaction while the delete is buffered, and after commit",
+		expected: "only the strong read after commit misses the row", honorsModes: true, run: reproduceIsolationCheck},
+	{name: "compare-dml-stats", flag: "compare-dml-stats", enable: "true", description: "delete with DML and compare the affected row count with the commit's mutation count",
+		expected: "the counts agree", run: reproduceCompareDMLStats},
+	{name: "verify-after-ddl", flag: "verify-after-ddl", enable: "true", description: "verify, add a column to T, and verify again",
+		expected: "the row is gone both times", honorsModes: true, run: reproduceVerifyAfterDDL},
+	{name: "dml-mutation-order", flag: "dml-mutation-order", enable: "true", description: "set Val=10 with DML and Val=20 with a buffered mutation in one transaction",
+		expected: "Val=20: mutations apply after DML", run: reproduceDMLMutationOrder},
+	{name: "mixed-concurrent", flag: "mixed-concurrent", enable: "true", description: "delete PK=1 with DML and PK=2 with a mutation in two transactions committing together",
+		expected: "both rows are gone", run: reproduceMixedConcurrent},
+	{name: "dml-plus-mutation", flag: "dml-plus-mutation", enable: "true", description: "delete PK=1 with DML and PK=2 with a buffered mutation in one transaction, in both orders",
+		expected: "both rows are gone in both orders", run: reproduceDMLPlusMutation},
+	{name: "cross-check", flag: "cross-check", enable: "true", description: "make the -op write to PK=1 with DML and to PK=2 with a mutation in independent transactions, and diff the results",
+		expected: "both paths apply the write", run: reproduceCrossCheck},
+	{name: "concurrency", flag: "concurrency", enable: "4", description: "delete -concurrency rows from as many goroutines on one client",
+		expected: "every row is gone", honorsModes: true, run: reproduceConcurrency},
+	{name: "stress", flag: "stress", enable: "4", description: "run whole insert/delete/verify cycles from -stress goroutines on one client",
+		expected: "no cycle loses the write", honorsModes: true, run: reproduceStress},
+	{name: "read-only", flag: "read-only", enable: "true", description: "write PK=1..3 and read them through strong, stale, multi-use, and batch read-only transactions",
+		expected: "every read sees PK=1..3", run: reproduceReadOnly},
+	{name: "multi-database", flag: "multi-database", enable: "6", description: "interleave inserts and deletes on two databases of the same emulator, one client each",
+		expected: "each database has exactly its own writes", run: reproduceMultiDatabase},
+	{name: "typed-values", flag: "typed-values", enable: "true", description: "write, update, and delete a row with a column of every type through -delete",
+		expected: "every value reads back as written, Ts is the commit timestamp, and the row is gone after the delete", run: reproduceTypedValues},
+	{name: "large-batch", flag: "mutation-count", enable: "2000", description: "insert and then delete -mutation-count rows, each with as many mutations in one transaction",
+		expected: "every row is written and then every row is gone", run: reproduceLargeBatch},
+	{name: "long-ro", flag: "long-ro", enable: "true", description: "run cycles with a multi-use read-only transaction open on the client, then without",
+		expected: "no cycle loses the write in either phase", honorsModes: true, run: reproduceLongRO},
+	{name: "reuse-committed-txn", flag: "reuse-committed-txn", enable: "true", description: "reuse a committed statement-based transaction",
+		expected: "every call on it fails", run: reproduceReuseCommitted},
+	{name: "cancel-at", flag: "cancel-at", enable: "before-commit", description: "cancel the delete's context, or pass its deadline with -cancel-kind=deadline, at -cancel-at and check the table",
+		expected: "the delete fails; PK=1 is gone only if the server applied the Commit (during-commit)", honorsModes: true, run: reproduceCancelAt},
+	{name: "abort-retry", flag: "abort-retry", enable: "true", description: "abort the first Commit of a buffered delete and let the transaction retry",
+		expected: "the retried delete is committed", run: reproduceAbortRetry},
+	{name: "soak", flag: "soak", enable: "30m", description: "keep one client open for -soak, running a cycle every -soak-interval to exercise session maintenance",
+		expected: "no cycle loses the write", honorsModes: true, run: reproduceSoak},
+	{name: "count", flag: "count", enable: "10", description: "run -count cycles on one client, keeping its sessions across cycles",
+		expected: "no cycle loses the write", honorsModes: true, run: reproduceCount},
+	{name: "script", flag: "script", description: "run the transaction steps of the -script file",
+		expected: "every read and verify step sees what it wants", run: reproduceScript},
+}
+
+// selectScenario returns the scenario named by -scenario, after setting its
+// flag, or else the scenario whose flag is set, or else the default. More
+// than one scenario flag is an error rather than a silent choice.
+func selectScenario() (scenario, error) {
+	if *scenarioName != "" {
+		for _, s := range scenarios {
+			if s.name != *scenarioName {
+				continue
+			}
+			if s.flag != "" && !scenarioFlagged(s) {
+				if err := flag.Set(s.flag, s.enable); err != nil {
+					return scenario{}, err
+				}
+			}
+			for _, other := range scenarios {
+				if other.name != s.name && scenarioFlagged(other) {
+					return scenario{}, fmt.Errorf("-scenario=%s conflicts with -%s", s.name, other.flag)
+				}
+			}
+			return s, nil
+		}
+		return scenario{}, fmt.Errorf("unknown scenario: %s (see -list)", *scenarioName)
+	}
+	var flagged []scenario
+	for _, s := range scenarios {
+		if scenarioFlagged(s) {
+			flagged = append(flagged, s)
+		}
+	}
+	switch len(flagged) {
+	case 0:
+		return scenarios[0], nil
+	case 1:
+		return flagged[0], nil
+	default:
+		return scenario{}, fmt.Errorf("-%s and -%s select different scenarios; run one at a time", flagged[0].flag, flagged[1].flag)
+	}
+}
+
+// scenarioFlagged reports whether the flag of s selects it: it is set to
+// something other than its default, false, or 0.
+func scenarioFlagged(s scenario) bool {
+	if s.flag == "" {
+		return false
+	}
+	f := flag.Lookup(s.flag)
+	switch f.Value.String() {
+	case "false", "0", f.DefValue:
+		return false
+	}
+	return true
+}
+
+// listScenarios implements -list.
+func listScenarios(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tFLAG\tDESCRIPTION\tEXPECTED")
+	for _, s := range scenarios {
+		f := "-"
+		if s.flag != "" {
+			f = "-" + s.flag
+		}
+		fmt.Fprintln(tw, strings.Join([]string{s.name, f, s.description, s.expected}, "\t"))
+	}
+	return tw.Flush()
+}
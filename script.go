@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+)
+
+// script is a transaction sequence read from a -script file, so that a
+// repro case that is a particular ordering of RPCs can be written without
+// changing the program. For example:
+//
+//	{
+//	  "description": "DELETE buffered in an explicitly begun transaction",
+//	  "steps": [
+//	    {"op": "mutation", "kind": "insert", "pk": 1, "val": 1},
+//	    {"op": "begin", "begin": "explicit"},
+//	    {"op": "mutation", "kind": "delete", "pk": 1},
+//	    {"op": "commit"},
+//	    {"op": "verify", "pk": 1, "want": "missing"}
+//	  ]
+//	}
+type script struct {
+	Description string       `json:"description"`
+	Steps       []scriptStep `json:"steps"`
+}
+
+// scriptStep is one step of a script. Op selects the step:
+//
+//   - begin: start a statement-based read/write transaction, with the Begin
+//     mode (default -begin).
+//   - dml: run SQL in the transaction; WantRows, if set, is the row count it
+//     must report.
+//   - mutation: buffer a Kind (insert, update, insert_or_update, replace, or
+//     delete) mutation of PK with Val in the transaction, or apply it in its
+//     own transaction if none is open.
+//   - read: read PK in the transaction, or in a strong single-use read if
+//     none is open, and check it against Want (exists or missing).
+//   - commit, rollback: end the transaction.
+//   - verify: read PK after the fact with the -verify timestamp bound and
+//     check it against Want. A mismatch is reported as a lost write.
+type scriptStep struct {
+	Op       string `json:"op"`
+	Begin    string `json:"begin,omitempty"`
+	SQL      string `json:"sql,omitempty"`
+	WantRows *int64 `json:"want_rows,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	PK       int64  `json:"pk,omitempty"`
+	Val      int64  `json:"val,omitempty"`
+	Want     string `json:"want,omitempty"`
+}
+
+// loadScript reads and checks the -script file.
+func loadScript(path string) (*script, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s script
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	for i, st := range s.Steps {
+		switch st.Op {
+		case "begin", "dml", "mutation", "read", "commit", "rollback", "verify":
+		default:
+			return nil, fmt.Errorf("%s: step %d: unknown op %q", path, i+1, st.Op)
+		}
+		if (st.Op == "read" || st.Op == "verify") && st.Want != "exists" && st.Want != "missing" {
+			return nil, fmt.Errorf("%s: step %d: want must be exists or missing, not %q", path, i+1, st.Want)
+		}
+	}
+	return &s, nil
+}
+
+// reproduceScript implements -script: it runs the steps of the script in
+// order on one client, failing at the first step that errors or does not see
+// what it wants.
+func reproduceScript(ctx context.Context) error {
+	if *scriptFile == "" {
+		return errors.New("-scenario=script needs -script")
+	}
+	s, err := loadScript(*scriptFile)
+	if err != nil {
+		return err
+	}
+	if s.Description != "" {
+		log.Printf("script: %s", s.Description)
+	}
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	r := &scriptRunner{client: client}
+	defer func() {
+		if r.txn != nil {
+			r.txn.Rollback(context.Background())
+		}
+	}()
+	for i, st := range s.Steps {
+		enterPhase(fmt.Sprintf("step %d %s", i+1, st.Op))
+		if err := r.step(ctx, st); err != nil {
+			err = fmt.Errorf("step %d (%s): %w", i+1, st.Op, err)
+			if st.Op == "verify" {
+				return stepError(stepVerify, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptRunner holds the transaction a script has open, if any.
+type scriptRunner struct {
+	client *spanner.Client
+	txn    *spanner.ReadWriteStmtBasedTransaction
+	// commitTs is the commit timestamp of the script's latest write, which
+	// its verify steps read at with -verify=read-timestamp.
+	commitTs time.Time
+}
+
+func (r *scriptRunner) step(ctx context.Context, st scriptStep) error {
+	switch st.Op {
+	case "begin":
+		if r.txn != nil {
+			return errors.New("a transaction is already open")
+		}
+		opts, err := transactionOptions()
+		if err != nil {
+			return err
+		}
+		if st.Begin != "" {
+			if opts.BeginTransactionOption, err = beginOption(st.Begin); err != nil {
+				return err
+			}
+		}
+		r.txn, err = spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, r.client, opts)
+		return err
+	case "dml":
+		if r.txn == nil {
+			return errors.New("no transaction open")
+		}
+		n, err := r.txn.Update(ctx, spanner.Statement{SQL: st.SQL})
+		if err != nil {
+			return err
+		}
+		log.Printf("script: %s: %d row(s) affected", st.SQL, n)
+		if st.WantRows != nil && n != *st.WantRows {
+			return fmt.Errorf("%d row(s) affected, want %d", n, *st.WantRows)
+		}
+		return nil
+	case "mutation":
+		m, err := scriptMutation(st)
+		if err != nil {
+			return err
+		}
+		if r.txn != nil {
+			return r.txn.BufferWrite([]*spanner.Mutation{m})
+		}
+		ts, err := r.client.Apply(ctx, []*spanner.Mutation{m}, spanner.TransactionTag(runTag()))
+		if err == nil {
+			log.Printf("script: %s PK=%d applied at %s", st.Kind, st.PK, ts.Format(time.RFC3339Nano))
+			recordCommit("script", ts)
+			r.commitTs = ts
+		}
+		return err
+	case "read":
+		var err error
+		if r.txn != nil {
+			_, err = r.txn.ReadRow(ctx, *table, spanner.Key{st.PK}, []string{*pkColumn})
+		} else {
+			_, err = r.client.Single().ReadRow(ctx, *table, spanner.Key{st.PK}, []string{*pkColumn})
+		}
+		if err != nil && spanner.ErrCode(err) != codes.NotFound {
+			return err
+		}
+		return checkWant(st, err == nil)
+	case "commit":
+		if r.txn == nil {
+			return errors.New("no transaction open")
+		}
+		ts, err := r.txn.Commit(ctx)
+		r.txn = nil
+		if err == nil {
+			log.Printf("script: committed at %s", ts.Format(time.RFC3339Nano))
+			recordCommit("script", ts)
+			r.commitTs = ts
+		}
+		return err
+	case "rollback":
+		if r.txn == nil {
+			return errors.New("no transaction open")
+		}
+		r.txn.Rollback(ctx)
+		r.txn = nil
+		return nil
+	case "verify":
+		exists, readTs, err := rowExists(ctx, r.client, st.PK, []string{*pkColumn}, r.commitTs)
+		if err != nil {
+			return err
+		}
+		log.Printf("verify (%s) read at %s: PK=%d exists=%t", *verifyMode, readTs.Format(time.RFC3339Nano), st.PK, exists)
+		if !r.commitTs.IsZero() {
+			if err := checkReadAfterWrite(readTs, r.commitTs); err != nil {
+				return err
+			}
+		}
+		if err := checkWant(st, exists); err != nil {
+			return fmt.Errorf("%w: %v", errWriteLost, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown op %q", st.Op)
+}
+
+// scriptMutation returns the mutation of a mutation step.
+func scriptMutation(st scriptStep) (*spanner.Mutation, error) {
+	cols, vals := []string{*pkColumn, "Val"}, []any{st.PK, st.Val}
+	switch st.Kind {
+	case "insert":
+		return spanner.Insert(*table, cols, vals), nil
+	case "update":
+		return spanner.Update(*table, cols, vals), nil
+	case "insert_or_update":
+		return spanner.InsertOrUpdate(*table, cols, vals), nil
+	case "replace":
+		return spanner.Replace(*table, cols, vals), nil
+	case "delete":
+		return spanner.Delete(*table, spanner.Key{st.PK}), nil
+	default:
+		return nil, fmt.Errorf("unknown mutation kind %q", st.Kind)
+	}
+}
+
+// checkWant checks the presence of the row of a read or verify step against
+// what it wants.
+func checkWant(st scriptStep, exists bool) error {
+	if exists != (st.Want == "exists") {
+		return fmt.Errorf("PK=%d exists=%t, want %s", st.PK, exists, st.Want)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+		// wantOps are the ops of the steps loaded.
+		wantOps []string
+	}{
+		{name: "valid", src: `{"description": "d", "steps": [
+			{"op": "mutation", "kind": "insert", "pk": 1, "val": 1},
+			{"op": "begin", "begin": "explicit"},
+			{"op": "mutation", "kind": "delete", "pk": 1},
+			{"op": "read", "pk": 1, "want": "exists"},
+			{"op": "commit"},
+			{"op": "verify", "pk": 1, "want": "missing"}]}`,
+			wantOps: []string{"mutation", "begin", "mutation", "read", "commit", "verify"}},
+		{name: "not JSON", src: `steps:`, wantErr: "invalid character"},
+		{name: "no steps", src: `{"steps": []}`, wantErr: "no steps"},
+		{name: "unknown op", src: `{"steps": [{"op": "commit"}, {"op": "abort"}]}`, wantErr: `step 2: unknown op "abort"`},
+		{name: "verify without want", src: `{"steps": [{"op": "verify", "pk": 1}]}`, wantErr: "want must be exists or missing"},
+		{name: "read with bad want", src: `{"steps": [{"op": "read", "pk": 1, "want": "gone"}]}`, wantErr: `not "gone"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "script.json")
+			if err := os.WriteFile(path, []byte(tt.src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := loadScript(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadScript() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadScript(): %v", err)
+			}
+			var ops []string
+			for _, st := range s.Steps {
+				ops = append(ops, st.Op)
+			}
+			if !slices.Equal(ops, tt.wantOps) {
+				t.Errorf("ops = %q, want %q", ops, tt.wantOps)
+			}
+		})
+	}
+}
+
+func TestLoadScriptMissingFile(t *testing.T) {
+	if _, err := loadScript(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("loadScript() error = %v, want a not-exist error", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	gapic "cloud.google.com/go/spanner/apiv1"
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+	"google.golang.org/api/iterator"
+)
+
+// logSessions implements -list-sessions: it logs every session of the
+// database with ListSessions, and for each the RPCs w saw the run send on it,
+// followed by the sessions the run used that were not listed.
+// Failures are logged rather than returned, so that the listing never
+// changes the result of the run.
+func logSessions(ctx context.Context, when string, w *poolWatcher) {
+	client, err := gapic.NewClient(ctx, rawClientOptions()...)
+	if err != nil {
+		log.Printf("sessions (%s): %v", when, err)
+		return
+	}
+	defer client.Close()
+
+	var sessions []*spannerpb.Session
+	it := client.ListSessions(ctx, &spannerpb.ListSessionsRequest{Database: databaseName()})
+	for {
+		s, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("sessions (%s): list: %v", when, err)
+			return
+		}
+		sessions = append(sessions, s)
+	}
+	var multiplexed int
+	listed := make(map[string]bool)
+	for _, s := range sessions {
+		listed[s.GetName()] = true
+		if s.GetMultiplexed() {
+			multiplexed++
+		}
+	}
+	log.Printf("sessions (%s): %d listed, %d multiplexed", when, len(sessions), multiplexed)
+	for _, s := range sessions {
+		used := "not used by this run"
+		if methods := w.sessionMethods(s.GetName()); len(methods) > 0 {
+			used = "used for " + strings.Join(methods, ", ")
+		}
+		log.Printf("sessions (%s): %s multiplexed=%t created=%s last used=%s; %s", when, s.GetName(), s.GetMultiplexed(),
+			s.GetCreateTime().AsTime().Format(time.RFC3339Nano), s.GetApproximateLastUseTime().AsTime().Format(time.RFC3339Nano), used)
+	}
+	for _, name := range w.usedSessions() {
+		if !listed[name] {
+			log.Printf("sessions (%s): %s not listed, used for %s", when, name, strings.Join(w.sessionMethods(name), ", "))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// reproduceSoak keeps one client open for -soak, running an
+// insert/delete/verify cycle every -soak-interval, so that the client's
+// session maintenance (multiplexed session refresh, pool health checks, and
+// with -session-maintenance-interval their shorter intervals) and the
+// emulator's handling of sessions that have lived that long get exercised
+// between writes. Each cycle logs the sessions it used that no earlier cycle
+// had, which is where a refreshed or recreated session shows.
+func reproduceSoak(ctx context.Context) error {
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	watcher := newPoolWatcher()
+	client, err := newClient(ctx, watcher.clientOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	start := time.Now()
+	deadline := start.Add(*soak)
+	log.Printf("soak: running a cycle every %s until %s", *soakInterval, deadline.Format(time.RFC3339))
+	var lost, n int
+	var seen []string
+	for i := 1; ; i++ {
+		n = i
+		if err := clearTable(ctx, client); err != nil {
+			return fmt.Errorf("reset before cycle %d: %w", i, err)
+		}
+		if err := insertRow(ctx, client); err != nil {
+			return fmt.Errorf("cycle %d: %w", i, err)
+		}
+		reported, commitTs, err := deleteRow(ctx, client, txnOpts, deleteHooks())
+		if err != nil {
+			return fmt.Errorf("cycle %d: %w", i, err)
+		}
+		err = checkReported(verifyDeleted(ctx, client, commitTs), reported)
+		if err != nil && !errors.Is(err, errWriteLost) {
+			return fmt.Errorf("cycle %d: %w", i, err)
+		}
+
+		var fresh []string
+		for _, s := range watcher.usedSessions() {
+			if !slices.Contains(seen, s) {
+				fresh = append(fresh, s)
+				seen = append(seen, s)
+			}
+		}
+		log.Printf("soak: cycle %d at %s: %s; %d new session(s) %v", i, time.Since(start).Round(time.Second), outcome(err), len(fresh), fresh)
+		if err != nil {
+			lost++
+			log.Printf("soak: cycle %d: BUG: %v", i, err)
+			if *untilFail {
+				log.Printf("-until-fail: stopping after cycle %d", i)
+				break
+			}
+		}
+
+		next := start.Add(time.Duration(i) * *soakInterval)
+		if !next.Before(deadline) {
+			break
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for cycle %d: %w", i+1, ctx.Err())
+		}
+	}
+	watcher.logSummary(sessionPoolConfig())
+	log.Printf("soak: %d/%d cycles over %s lost the write; %s", lost, n, time.Since(start).Round(time.Second), estimateLoss(lost, n))
+	if lost > 0 {
+		return fmt.Errorf("%w: %d/%d soak cycles lost the write", errWriteLost, lost, n)
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"text/template"
+
+	"cloud.google.com/go/spanner"
+)
+
+// standaloneDeletes holds the Step 2 code emitted by -generate-standalone for
+// each delete mode. Each snippet may refer to ctx, client, and opts, and the
+// autocommit one, which uses the generated API client, to db and
+// multiplexed.
+var standaloneDeletes = map[string]string{
+	"stmt-mutation": `txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		log.Fatalf("begin: %v", err)
+	}
+	if err := txn.BufferWrite([]*spanner.Mutation{spanner.Delete("T", spanner.Key{1})}); err != nil {
+		log.Fatalf("buffer write: %v", err)
+	}
+	if _, err := txn.CommitWithReturnResp(ctx); err != nil {
+		log.Fatalf("commit: %v", err)
+	}`,
+	"rw-mutation": `if _, err := client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return txn.BufferWrite([]*spanner.Mutation{spanner.Delete("T", spanner.Key{1})})
+	}, opts); err != nil {
+		log.Fatalf("delete: %v", err)
+	}`,
+	"apply": `if _, err := client.Apply(ctx, []*spanner.Mutation{spanner.Delete("T", spanner.Key{1})}, spanner.ApplyCommitOptions(opts.CommitOptions)); err != nil {
+		log.Fatalf("delete: %v", err)
+	}`,
+	"stmt-dml": `txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		log.Fatalf("begin: %v", err)
+	}
+	if err := txn.Query(ctx, spanner.Statement{SQL: "DELETE FROM T WHERE PK = 1"}).Do(func(*spanner.Row) error { return nil }); err != nil {
+		log.Fatalf("query: %v", err)
+	}
+	if _, err := txn.CommitWithReturnResp(ctx); err != nil {
+		log.Fatalf("commit: %v", err)
+	}`,
+	"stmt-dml-return": `txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		log.Fatalf("begin: %v", err)
+	}
+	var returned int
+	if err := txn.Query(ctx, spanner.Statement{SQL: "DELETE FROM T WHERE PK = 1 THEN RETURN PK"}).Do(func(*spanner.Row) error { returned++; return nil }); err != nil {
+		log.Fatalf("query: %v", err)
+	}
+	log.Printf("THEN RETURN returned %d row(s)", returned)
+	if _, err := txn.CommitWithReturnResp(ctx); err != nil {
+		log.Fatalf("commit: %v", err)
+	}`,
+	"stmt-batch-dml": `txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		log.Fatalf("begin: %v", err)
+	}
+	counts, err := txn.BatchUpdate(ctx, []spanner.Statement{{SQL: "DELETE FROM T WHERE PK = 1"}})
+	if err != nil {
+		log.Fatalf("batch update: %v", err)
+	}
+	log.Printf("BatchUpdate row counts: %v", counts)
+	if _, err := txn.CommitWithReturnResp(ctx); err != nil {
+		log.Fatalf("commit: %v", err)
+	}`,
+	"rw-batch-dml": `if _, err := client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		counts, err := txn.BatchUpdate(ctx, []spanner.Statement{{SQL: "DELETE FROM T WHERE PK = 1"}})
+		log.Printf("BatchUpdate row counts: %v", counts)
+		return err
+	}, opts); err != nil {
+		log.Fatalf("delete: %v", err)
+	}`,
+	"mixed": `txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		log.Fatalf("begin: %v", err)
+	}
+	if _, err := txn.Update(ctx, spanner.Statement{SQL: "UPDATE T SET Val = Val + 1 WHERE PK = 1"}); err != nil {
+		log.Fatalf("update: %v", err)
+	}
+	if err := txn.BufferWrite([]*spanner.Mutation{spanner.Delete("T", spanner.Key{1})}); err != nil {
+		log.Fatalf("buffer write: %v", err)
+	}
+	if _, err := txn.CommitWithReturnResp(ctx); err != nil {
+		log.Fatalf("commit: %v", err)
+	}`,
+	"autocommit": `gc, err := gapic.NewClient(ctx,
+		option.WithEndpoint(os.Getenv("SPANNER_EMULATOR_HOST")),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gc.Close()
+	session, err := gc.CreateSession(ctx, &spannerpb.CreateSessionRequest{Database: db, Session: &spannerpb.Session{Multiplexed: multiplexed}})
+	if err != nil {
+		log.Fatalf("create session: %v", err)
+	}
+	rs, err := gc.ExecuteSql(ctx, &spannerpb.ExecuteSqlRequest{
+		Session: session.GetName(),
+		Transaction: &spannerpb.TransactionSelector{Selector: &spannerpb.TransactionSelector_Begin{Begin: &spannerpb.TransactionOptions{
+			Mode: &spannerpb.TransactionOptions_ReadWrite_{ReadWrite: &spannerpb.TransactionOptions_ReadWrite{}},
+		}}},
+		Sql:   "DELETE FROM T WHERE PK = 1",
+		Seqno: 1,
+	})
+	if err != nil {
+		log.Fatalf("execute sql: %v", err)
+	}
+	req := &spannerpb.CommitRequest{
+		Session:        session.GetName(),
+		Transaction:    &spannerpb.CommitRequest_TransactionId{TransactionId: rs.GetMetadata().GetTransaction().GetId()},
+		PrecommitToken: rs.GetPrecommitToken(),
+	}
+	if d := opts.CommitOptions.MaxCommitDelay; d != nil {
+		req.MaxCommitDelay = durationpb.New(*d)
+	}
+	if _, err := gc.Commit(ctx, req); err != nil {
+		log.Fatalf("commit: %v", err)
+	}`,
+	"batchwrite": `groups := []*spanner.MutationGroup{{Mutations: []*spanner.Mutation{spanner.Delete("T", spanner.Key{1})}}}
+	if err := client.BatchWriteWithOptions(ctx, groups, spanner.BatchWriteOptions{TransactionTag: opts.TransactionTag}).Do(func(r *spannerpb.BatchWriteResponse) error {
+		log.Printf("BatchWrite: groups %v: status %v", r.GetIndexes(), r.GetStatus())
+		return nil
+	}); err != nil {
+		log.Fatalf("delete: %v", err)
+	}`,
+	"pdml": `if _, err := client.PartitionedUpdate(ctx, spanner.Statement{SQL: "DELETE FROM T WHERE PK = 1"}); err != nil {
+		log.Fatalf("delete: %v", err)
+	}`,
+}
+
+// standaloneFlags are the flags whose effect -generate-standalone reproduces.
+var standaloneFlags = map[string]bool{
+	"delete":              true,
+	"begin":               true,
+	"skip-setup":          true,
+	"project":             true,
+	"instance":            true,
+	"database":            true,
+	"max-commit-delay":    true,
+	"generate-standalone": true,
+}
+
+var standaloneTemplate = template.Must(template.New("standalone").Parse(`// Standalone reproduction for https://github.com/GoogleCloudPlatform/cloud-spanner-emulator/issues/282
+//
+// Generated by spanner-mux-session-repro run {{.RunID}} with:
+//   {{.Args}}
+//
+// Run:
+//   go mod init repro && go get cloud.google.com/go/spanner@{{.SpannerVersion}}
+//   {{.Env}}SPANNER_EMULATOR_HOST=localhost:9010 go run main.go
+package main
+
+import (
+	"context"
+	"log"
+{{- if .Raw}}
+	"os"
+{{- end}}
+{{- if .MaxCommitDelay}}
+	"time"
+{{- end}}
+
+	"cloud.google.com/go/spanner"
+{{- if .Raw}}
+	gapic "cloud.google.com/go/spanner/apiv1"
+{{- end}}
+{{- if or .BatchWrite .Raw}}
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+{{- end}}
+{{- if .Setup}}
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
+	"cloud.google.com/go/spanner/admin/instance/apiv1/instancepb"
+{{- end}}
+	"google.golang.org/api/option"
+{{- if .Raw}}
+	"google.golang.org/grpc"
+{{- end}}
+	"google.golang.org/grpc/codes"
+{{- if .Raw}}
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/durationpb"
+{{- end}}
+)
+
+const db = {{printf "%q" .Database}}
+{{if .Raw}}
+// multiplexed selects the session the autocommit DELETE runs on.
+const multiplexed = {{.Multiplexed}}
+{{end}}
+func main() {
+	log.SetFlags(0)
+	ctx := context.Background()
+{{if .Setup}}
+	if err := setup(ctx); err != nil {
+		log.Fatalf("setup: %v", err)
+	}
+{{end}}
+	client, err := spanner.NewClientWithConfig(ctx, db,
+		spanner.ClientConfig{
+			DisableNativeMetrics: true,
+			SessionPoolConfig:    spanner.SessionPoolConfig{MinOpened: 1, MaxOpened: 10},
+		},
+		option.WithGRPCConnectionPool(1),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		_, err := txn.Update(ctx, spanner.Statement{SQL: "INSERT INTO T (PK, Val) VALUES (1, 1)"})
+		return err
+	}); err != nil {
+		log.Fatalf("insert: %v", err)
+	}
+{{if .MaxCommitDelay}}
+	delay := {{.MaxCommitDelay}} * time.Millisecond
+{{- end}}
+	opts := spanner.TransactionOptions{
+		BeginTransactionOption: spanner.{{.BeginOption}},
+{{- if .MaxCommitDelay}}
+		CommitOptions:          spanner.CommitOptions{MaxCommitDelay: &delay},
+{{- end}}
+	}
+	{{.Delete}}
+
+	_, err = client.Single().ReadRow(ctx, "T", spanner.Key{1}, []string{"PK"})
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+		log.Println("PASS")
+	case err != nil:
+		log.Fatalf("read: %v", err)
+	default:
+		log.Fatal("BUG: row PK=1 still exists after DELETE succeeded without error")
+	}
+}
+{{if .Setup}}
+func setup(ctx context.Context) error {
+	ic, err := instance.NewInstanceAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer ic.Close()
+
+	iop, err := ic.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     {{printf "%q" .Project}},
+		InstanceId: {{printf "%q" .InstanceID}},
+		Instance: &instancepb.Instance{
+			Config:      {{printf "%q" .InstanceConfig}},
+			DisplayName: {{printf "%q" .InstanceID}},
+			NodeCount:   1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := iop.Wait(ctx); err != nil {
+		return err
+	}
+
+	dc, err := database.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	dop, err := dc.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+		Parent:          {{printf "%q" .Instance}},
+		CreateStatement: {{printf "%q" .CreateStatement}},
+		ExtraStatements: []string{
+			{{printf "%q" .Schema}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dop.Wait(ctx)
+	return err
+}
+{{end}}`))
+
+// writeStandalone renders the active -delete/-begin configuration as a
+// single main.go that depends only on the Spanner client library, for
+// attaching to upstream bug reports.
+func writeStandalone(path string) error {
+	del, ok := standaloneDeletes[*deleteMode]
+	if !ok {
+		return fmt.Errorf("unknown delete mode: %s", *deleteMode)
+	}
+	beginOpt, err := parseBeginOption()
+	if err != nil {
+		return err
+	}
+	var ignored []string
+	flag.Visit(func(f *flag.Flag) {
+		if !standaloneFlags[f.Name] {
+			ignored = append(ignored, "-"+f.Name)
+		}
+	})
+	if len(ignored) > 0 {
+		log.Printf("Note: %s not reproduced in the standalone program", strings.Join(ignored, ", "))
+	}
+
+	args := []string{"-delete=" + *deleteMode, "-begin=" + *beginMode}
+	if *maxCommitDelay > 0 {
+		args = append(args, "-max-commit-delay="+maxCommitDelay.String())
+	}
+	if *skipSetup {
+		args = append(args, "-skip-setup")
+	}
+	var env string
+	for _, name := range []string{"GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS", "GOOGLE_CLOUD_SPANNER_MULTIPLEXED_SESSIONS_FOR_RW"} {
+		if v, ok := os.LookupEnv(name); ok {
+			env += name + "=" + v + " "
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := standaloneTemplate.Execute(&buf, map[string]any{
+		"RunID":           runID,
+		"Args":            strings.Join(args, " "),
+		"Env":             env,
+		"SpannerVersion":  moduleVersion("cloud.google.com/go/spanner"),
+		"Database":        databaseName(),
+		"Setup":           !*skipSetup,
+		"Project":         projectName(),
+		"InstanceID":      *instanceID,
+		"Instance":        instanceName(),
+		"InstanceConfig":  projectName() + "/instanceConfigs/emulator-config",
+		"CreateStatement": "CREATE DATABASE `" + *databaseID + "`",
+		"Schema":          schema,
+		"BeginOption":     beginOptionName(beginOpt),
+		"MaxCommitDelay":  maxCommitDelay.Milliseconds(),
+		"Delete":          del,
+		"BatchWrite":      *deleteMode == "batchwrite",
+		"Raw":             *deleteMode == "autocommit",
+		"Multiplexed":     multiplexedForRW(),
+	}); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("format generated source: %w", err)
+	}
+	return os.WriteFile(path, src, 0o644)
+}
+
+func beginOptionName(opt spanner.BeginTransactionOption) string {
+	switch opt {
+	case spanner.InlinedBeginTransaction:
+		return "InlinedBeginTransaction"
+	case spanner.ExplicitBeginTransaction:
+		return "ExplicitBeginTransaction"
+	default:
+		return "DefaultBeginTransaction"
+	}
+}
+
+// moduleVersion returns the version of the named dependency this binary was
+// built with, or "latest" if build information is unavailable.
+func moduleVersion(path string) string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				return dep.Version
+			}
+		}
+	}
+	return "latest"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// z95 is the standard normal quantile for a two-sided 95% interval.
+const z95 = 1.959964
+
+// lossEstimate summarizes how often the write was lost across repeated runs.
+type lossEstimate struct {
+	lost, n int
+	p       float64
+	lo, hi  float64
+}
+
+// estimateLoss computes the loss probability with a 95% Wilson score
+// interval. Unlike the normal approximation, the Wilson interval stays within
+// [0, 1] and is meaningful for the small n and extreme rates (never or always
+// lost) that reproductions typically produce.
+func estimateLoss(lost, n int) lossEstimate {
+	e := lossEstimate{lost: lost, n: n}
+	if n == 0 {
+		return e
+	}
+	nf := float64(n)
+	e.p = float64(lost) / nf
+	z2 := z95 * z95
+	center := (e.p + z2/(2*nf)) / (1 + z2/nf)
+	half := z95 / (1 + z2/nf) * math.Sqrt(e.p*(1-e.p)/nf+z2/(4*nf*nf))
+	e.lo = math.Max(0, center-half)
+	e.hi = math.Min(1, center+half)
+	return e
+}
+
+func (e lossEstimate) String() string {
+	if e.n == 0 {
+		return "loss probability unknown (n=0)"
+	}
+	return fmt.Sprintf("loss probability %.2f (95%% CI %.2f–%.2f, n=%d)", e.p, e.lo, e.hi, e.n)
+}
+
+// summarizeLatencies describes the distribution of ds as min, median, 99th
+// percentile, and max.
+func summarizeLatencies(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "n=0"
+	}
+	s := slices.Sorted(slices.Values(ds))
+	at := func(q float64) time.Duration {
+		return s[int(math.Ceil(q*float64(len(s))))-1].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("n=%d min=%s p50=%s p99=%s max=%s", len(s), s[0].Round(time.Microsecond), at(0.5), at(0.99), s[len(s)-1].Round(time.Microsecond))
+}
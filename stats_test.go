@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestEstimateLoss(t *testing.T) {
+	tests := []struct {
+		lost, n int
+		want    string
+	}{
+		{0, 0, "loss probability unknown (n=0)"},
+		{0, 10, "loss probability 0.00 (95% CI 0.00–0.28, n=10)"},
+		{5, 10, "loss probability 0.50 (95% CI 0.24–0.76, n=10)"},
+		{10, 10, "loss probability 1.00 (95% CI 0.72–1.00, n=10)"},
+		{164, 200, "loss probability 0.82 (95% CI 0.76–0.87, n=200)"},
+	}
+	for _, tt := range tests {
+		if got := estimateLoss(tt.lost, tt.n).String(); got != tt.want {
+			t.Errorf("estimateLoss(%d, %d) = %q, want %q", tt.lost, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+)
+
+// stmtAttempt is one attempt of a statement-based transaction that was
+// aborted at least once, for the log and -output=json.
+type stmtAttempt struct {
+	Phase    string `json:"phase"`
+	Attempt  int    `json:"attempt"`
+	Reset    bool   `json:"reset_for_retry"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// stmtAttempts collects the attempts of every retried statement-based
+// transaction of the run.
+var stmtAttempts struct {
+	sync.Mutex
+	list []stmtAttempt
+}
+
+// contentionRetries is the retry budget of runStmtTxn in the scenarios that
+// run transactions conflicting with each other, or abort them, on purpose:
+// without it, the emulator's aborts would end them in ERROR before the
+// write under test is ever checked.
+const contentionRetries = 10
+
+type retryBudgetKey struct{}
+
+// withRetryBudget returns ctx with n as the retry budget of runStmtTxn,
+// which -max-retries overrides when it is given.
+func withRetryBudget(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, n)
+}
+
+// retryBudget returns how many times runStmtTxn retries an aborted
+// transaction in ctx.
+func retryBudget(ctx context.Context) int {
+	if n, ok := ctx.Value(retryBudgetKey{}).(int); ok && !flagSet("max-retries") {
+		return n
+	}
+	return *maxRetries
+}
+
+// recordedStmtAttempts returns the attempts collected so far.
+func recordedStmtAttempts() []stmtAttempt {
+	stmtAttempts.Lock()
+	defer stmtAttempts.Unlock()
+	return append([]stmtAttempt(nil), stmtAttempts.list...)
+}
+
+// runStmtTxn begins a statement-based transaction, runs body in it, and
+// commits it. If body or the commit fails with Aborted, the transaction is
+// retried up to retryBudget times: with ResetForRetry, which keeps the
+// session and passes the aborted transaction's ID on, or, when the aborted
+// transaction cannot be reset, with a new transaction. body runs again on
+// each attempt and must not depend on state from an earlier one. A body
+// error that ends the transaction rolls it back.
+func runStmtTxn(ctx context.Context, client *spanner.Client, opts spanner.TransactionOptions, body func(*spanner.ReadWriteStmtBasedTransaction) error) (spanner.CommitResponse, error) {
+	txn, err := spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts)
+	if err != nil {
+		return spanner.CommitResponse{}, fmt.Errorf("begin: %w", err)
+	}
+	budget := retryBudget(ctx)
+	var attempts []stmtAttempt
+	reset := false
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		var resp spanner.CommitResponse
+		err := body(txn)
+		committed := err == nil
+		if committed {
+			resp, err = txn.CommitWithReturnResp(ctx)
+		}
+		a := stmtAttempt{Phase: currentPhase(), Attempt: attempt, Reset: reset, Duration: time.Since(start).Round(time.Microsecond).String()}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		attempts = append(attempts, a)
+		retry := spanner.ErrCode(err) == codes.Aborted && attempt <= budget
+		if !retry {
+			if err != nil && !committed {
+				txn.Rollback(ctx)
+			}
+			if len(attempts) > 1 {
+				stmtAttempts.Lock()
+				stmtAttempts.list = append(stmtAttempts.list, attempts...)
+				stmtAttempts.Unlock()
+			}
+			return resp, err
+		}
+
+		log.Printf("%s: attempt %d of the statement-based transaction aborted after %s: %v; retrying (up to %d retries)", a.Phase, attempt, a.Duration, err, budget)
+		next, rerr := txn.ResetForRetry(ctx)
+		reset = rerr == nil
+		if !reset {
+			vlogf(1, "ResetForRetry: %v; beginning a new transaction", rerr)
+			txn.Rollback(ctx)
+			if next, rerr = spanner.NewReadWriteStmtBasedTransactionWithOptions(ctx, client, opts); rerr != nil {
+				return spanner.CommitResponse{}, fmt.Errorf("begin attempt %d: %w", attempt+1, rerr)
+			}
+		}
+		txn = next
+	}
+}
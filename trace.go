@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner/apiv1/spannerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// callerDepth is the number of stack frames reported by -trace-callers.
+const callerDepth = 4
+
+// rpcCallers returns the innermost spanner and main package frames of the
+// current goroutine, which tells a test-driven Commit apart from one issued by
+// session pool maintenance. Frames in the client library's thin gRPC wrapper
+// are skipped because every RPC passes through them.
+func rpcCallers() string {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	var callers []string
+	for len(callers) < callerDepth {
+		f, more := frames.Next()
+		if (strings.HasPrefix(f.Function, "cloud.google.com/go/spanner.") && !strings.HasSuffix(f.File, "/grpc_client.go")) ||
+			strings.HasPrefix(f.Function, "main.") {
+			callers = append(callers, strings.TrimPrefix(f.Function, "cloud.google.com/go/"))
+		}
+		if !more {
+			break
+		}
+	}
+	if len(callers) == 0 {
+		return "unknown"
+	}
+	return strings.Join(callers, " <- ")
+}
+
+// sessionRecorder collects the names of the sessions a client sends requests
+// on, marking the ones the server created as multiplexed.
+type sessionRecorder struct {
+	mu          sync.Mutex
+	names       []string
+	multiplexed map[string]bool
+}
+
+func (r *sessionRecorder) clientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(r.unaryInterceptor)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(r.streamInterceptor)),
+	}
+}
+
+func (r *sessionRecorder) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if s, ok := reply.(*spannerpb.Session); ok && err == nil {
+		r.record(s.GetName(), s.GetMultiplexed())
+	}
+	r.recordRequest(req)
+	return err
+}
+
+func (r *sessionRecorder) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingStream{ClientStream: cs, rec: r}, nil
+}
+
+func (r *sessionRecorder) recordRequest(req any) {
+	if s, ok := req.(interface{ GetSession() string }); ok && s.GetSession() != "" {
+		r.record(s.GetSession(), false)
+	}
+}
+
+func (r *sessionRecorder) record(name string, multiplexed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.multiplexed == nil {
+		r.multiplexed = make(map[string]bool)
+	}
+	if _, ok := r.multiplexed[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.multiplexed[name] = r.multiplexed[name] || multiplexed
+}
+
+func (r *sessionRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.names) == 0 {
+		return "none"
+	}
+	var b strings.Builder
+	for i, name := range r.names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		if r.multiplexed[name] {
+			b.WriteString(" (multiplexed)")
+		}
+	}
+	return b.String()
+}
+
+// recordingStream records the session of requests sent on a streaming RPC
+// such as ExecuteStreamingSql.
+type recordingStream struct {
+	grpc.ClientStream
+	rec *sessionRecorder
+}
+
+func (s *recordingStream) SendMsg(m any) error {
+	s.rec.recordRequest(m)
+	return s.ClientStream.SendMsg(m)
+}
+
+// rpcTraceLevel is the detail the RPC trace logs each RPC in, selected by
+// the most detailed of -trace-callers, -trace-rpc, and -trace.
+type rpcTraceLevel int
+
+const (
+	traceOff rpcTraceLevel = iota
+	// traceMethods logs the method of each request only.
+	traceMethods
+	// traceSummary logs Commit and BeginTransaction requests in full and
+	// other requests with their session and transaction selector; of the
+	// responses, whether a new session is multiplexed, the transactions,
+	// and the commits.
+	traceSummary
+	// traceFull logs every request and response in full as protojson.
+	traceFull
+)
+
+// rpcTraceDetail returns the level of the RPC trace the flags select.
+func rpcTraceDetail() rpcTraceLevel {
+	switch {
+	case *traceWire:
+		return traceFull
+	case *traceRPC:
+		return traceSummary
+	case *traceCallers:
+		return traceMethods
+	}
+	return traceOff
+}
+
+// prefix marks the lines of the trace; report tells -trace's apart by it.
+func (l rpcTraceLevel) prefix() string {
+	if l == traceFull {
+		return "TRACE"
+	}
+	return "RPC"
+}
+
+// logRequest logs req, sent on method with the routing header routing, and
+// with -trace-callers the frames that initiated the RPC.
+func (l rpcTraceLevel) logRequest(method string, req any, routing, callers string) {
+	line := l.prefix() + "> " + method
+	switch l {
+	case traceFull:
+		line += " " + protoJSON(req) + routing
+	case traceSummary:
+		line += " " + describeRequest(req) + routing
+	}
+	if callers != "" {
+		line += " from " + callers
+	}
+	log.Print(line)
+}
+
+// logResponse logs the reply to method, or the error it failed with.
+func (l rpcTraceLevel) logResponse(method string, reply any, err error) {
+	switch {
+	case l < traceSummary:
+	case err != nil:
+		log.Printf("%s< %s error: %v", l.prefix(), method, err)
+	case l == traceFull:
+		log.Printf("TRACE< %s %s", method, protoJSON(reply))
+	default:
+		switch r := reply.(type) {
+		case *spannerpb.Session:
+			log.Printf("RPC< %s session=%s multiplexed=%t", method, r.GetName(), r.GetMultiplexed())
+		case *spannerpb.BatchCreateSessionsResponse:
+			log.Printf("RPC< %s %d regular sessions", method, len(r.GetSession()))
+		case *spannerpb.Transaction, *spannerpb.CommitResponse, *spannerpb.ExecuteBatchDmlResponse:
+			log.Printf("RPC< %s %s", method, prototext.Format(r.(proto.Message)))
+		case *spannerpb.ResultSet:
+			log.Printf("RPC< %s transaction=%s", method, prototext.Format(r.GetMetadata().GetTransaction()))
+		case *spannerpb.PartialResultSet:
+			if tx := r.GetMetadata().GetTransaction(); tx != nil {
+				log.Printf("RPC< %s transaction=%s", method, prototext.Format(tx))
+			}
+		}
+	}
+}
+
+// rpcTraceUnaryInterceptor and rpcTraceStreamInterceptor implement -trace,
+// -trace-rpc, and -trace-callers: they log every RPC at the rpcTraceDetail
+// level.
+func rpcTraceUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	l := rpcTraceDetail()
+	var callers string
+	if *traceCallers {
+		callers = rpcCallers()
+	}
+	l.logRequest(method, req, routingHeader(ctx), callers)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	l.logResponse(method, reply, err)
+	return err
+}
+
+func rpcTraceStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	l := rpcTraceDetail()
+	var callers string
+	if *traceCallers {
+		callers = rpcCallers()
+	}
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		log.Printf("%s> %s error: %v", l.prefix(), method, err)
+		return nil, err
+	}
+	return &tracingStream{ClientStream: cs, level: l, method: method, routing: routingHeader(ctx), callers: callers}, nil
+}
+
+// routeToLeaderHeader is the metadata header with which the client library
+// asks for a request to be routed to the leader, unless
+// -route-to-leader=false.
+const routeToLeaderHeader = "x-goog-spanner-route-to-leader"
+
+// routingHeader renders the route-to-leader header of the outgoing metadata
+// of ctx for the traces, or returns "" if the request does not carry it.
+func routingHeader(ctx context.Context) string {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if v := md.Get(routeToLeaderHeader); len(v) > 0 {
+		return " " + routeToLeaderHeader + "=" + strings.Join(v, ",")
+	}
+	return ""
+}
+
+// describeRequest renders req for traceSummary.
+func describeRequest(req any) string {
+	switch r := req.(type) {
+	case *spannerpb.CommitRequest, *spannerpb.BeginTransactionRequest:
+		return prototext.Format(r.(proto.Message))
+	}
+	var parts []string
+	if s, ok := req.(interface{ GetSession() string }); ok && s.GetSession() != "" {
+		parts = append(parts, "session="+s.GetSession())
+	}
+	if t, ok := req.(interface {
+		GetTransaction() *spannerpb.TransactionSelector
+	}); ok && t.GetTransaction() != nil {
+		parts = append(parts, "transaction={"+prototext.Format(t.GetTransaction())+"}")
+	}
+	if o, ok := req.(interface {
+		GetRequestOptions() *spannerpb.RequestOptions
+	}); ok && o.GetRequestOptions() != nil {
+		if tag := o.GetRequestOptions().GetRequestTag(); tag != "" {
+			parts = append(parts, "request_tag="+tag)
+		}
+		if tag := o.GetRequestOptions().GetTransactionTag(); tag != "" {
+			parts = append(parts, "transaction_tag="+tag)
+		}
+		if p := o.GetRequestOptions().GetPriority(); p != spannerpb.RequestOptions_PRIORITY_UNSPECIFIED {
+			parts = append(parts, "priority="+p.String())
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// setRequestOptions sets -request-tag on req if it is a read, query, or DML
+// request without a request tag of its own, and -priority on it if it is
+// one of those or a commit.
+func setRequestOptions(req any) {
+	var opts **spannerpb.RequestOptions
+	tagged := true
+	switch r := req.(type) {
+	case *spannerpb.ExecuteSqlRequest:
+		opts = &r.RequestOptions
+	case *spannerpb.ExecuteBatchDmlRequest:
+		opts = &r.RequestOptions
+	case *spannerpb.ReadRequest:
+		opts = &r.RequestOptions
+	case *spannerpb.CommitRequest:
+		opts, tagged = &r.RequestOptions, false
+	case *spannerpb.BatchWriteRequest:
+		opts, tagged = &r.RequestOptions, false
+	default:
+		return
+	}
+	if *opts == nil {
+		*opts = &spannerpb.RequestOptions{}
+	}
+	if tagged && (*opts).RequestTag == "" {
+		(*opts).RequestTag = *requestTag
+	}
+	// Validated in main.
+	if p, _ := requestPriority(); p != spannerpb.RequestOptions_PRIORITY_UNSPECIFIED {
+		(*opts).Priority = p
+	}
+}
+
+// requestOptionsUnaryInterceptor and requestOptionsStreamInterceptor
+// implement -request-tag and -priority. The client library only sets either
+// on requests made with explicit options, so they are set on the wire
+// instead, alike for every -delete mode.
+func requestOptionsUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	setRequestOptions(req)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func requestOptionsStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &requestOptionsStream{ClientStream: cs}, nil
+}
+
+// requestOptionsStream sets -request-tag and -priority on the request of a
+// streaming RPC.
+type requestOptionsStream struct {
+	grpc.ClientStream
+}
+
+func (s *requestOptionsStream) SendMsg(m any) error {
+	setRequestOptions(m)
+	return s.ClientStream.SendMsg(m)
+}
+
+// tracingStream logs the messages of a streaming RPC such as
+// ExecuteStreamingSql: every one with -trace, and otherwise the requests and
+// the transaction returned in the first response when the request began one
+// inline.
+type tracingStream struct {
+	grpc.ClientStream
+	level                    rpcTraceLevel
+	method, routing, callers string
+	received                 bool
+}
+
+func (s *tracingStream) SendMsg(m any) error {
+	s.level.logRequest(s.method, m, s.routing, s.callers)
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *tracingStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case errors.Is(err, io.EOF):
+	case err != nil, s.level == traceFull, !s.received:
+		s.level.logResponse(s.method, m, err)
+	}
+	s.received = true
+	return err
+}
+
+// vlogf logs like log.Printf if -v is at least level.
+func vlogf(level int, format string, args ...any) {
+	if *verbosity >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// rpcTimingUnaryInterceptor logs each unary RPC's method, status code, and
+// duration at -v=2. A Commit that returns in well under the emulator's usual
+// latency has not done the work it reports.
+func rpcTimingUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	vlogf(2, "RPC %s %s in %s", method, status.Code(err), time.Since(start).Round(time.Microsecond))
+	return err
+}
+
+func rpcTimingStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		vlogf(2, "RPC %s %s in %s", method, status.Code(err), time.Since(start).Round(time.Microsecond))
+		return nil, err
+	}
+	return &timingStream{ClientStream: cs, method: method, start: start}, nil
+}
+
+// timingStream logs the duration of a streaming RPC, from its start until
+// the stream ends, at -v=2.
+type timingStream struct {
+	grpc.ClientStream
+	method string
+	start  time.Time
+	done   bool
+}
+
+func (s *timingStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && !s.done {
+		s.done = true
+		code := status.Code(err)
+		if errors.Is(err, io.EOF) {
+			code = status.Code(nil)
+		}
+		vlogf(2, "RPC %s %s in %s", s.method, code, time.Since(s.start).Round(time.Microsecond))
+	}
+	return err
+}
+
+// protoJSON renders a gRPC message as single-line protojson.
+func protoJSON(m any) string {
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return fmt.Sprintf("%v", m)
+	}
+	b, err := protojson.Marshal(pm)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return string(b)
+}
+
+// commitResponseInterceptor logs every CommitResponse in full at -v=1. The
+// client library returns only the commit timestamp and stats of a commit,
+// and of Apply not even those; the response itself also says whether the
+// server wants the commit retried with a newer precommit token.
+func commitResponseInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if resp, ok := reply.(*spannerpb.CommitResponse); ok && err == nil {
+		vlogf(1, "CommitResponse: %s", protoJSON(resp))
+	}
+	return err
+}
+
+// commitStatsKey is the context key of the commitStatsRecord that
+// commitStatsInterceptor fills in.
+type commitStatsKey struct{}
+
+// commitStatsRecord holds the mutation counts of the Commit RPCs made with
+// one context. The client library does not return commit stats from Apply,
+// so -commit-stats reads them off the wire for every -delete mode alike.
+type commitStatsRecord struct {
+	mu     sync.Mutex
+	counts []int64
+}
+
+// withCommitStats returns ctx with a commitStatsRecord attached, which
+// collects the commit stats of Commit RPCs made with the returned context.
+func withCommitStats(ctx context.Context) (context.Context, *commitStatsRecord) {
+	r := &commitStatsRecord{}
+	return context.WithValue(ctx, commitStatsKey{}, r), r
+}
+
+func commitStatsInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	r, ok := ctx.Value(commitStatsKey{}).(*commitStatsRecord)
+	if resp, isCommit := reply.(*spannerpb.CommitResponse); ok && isCommit && err == nil && resp.GetCommitStats() != nil {
+		r.mu.Lock()
+		r.counts = append(r.counts, resp.GetCommitStats().GetMutationCount())
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// checkCommitStats implements -commit-stats for the write label: the last
+// commit made for it must report at least one mutation. A commit that
+// returned OK with no mutations dropped the write before verification reads
+// anything. A write with no commit stats at all checked nothing, which is
+// inconclusive rather than a pass.
+func checkCommitStats(label string, r *commitStatsRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.counts) == 0 {
+		return fmt.Errorf("%w: commit stats: no Commit RPC with commit stats for %s with -delete=%s", errInconclusive, label, *deleteMode)
+	}
+	n := r.counts[len(r.counts)-1]
+	log.Printf("commit stats: %s commit reported MutationCount=%d", label, n)
+	if n == 0 {
+		return fmt.Errorf("%w: %s commit returned OK with CommitStats.MutationCount=0", errWriteLost, label)
+	}
+	return nil
+}
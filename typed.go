@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/civil"
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/sourcecontextpb"
+	"google.golang.org/protobuf/types/known/typepb"
+)
+
+// typedTable is the table -typed-values writes, with a column of every type
+// but STRUCT, which cannot be stored, and arrays of INT64 and STRING. Its
+// PROTO column holds a google.protobuf.Duration and its ENUM column a
+// google.protobuf.Syntax, from the proto bundle setup creates along with
+// it. Setup creates both only for that mode, and only in GoogleSQL.
+const typedTable = "Typed"
+
+// typedColumnDefs are the columns of typedTable and their types.
+var typedColumnDefs = [][2]string{
+	{"PK", "INT64 NOT NULL"},
+	{"S", "STRING(MAX)"},
+	{"B", "BYTES(MAX)"},
+	{"N", "NUMERIC"},
+	{"J", "JSON"},
+	{"Ts", "TIMESTAMP OPTIONS (allow_commit_timestamp = true)"},
+	{"A", "ARRAY<INT64>"},
+	{"P", "`google.protobuf.Duration`"},
+	{"Bo", "BOOL"},
+	{"F", "FLOAT64"},
+	{"F32", "FLOAT32"},
+	{"D", "DATE"},
+	{"E", "`google.protobuf.Syntax`"},
+	{"SA", "ARRAY<STRING(MAX)>"},
+}
+
+// typedProtoTypes are the types of the proto bundle of typedTable.
+var typedProtoTypes = []string{"google.protobuf.Duration", "google.protobuf.Syntax"}
+
+var typedColumns = func() []string {
+	var names []string
+	for _, c := range typedColumnDefs {
+		names = append(names, c[0])
+	}
+	return names
+}()
+
+// ensureTypedTable creates typedTable and its proto bundle in the database
+// db if it does not have them yet. A table or bundle left by an earlier
+// version of the mode gets the columns and types it lacks.
+func ensureTypedTable(ctx context.Context, dc *database.DatabaseAdminClient, db string) error {
+	resp, err := dc.GetDatabaseDdl(ctx, &databasepb.GetDatabaseDdlRequest{Database: db})
+	if err != nil {
+		return fmt.Errorf("get database DDL: %w", err)
+	}
+	var table, bundle string
+	for _, stmt := range resp.GetStatements() {
+		switch {
+		case strings.HasPrefix(stmt, "CREATE TABLE "+typedTable+" "):
+			table = stmt
+		case strings.HasPrefix(stmt, "CREATE PROTO BUNDLE"):
+			bundle = stmt
+		}
+	}
+	var ddl, missing []string
+	for _, t := range typedProtoTypes {
+		if !strings.Contains(bundle, t) {
+			missing = append(missing, "`"+t+"`")
+		}
+	}
+	switch {
+	case bundle == "":
+		ddl = append(ddl, "CREATE PROTO BUNDLE ("+strings.Join(missing, ", ")+")")
+	case len(missing) > 0:
+		ddl = append(ddl, "ALTER PROTO BUNDLE INSERT ("+strings.Join(missing, ", ")+")")
+	}
+	if table == "" {
+		var cols []string
+		for _, c := range typedColumnDefs {
+			cols = append(cols, c[0]+" "+c[1])
+		}
+		ddl = append(ddl, "CREATE TABLE "+typedTable+" ("+strings.Join(cols, ", ")+") PRIMARY KEY (PK)")
+	} else {
+		for _, c := range typedColumnDefs {
+			if !regexp.MustCompile(`(?m)^\s*` + c[0] + `\s`).MatchString(table) {
+				ddl = append(ddl, "ALTER TABLE "+typedTable+" ADD COLUMN "+c[0]+" "+c[1])
+			}
+		}
+	}
+	if len(ddl) == 0 {
+		return nil
+	}
+	var files []*descriptorpb.FileDescriptorProto
+	for _, f := range []protoreflect.FileDescriptor{
+		durationpb.File_google_protobuf_duration_proto,
+		anypb.File_google_protobuf_any_proto,
+		sourcecontextpb.File_google_protobuf_source_context_proto,
+		typepb.File_google_protobuf_type_proto,
+	} {
+		files = append(files, protodesc.ToFileDescriptorProto(f))
+	}
+	descriptors, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: files})
+	if err != nil {
+		return err
+	}
+	op, err := dc.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:         db,
+		Statements:       ddl,
+		ProtoDescriptors: descriptors,
+	})
+	if err != nil {
+		return err
+	}
+	return op.Wait(ctx)
+}
+
+// typedRow is a row of typedTable but its key and commit timestamp.
+type typedRow struct {
+	S   spanner.NullString
+	B   []byte
+	N   spanner.NullNumeric
+	J   spanner.NullJSON
+	A   []int64
+	P   spanner.NullProtoMessage
+	Bo  spanner.NullBool
+	F   spanner.NullFloat64
+	F32 spanner.NullFloat32
+	D   spanner.NullDate
+	E   spanner.NullProtoEnum
+	SA  []spanner.NullString
+}
+
+// typedRows are the values -typed-values writes to PK=1, first as an insert
+// and then as an update: non-ASCII text, bytes outside UTF-8, a NUMERIC
+// beyond float64 precision, nested JSON, floats without an exact decimal
+// form, a leap day, and a STRING array with a NULL element, and then NULL
+// in every nullable column but A, which becomes an empty array, and S, an
+// empty string.
+var typedRows = []typedRow{
+	{
+		S:   spanner.NullString{StringVal: "héllo, 世界", Valid: true},
+		B:   []byte{0, 1, 2, 0xff},
+		N:   spanner.NullNumeric{Numeric: *new(big.Rat).SetFrac64(123456789012345678, 1000000000), Valid: true},
+		J:   spanner.NullJSON{Value: map[string]any{"a": 1, "b": []any{true, nil, "x"}}, Valid: true},
+		A:   []int64{1, -2, 3},
+		P:   spanner.NullProtoMessage{ProtoMessageVal: durationpb.New(90*time.Second + 5*time.Millisecond), Valid: true},
+		Bo:  spanner.NullBool{Bool: true, Valid: true},
+		F:   spanner.NullFloat64{Float64: 0.1, Valid: true},
+		F32: spanner.NullFloat32{Float32: 1.0 / 3, Valid: true},
+		D:   spanner.NullDate{Date: civil.Date{Year: 2024, Month: time.February, Day: 29}, Valid: true},
+		E:   spanner.NullProtoEnum{ProtoEnumVal: typepb.Syntax_SYNTAX_PROTO3.Enum(), Valid: true},
+		SA:  []spanner.NullString{{StringVal: "a", Valid: true}, {}, {StringVal: "", Valid: true}},
+	},
+	{
+		S: spanner.NullString{Valid: true},
+		A: []int64{},
+	},
+}
+
+// writeTyped writes r to PK=1 with the -delete mode: buffered mutations for
+// the mutation modes, DML for stmt-dml. Ts is the commit timestamp.
+func writeTyped(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions, r typedRow) (time.Time, error) {
+	if *deleteMode != "stmt-dml" {
+		return commitMutations(ctx, client, txnOpts, []*spanner.Mutation{
+			spanner.InsertOrUpdate(typedTable, typedColumns, []any{int64(1), r.S, r.B, r.N, r.J, spanner.CommitTimestamp, r.A, r.P, r.Bo, r.F, r.F32, r.D, r.E, r.SA}),
+		})
+	}
+	// A NULL proto or enum parameter has no type for the server to check
+	// P or E against, so NULL is written as a literal.
+	p, e := "@p", "@e"
+	params := map[string]any{"s": r.S, "b": r.B, "n": r.N, "j": r.J, "a": r.A, "bo": r.Bo, "f": r.F, "f32": r.F32, "d": r.D, "sa": r.SA}
+	if r.P.Valid {
+		params["p"] = r.P
+	} else {
+		p = "NULL"
+	}
+	if r.E.Valid {
+		params["e"] = r.E
+	} else {
+		e = "NULL"
+	}
+	commitTs, _, err := execStmtDML(ctx, client, txnOpts, txnHooks{}, spanner.Statement{
+		SQL: "INSERT OR UPDATE INTO " + typedTable + " (" + strings.Join(typedColumns, ", ") + ") VALUES (1, @s, @b, @n, @j, PENDING_COMMIT_TIMESTAMP(), @a, " +
+			p + ", @bo, @f, @f32, @d, " + e + ", @sa)",
+		Params: params,
+	})
+	return commitTs, err
+}
+
+// deleteTyped deletes PK=1 with the -delete mode.
+func deleteTyped(ctx context.Context, client *spanner.Client, txnOpts spanner.TransactionOptions) (time.Time, error) {
+	if *deleteMode != "stmt-dml" {
+		return commitMutations(ctx, client, txnOpts, []*spanner.Mutation{spanner.Delete(typedTable, spanner.Key{1})})
+	}
+	commitTs, _, err := execStmtDML(ctx, client, txnOpts, txnHooks{}, spanner.Statement{SQL: "DELETE FROM " + typedTable + " WHERE PK = 1"})
+	return commitTs, err
+}
+
+// readTyped reads PK=1 of typedTable, returning false if it does not exist.
+func readTyped(ctx context.Context, client *spanner.Client) (typedRow, time.Time, bool, error) {
+	row, err := client.Single().ReadRow(ctx, typedTable, spanner.Key{1}, typedColumns[1:])
+	if spanner.ErrCode(err) == codes.NotFound {
+		return typedRow{}, time.Time{}, false, nil
+	}
+	if err != nil {
+		return typedRow{}, time.Time{}, false, fmt.Errorf("read: %w", err)
+	}
+	var r typedRow
+	var ts spanner.NullTime
+	r.P.ProtoMessageVal = &durationpb.Duration{}
+	r.E.ProtoEnumVal = new(typepb.Syntax)
+	if err := row.Columns(&r.S, &r.B, &r.N, &r.J, &ts, &r.A, &r.P, &r.Bo, &r.F, &r.F32, &r.D, &r.E, &r.SA); err != nil {
+		return typedRow{}, time.Time{}, false, fmt.Errorf("scan: %w", err)
+	}
+	return r, ts.Time, true, nil
+}
+
+// diffTyped describes the columns in which got differs from want. NULL
+// differs from an empty string, byte string, or array, and JSON is compared
+// by value rather than by its text, which the server may normalize.
+func diffTyped(want, got typedRow) []string {
+	var diffs []string
+	add := func(col string, got, want any) {
+		diffs = append(diffs, fmt.Sprintf("%s=%v, expected %v", col, got, want))
+	}
+	if want.S != got.S {
+		add("S", got.S, want.S)
+	}
+	if (want.B == nil) != (got.B == nil) || !bytes.Equal(want.B, got.B) {
+		add("B", got.B, want.B)
+	}
+	if want.N.Valid != got.N.Valid || want.N.Numeric.Cmp(&got.N.Numeric) != 0 {
+		add("N", got.N, want.N)
+	}
+	if !reflect.DeepEqual(jsonValue(want.J), jsonValue(got.J)) {
+		add("J", got.J, want.J)
+	}
+	if (want.A == nil) != (got.A == nil) || !slices.Equal(want.A, got.A) {
+		add("A", got.A, want.A)
+	}
+	if want.P.Valid != got.P.Valid || want.P.Valid && !proto.Equal(want.P.ProtoMessageVal, got.P.ProtoMessageVal) {
+		add("P", got.P, want.P)
+	}
+	if want.Bo != got.Bo {
+		add("Bo", got.Bo, want.Bo)
+	}
+	if want.F != got.F {
+		add("F", got.F, want.F)
+	}
+	if want.F32 != got.F32 {
+		add("F32", got.F32, want.F32)
+	}
+	if want.D != got.D {
+		add("D", got.D, want.D)
+	}
+	if want.E.Valid != got.E.Valid || want.E.Valid && want.E.ProtoEnumVal.Number() != got.E.ProtoEnumVal.Number() {
+		add("E", got.E, want.E)
+	}
+	if (want.SA == nil) != (got.SA == nil) || !slices.Equal(want.SA, got.SA) {
+		add("SA", got.SA, want.SA)
+	}
+	return diffs
+}
+
+// jsonValue returns j decoded as encoding/json decodes it, or nil for NULL.
+func jsonValue(j spanner.NullJSON) any {
+	if !j.Valid {
+		return nil
+	}
+	b, err := json.Marshal(j.Value)
+	if err != nil {
+		return err.Error()
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err.Error()
+	}
+	return v
+}
+
+// reproduceTypedValues writes PK=1 of typedTable with the -delete mode,
+// reads it back and compares every column, overwrites it with NULLs and
+// empty values and compares again, and finally deletes it and checks that
+// it is gone. Ts must be the commit timestamp of each write. A value that
+// reads back other than written, or a row that survives its delete, was
+// lost on the way through the transaction.
+func reproduceTypedValues(ctx context.Context) error {
+	switch *deleteMode {
+	case "stmt-mutation", "rw-mutation", "apply", "batchwrite", "stmt-dml":
+	default:
+		return fmt.Errorf("-typed-values supports -delete=stmt-mutation, rw-mutation, apply, batchwrite, and stmt-dml, not %s", *deleteMode)
+	}
+	txnOpts, err := transactionOptions()
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if _, err := client.Apply(ctx, []*spanner.Mutation{spanner.Delete(typedTable, spanner.AllKeys())}, spanner.TransactionTag(runTag())); err != nil {
+		return fmt.Errorf("clear %s: %w", typedTable, err)
+	}
+
+	for i, want := range typedRows {
+		label := "INSERT"
+		if i > 0 {
+			label = "UPDATE"
+		}
+		enterPhase(strings.ToLower(label))
+		commitTs, err := writeTyped(ctx, client, txnOpts, want)
+		if err != nil {
+			return stepError(stepInsert, fmt.Errorf("%s %s: %w", strings.ToLower(label), typedTable, err))
+		}
+		log.Printf("%s %s PK=1 (-delete=%s) committed at %s", label, typedTable, *deleteMode, commitTs.Format(time.RFC3339Nano))
+
+		enterPhase("verify")
+		got, ts, exists, err := readTyped(ctx, client)
+		if err != nil {
+			return stepError(stepVerify, err)
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s of %s PK=1 committed, but the row does not exist", errWriteLost, label, typedTable)
+		}
+		diffs := diffTyped(want, got)
+		if !commitTs.IsZero() && !ts.Equal(commitTs) {
+			diffs = append(diffs, fmt.Sprintf("Ts=%s, expected the commit timestamp %s", ts.Format(time.RFC3339Nano), commitTs.Format(time.RFC3339Nano)))
+		}
+		if len(diffs) > 0 {
+			return fmt.Errorf("%w: %s of %s PK=1 committed, but %s", errWriteLost, label, typedTable, strings.Join(diffs, "; "))
+		}
+		log.Printf("verify: %s PK=1 reads back as written", typedTable)
+	}
+
+	enterPhase("delete")
+	commitTs, err := deleteTyped(ctx, client, txnOpts)
+	if err != nil {
+		return stepError(stepDelete, fmt.Errorf("delete %s: %w", typedTable, err))
+	}
+	log.Printf("DELETE %s PK=1 committed at %s", typedTable, commitTs.Format(time.RFC3339Nano))
+	enterPhase("verify")
+	if _, _, exists, err := readTyped(ctx, client); err != nil {
+		return stepError(stepVerify, err)
+	} else if exists {
+		return fmt.Errorf("%w: DELETE of %s PK=1 committed, but the row still exists", errWriteLost, typedTable)
+	}
+	return nil
+}